@@ -0,0 +1,9 @@
+package main
+
+import (
+	"esterpad_sync"
+)
+
+func main() {
+	esterpad_sync.Main()
+}
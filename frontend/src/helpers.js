@@ -29,3 +29,7 @@ export let permsMask = {
   mod: (1 << 5),
   admin: (1 << 6)
 }
+
+// CodeMirror positions count UTF-16 code units, the server counts code points
+// unless asked otherwise in EnterPad
+export const OFFSET_UNIT_UTF16 = 1
@@ -46,7 +46,7 @@ router.beforeEach((to, from, next) => {
 
   if (to.matched.some(record => record.meta.updatesPadId)) {
     let pid = to.params.padId
-    if (pid.indexOf('.') !== -1 || pid.indexOf('/') !== -1) {
+    if (pid.indexOf('.') !== -1 || pid.split('/').some(part => !part.trim())) {
       bus.$emit('snack-msg', 'Error 404, redirecting you to main page')
       next('/')
       return
@@ -125,6 +125,7 @@ bus.$on('send', function () {
 
 conn.onopen = function (evt) {
   log.debug('WS connected')
+  bus.$emit('send', 'Hello', {version: 1, capabilities: 5, client: 'esterpad_frontend'})
   if (state.sessId) {
     bus.$emit('send', 'Session', {sessId: state.sessId})
   } else {
@@ -153,6 +154,8 @@ conn.onmessage = function (evt) {
       state.userColor = num2color(message.Auth.color)
       if (message.Auth.sessId) {
         state.sessId = message.Auth.sessId
+        // uploads and search over http read the session from the cookie
+        document.cookie = 'sessid=' + message.Auth.sessId + '; path=/; SameSite=Strict'
       }
       state.perms = {
         notGuest: Boolean(message.Auth.perms & permsMask.notGuest),
@@ -163,7 +166,6 @@ conn.onmessage = function (evt) {
         mod: Boolean(message.Auth.perms & permsMask.mod),
         admin: Boolean(message.Auth.perms & permsMask.admin)
       }
-      state.padList = []
       let loginPage = (['/.login', '/.register'].indexOf(router.currentRoute.path) >= 0)
       if (loginPage && 'go' in router.currentRoute.query) {
         router.push(router.currentRoute.query['go'])
@@ -185,20 +187,24 @@ conn.onmessage = function (evt) {
       bus.$emit('new-delta', message.Delta)
     } else if (message.Document !== null) { // Document revision
       bus.$emit('document', message.Document)
-    } else if (message.AuthError) {
+    } else if (message.PadState) {
+      if (state.padId && message.PadState.name !== state.padId) { // pad renamed
+        state.padId = message.PadState.name
+        router.replace({params: {padId: message.PadState.name}})
+      }
+    } else if (message.Hello) {
+      log.debug('Server protocol version', message.Hello.version, 'capabilities', message.Hello.capabilities)
+    } else if (message.Error) {
       state.loading = false
 
-      let error = ''
-      switch (message.AuthError.error) {
+      let error = message.Error.message
+      switch (message.Error.code) {
         case 1:
           error = 'Invalid username or password'
           break
         case 2:
           error = 'User with this email already exists'
           break
-        case 3:
-          error = 'Unknown login error'
-          break
         case 4:
           state.sessId = ''
           error = 'Your session invalidated, please log in'
@@ -209,12 +215,22 @@ conn.onmessage = function (evt) {
             })
           }
           break
-        default:
-          error = 'Error #' + error
+        case 5:
+          if (message.Error.request === 'Login') {
+            error = 'Too many login attempts, please try again later'
+          }
+          break
+        case 6:
+          error = 'You are banned'
+          break
       }
       bus.$emit('snack-msg', error)
-    } else if (message.PadList !== null) {
-      state.padList = state.padList.concat(message.PadList.pads)
+    } else if (message.PadPage) { // Requested page of the pad list
+      let pads = message.PadPage.pads.map(pad => pad.name)
+      state.padList = message.PadPage.offset ? state.padList.concat(pads) : pads
+    } else if (message.PadList) { // Pads created, renamed or removed
+      let removed = message.PadList.removed.concat(message.PadList.pads)
+      state.padList = state.padList.filter(pad => removed.indexOf(pad) < 0).concat(message.PadList.pads).sort()
     } else {
       log.error('Unknown message type', message)
     }
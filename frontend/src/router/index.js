@@ -65,7 +65,7 @@ export default new Router({
       redirect: '/.padlist'
     },
     {
-      path: '/:padId',
+      path: '/:padId(.+?)', // folder pads have slashes in names
       component: Pad,
       children: [
         {path: '', component: Editor},
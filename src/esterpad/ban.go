@@ -0,0 +1,236 @@
+/*
+Esterpad online collaborative editor
+Copyright (C) 2017 Anon2Anon
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package esterpad
+
+import (
+	. "esterpad_utils"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PBan bans a user, an IP or a CIDR range until ExpireTime, a zero
+// ExpireTime bans forever. Bans are guarded by BanMutex.
+type PBan struct {
+	Id         uint32
+	UserId     uint32
+	Net        *net.IPNet
+	ExpireTime time.Time
+	Reason     string
+	ModId      uint32
+}
+
+// ClientDisconnect makes WritePump flush its buffer and close the connection.
+type ClientDisconnect struct {
+	Reason string
+}
+
+var (
+	banLogger         = LogInit("ban")
+	BanMap            = map[uint32]*PBan{}
+	BanCounter uint32 = 0
+	BanMutex          = &sync.RWMutex{}
+)
+
+// BanParseNet parses an IP or a CIDR range.
+func BanParseNet(s string) *net.IPNet {
+	s = strings.TrimSpace(s)
+	if strings.IndexByte(s, '/') >= 0 {
+		if _, ipNet, err := net.ParseCIDR(s); err == nil {
+			return ipNet
+		}
+		return nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+// banParseIp parses the client address, which is the first one of
+// x-forwarded-for behind a proxy.
+func banParseIp(s string) net.IP {
+	if i := strings.IndexByte(s, ','); i >= 0 {
+		s = s[:i]
+	}
+	return net.ParseIP(strings.TrimSpace(s))
+}
+
+func (b *PBan) Matches(userId uint32, ip net.IP, now time.Time) bool {
+	if !b.ExpireTime.IsZero() && !now.Before(b.ExpireTime) {
+		return false
+	}
+	if b.Net != nil {
+		return ip != nil && b.Net.Contains(ip)
+	}
+	return userId != 0 && b.UserId == userId
+}
+
+// BanFind returns an active ban of userId or ip or nil.
+func BanFind(userId uint32, ip string) *PBan {
+	parsedIp := banParseIp(ip)
+	now := time.Now()
+	BanMutex.RLock()
+	defer BanMutex.RUnlock()
+	for _, ban := range BanMap {
+		if ban.Matches(userId, parsedIp, now) {
+			return ban
+		}
+	}
+	return nil
+}
+
+// banTarget builds a ban of user id or ip, moderators can't ban other
+// moderators by user id.
+func banTarget(mod *User, userId uint32, ip string) *PBan {
+	ban := &PBan{ModId: mod.Id}
+	if len(ip) > 0 {
+		if ban.Net = BanParseNet(ip); ban.Net == nil {
+			return nil
+		}
+		return ban
+	}
+	user := CacherGetUser(userId)
+	if user == nil || user == mod || mod.Perms&PERM_ADMIN == 0 && user.Perms&(PERM_MOD|PERM_ADMIN) != 0 {
+		return nil
+	}
+	ban.UserId = userId
+	return ban
+}
+
+func BanAdd(mod *User, message *CBan) bool {
+	ban := banTarget(mod, message.UserId, message.Ip)
+	if ban == nil {
+		return false
+	}
+	if message.Duration != 0 {
+		ban.ExpireTime = time.Now().Add(time.Duration(message.Duration) * time.Second)
+	}
+	ban.Reason = strings.TrimSpace(message.Reason)
+	BanMutex.Lock()
+	BanCounter++
+	ban.Id = BanCounter
+	BanMap[ban.Id] = ban
+	BanMutex.Unlock()
+	banLogger.Log(LOG_INFO, mod.Id, "ban", ban.Id, ban.UserId, ban.Net, ban.ExpireTime)
+	MongoInsertBan(ban)
+	banDisconnect(ban)
+	return true
+}
+
+// BanKick disconnects matching clients without banning them.
+func BanKick(mod *User, message *CKick) bool {
+	ban := banTarget(mod, message.UserId, message.Ip)
+	if ban == nil {
+		return false
+	}
+	banLogger.Log(LOG_INFO, mod.Id, "kick", ban.UserId, ban.Net)
+	banDisconnect(ban)
+	return true
+}
+
+func BanRemove(mod *User, id uint32) bool {
+	BanMutex.Lock()
+	_, exist := BanMap[id]
+	delete(BanMap, id)
+	BanMutex.Unlock()
+	if !exist {
+		return false
+	}
+	banLogger.Log(LOG_INFO, mod.Id, "unban", id)
+	MongoRemoveBan(id)
+	return true
+}
+
+// BanList returns active bans and forgets expired ones.
+func BanList() *SBanList {
+	ret := &SBanList{Bans: []*SBan{}}
+	expired := []uint32{}
+	now := time.Now()
+	BanMutex.Lock()
+	for id, ban := range BanMap {
+		if !ban.ExpireTime.IsZero() && !now.Before(ban.ExpireTime) {
+			delete(BanMap, id)
+			expired = append(expired, id)
+			continue
+		}
+		sban := &SBan{ban.Id, ban.UserId, "", 0, ban.Reason, ban.ModId}
+		if ban.Net != nil {
+			sban.Ip = ban.Net.String()
+		}
+		if !ban.ExpireTime.IsZero() {
+			sban.ExpireTime = ban.ExpireTime.Unix()
+		}
+		ret.Bans = append(ret.Bans, sban)
+	}
+	BanMutex.Unlock()
+	for _, id := range expired {
+		MongoRemoveBan(id)
+	}
+	sort.Slice(ret.Bans, func(i, j int) bool {
+		return ret.Bans[i].Id < ret.Bans[j].Id
+	})
+	return ret
+}
+
+func banDisconnect(ban *PBan) {
+	now := time.Now()
+	GlobalClientsMutex.RLock()
+	for clientIter := GlobalClients.Front(); clientIter != nil; clientIter = clientIter.Next() {
+		client := clientIter.Value.(*Client)
+		if ban.Matches(client.UserId, banParseIp(client.Ip), now) {
+			banLogger.Log(LOG_INFO, "disconnect client", client.UserId, client.Ip)
+			select {
+			case client.Messages <- ClientDisconnect{ban.Reason}:
+			default:
+				// the queue is full, close without sending the reason
+				client.conn.Close()
+			}
+		}
+	}
+	GlobalClientsMutex.RUnlock()
+}
+
+func BanLoad() {
+	banIter := BanCollection.Find(nil).Iter()
+	ban := MongoBan{}
+	for banIter.Next(&ban) {
+		if BanCounter < ban.Id {
+			BanCounter = ban.Id
+		}
+		pban := &PBan{ban.Id, ban.UserId, nil, ban.ExpireTime, ban.Reason, ban.ModId}
+		if len(ban.Ip) > 0 {
+			if pban.Net = BanParseNet(ban.Ip); pban.Net == nil {
+				banLogger.Log(LOG_ERROR, "invalid ban ip", ban.Id, ban.Ip)
+				continue
+			}
+		}
+		BanMap[ban.Id] = pban
+		ban = MongoBan{}
+	}
+	if err := banIter.Close(); err != nil {
+		mongoLogger.Log(LOG_ERROR, "mongo find err", err)
+	}
+}
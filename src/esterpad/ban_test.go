@@ -0,0 +1,96 @@
+/*
+Esterpad online collaborative editor
+Copyright (C) 2017 Anon2Anon
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package esterpad
+
+import (
+	"github.com/gorilla/websocket"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBanMatches(t *testing.T) {
+	now := time.Unix(1000, 0)
+	if BanParseNet("not an ip") != nil || BanParseNet("10.0.0.0/33") != nil {
+		t.Fatal("invalid ban target parsed")
+	}
+	rangeBan := &PBan{Net: BanParseNet("10.1.0.0/16")}
+	ipBan := &PBan{Net: BanParseNet(" 2001:db8::1 "), ExpireTime: now.Add(time.Minute)}
+	userBan := &PBan{UserId: 7}
+	cases := []struct {
+		ban    *PBan
+		userId uint32
+		ip     string
+		now    time.Time
+		want   bool
+	}{
+		{rangeBan, 0, "10.1.2.3", now, true},
+		{rangeBan, 0, "10.2.2.3", now, false},
+		{rangeBan, 0, "10.1.2.3, 192.168.0.1", now, true},
+		{rangeBan, 0, "192.168.0.1, 10.1.2.3", now, false},
+		{rangeBan, 0, "", now, false},
+		{ipBan, 0, "2001:db8::1", now, true},
+		{ipBan, 0, "2001:db8::2", now, false},
+		{ipBan, 0, "2001:db8::1", now.Add(time.Minute), false},
+		{userBan, 7, "10.1.2.3", now, true},
+		{userBan, 8, "10.1.2.3", now, false},
+		{&PBan{}, 0, "10.1.2.3", now, false},
+	}
+	for i, c := range cases {
+		if got := c.ban.Matches(c.userId, banParseIp(c.ip), c.now); got != c.want {
+			t.Error("case", i, "got", got, "want", c.want)
+		}
+	}
+}
+
+func TestBanDisconnectFullQueue(t *testing.T) {
+	conns := make(chan *websocket.Conn, 1)
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if conn, err := upgrader.Upgrade(w, r, nil); err == nil {
+			conns <- conn
+		}
+	}))
+	defer server.Close()
+	clientConn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientConn.Close()
+
+	// nothing drains the queue, so the disconnect can't be queued
+	c := &Client{UserId: 30, Messages: make(chan interface{}), conn: <-conns}
+	GlobalClientsMutex.Lock()
+	clientIter := GlobalClients.PushBack(c)
+	GlobalClientsMutex.Unlock()
+	defer func() {
+		GlobalClientsMutex.Lock()
+		GlobalClients.Remove(clientIter)
+		GlobalClientsMutex.Unlock()
+	}()
+	banDisconnect(&PBan{UserId: 30, Reason: "spam"})
+	clientConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = clientConn.ReadMessage()
+	if netErr, ok := err.(net.Error); err == nil || ok && netErr.Timeout() {
+		t.Fatal("banned client with a full queue stays connected")
+	}
+}
@@ -20,11 +20,31 @@ package esterpad
 
 import (
 	. "esterpad_utils"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
+const (
+	PADLIST_SORT_NAME   = 0
+	PADLIST_SORT_EDIT   = 1
+	PADLIST_SORT_CREATE = 2
+)
+
+const (
+	PADLIST_FILTER_ALL      = 0
+	PADLIST_FILTER_RECENT   = 1
+	PADLIST_FILTER_FAVORITE = 2
+	PADLIST_FILTER_DELETED  = 3
+)
+
+const maxRecentPads = 20
+
+// padWritePerms are taken from everyone but moderators in read-only pads.
+const padWritePerms = PERM_CHAT | PERM_WRITE | PERM_EDIT | PERM_WHITEWASH | PERM_SUGGEST
+
 var (
 	cacherLogger         = LogInit("cacher")
 	cacherChannel        = make(chan interface{}, 200)
@@ -34,6 +54,7 @@ var (
 	PadMap               = map[string]*Pad{}
 	PadMutex             = &sync.RWMutex{}
 	PadCounter    uint32 = 0
+	FolderMap            = map[string]uint32{}
 )
 
 func CacherClearAll() {
@@ -48,13 +69,29 @@ func CacherClearAll() {
 		p.DeltaArray = []*PDelta{}
 		p.DocumentArray = []*PDocument{}
 		p.DeltaCounter = 0
+		p.UndoStacks = map[uint32]*PUndoStack{}
+		p.LockArray = nil
 		p.DeltaCollection.RemoveAll(nil)
+		p.LockCollection.RemoveAll(nil)
 		p.DeltaMutex.Unlock()
+		p.ThreadMutex.Lock()
+		p.ThreadArray = nil
+		p.ThreadCollection.RemoveAll(nil)
+		p.ThreadMutex.Unlock()
 	}
 	PadMap = map[string]*Pad{}
 	PadCounter = 0
 	PadCollection.RemoveAll(nil)
+	FolderMap = map[string]uint32{}
+	FolderCollection.RemoveAll(nil)
+	ShareMap = map[string]*PShare{}
+	ShareCollection.RemoveAll(nil)
 	PadMutex.Unlock()
+	BanMutex.Lock()
+	BanMap = map[uint32]*PBan{}
+	BanCounter = 0
+	BanCollection.RemoveAll(nil)
+	BanMutex.Unlock()
 	UserMutex.Lock()
 	UserMap = map[uint32]*User{}
 	UserCounter = 0
@@ -76,9 +113,193 @@ func CacherAddUser(user *User, email interface{}) {
 	}
 }
 
+func CacherCheckPadName(name string) string {
+	name = strings.Trim(strings.TrimSpace(name), "/")
+	if len(name) == 0 || strings.IndexRune(name, '.') >= 0 {
+		return ""
+	}
+	parts := strings.Split(name, "/")
+	for i, part := range parts {
+		part = strings.TrimSpace(part)
+		if len(part) == 0 {
+			return ""
+		}
+		parts[i] = part
+	}
+	return strings.Join(parts, "/")
+}
+
+func CacherGetFolderPerms(name string) uint32 {
+	PadMutex.RLock()
+	defer PadMutex.RUnlock()
+	return cacherFolderPerms(name)
+}
+
+// cacherFolderPerms is CacherGetFolderPerms for callers holding PadMutex.
+func cacherFolderPerms(name string) uint32 {
+	for i := strings.LastIndexByte(name, '/'); i > 0; i = strings.LastIndexByte(name, '/') {
+		name = name[:i]
+		if perms, exist := FolderMap[name]; exist {
+			return perms
+		}
+	}
+	return ^uint32(0)
+}
+
+// cacherPadVisible returns whether user may see pad name in listings,
+// deleted and private pads and pads in folders which grant user no perms
+// are visible only to moderators. PadMutex must be held.
+func cacherPadVisible(user *User, name string, pad *Pad) bool {
+	if user.Perms&(PERM_MOD|PERM_ADMIN) != 0 {
+		return true
+	}
+	return pad.DeleteTime.IsZero() && !pad.Private && user.Perms&cacherFolderPerms(name)&^PERM_NOTGUEST != 0
+}
+
+// CacherUserPadPerms returns perms of user in pad name entered with share
+// token, a share of the pad replaces perms of user. Folder perms and pad
+// flags don't limit moderators and admins.
+func CacherUserPadPerms(user *User, name string, token string) uint32 {
+	perms := user.Perms
+	if perms&(PERM_MOD|PERM_ADMIN) != 0 {
+		return perms
+	}
+	perms &= CacherGetFolderPerms(name) | PERM_NOTGUEST
+	PadMutex.RLock()
+	if pad := PadMap[name]; pad != nil {
+		if share := ShareMap[token]; share != nil && share.PadId == pad.Id {
+			perms = perms&PERM_NOTGUEST | sharePerms(share)
+		} else if pad.Private {
+			perms &= PERM_NOTGUEST
+		}
+		if pad.ReadOnly {
+			perms &^= padWritePerms
+		}
+	}
+	PadMutex.RUnlock()
+	return perms
+}
+
+func CacherSetFolderPerms(path string, perms uint32, reset bool) bool {
+	path = CacherCheckPadName(path)
+	if len(path) == 0 {
+		return false
+	}
+	PadMutex.Lock()
+	if reset {
+		delete(FolderMap, path)
+	} else {
+		FolderMap[path] = perms
+	}
+	PadMutex.Unlock()
+	cacherLogger.Log(LOG_INFO, "set folder perms", path, perms, reset)
+	if reset {
+		MongoResetFolderPerms(path)
+	} else {
+		MongoSetFolderPerms(path, perms)
+	}
+	return true
+}
+
+func CacherPadTree(user *User, path string) *SPadTree {
+	path = CacherCheckPadName(path)
+	prefix := ""
+	if len(path) > 0 {
+		prefix = path + "/"
+	}
+	ret := &SPadTree{Path: path, Folders: []string{}, Pads: []string{}}
+	folders := map[string]bool{}
+	PadMutex.RLock()
+	for name, pad := range PadMap {
+		if !pad.DeleteTime.IsZero() || !cacherPadVisible(user, name, pad) || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		rest := name[len(prefix):]
+		if i := strings.IndexByte(rest, '/'); i >= 0 {
+			folders[rest[:i]] = true
+		} else {
+			ret.Pads = append(ret.Pads, rest)
+		}
+	}
+	ret.Perms, ret.HasPerms = FolderMap[path]
+	PadMutex.RUnlock()
+	for folder := range folders {
+		ret.Folders = append(ret.Folders, folder)
+	}
+	sort.Strings(ret.Folders)
+	sort.Strings(ret.Pads)
+	return ret
+}
+
+// cacherPadListFor leaves out of message pads in folders which grant user no
+// perms, it returns nil if nothing is left.
+func cacherPadListFor(user *User, message *SPadList, folderPerms map[string]uint32) *SPadList {
+	if user == nil {
+		return nil
+	}
+	ret := &SPadList{}
+	for _, name := range message.Pads {
+		if user.Perms&folderPerms[name]&^PERM_NOTGUEST != 0 {
+			ret.Pads = append(ret.Pads, name)
+		}
+	}
+	for _, name := range message.Removed {
+		if user.Perms&folderPerms[name]&^PERM_NOTGUEST != 0 {
+			ret.Removed = append(ret.Removed, name)
+		}
+	}
+	if len(ret.Pads) == 0 && len(ret.Removed) == 0 {
+		return nil
+	}
+	return ret
+}
+
+// CacherSendPadList sends modMessage to subscribed moderators and message to
+// other subscribers who may see the pads in it. PadMutex must not be held.
+func CacherSendPadList(message *SPadList, modMessage *SPadList) {
+	folderPerms := map[string]uint32{}
+	if message != nil {
+		PadMutex.RLock()
+		for _, name := range append(append([]string{}, message.Pads...), message.Removed...) {
+			folderPerms[name] = cacherFolderPerms(name)
+		}
+		PadMutex.RUnlock()
+	}
+	GlobalClientsMutex.RLock()
+	for clientIter := GlobalClients.Front(); clientIter != nil; clientIter = clientIter.Next() {
+		client := clientIter.Value.(*Client)
+		if !client.PadListSubscribed {
+			continue
+		}
+		user := client.User
+		if user != nil && user.Perms&PERM_MOD != 0 && modMessage != nil {
+			select {
+			case client.Messages <- modMessage:
+			default:
+			}
+		} else if message != nil {
+			if userMessage := cacherPadListFor(user, message, folderPerms); userMessage != nil {
+				select {
+				case client.Messages <- userMessage:
+				default:
+				}
+			}
+		}
+	}
+	GlobalClientsMutex.RUnlock()
+}
+
+func CacherPadExists(name string) bool {
+	name = CacherCheckPadName(name)
+	PadMutex.RLock()
+	_, exist := PadMap[name]
+	PadMutex.RUnlock()
+	return exist
+}
+
 func CacherGetPad(name string) *Pad {
-	name = strings.TrimSpace(name)
-	if len(name) == 0 || strings.IndexRune(name, '/') >= 0 || strings.IndexRune(name, '.') >= 0 {
+	name = CacherCheckPadName(name)
+	if len(name) == 0 {
 		return nil
 	}
 	needInsert := false
@@ -87,26 +308,308 @@ func CacherGetPad(name string) *Pad {
 	if pad == nil {
 		PadCounter++
 		pad = PadLoad(PadCounter, name)
+		pad.CreateTime = time.Now()
 		PadMap[name] = pad
 		needInsert = true
+	} else if !pad.DeleteTime.IsZero() {
+		pad = nil
 	}
 	PadMutex.Unlock()
 	if needInsert {
-		MongoInsertPad(pad.Id, pad.Name)
-		message := SPadList{[]string{pad.Name}}
-		GlobalClientsMutex.RLock()
-		for clientIter := GlobalClients.Front(); clientIter != nil; clientIter = clientIter.Next() {
-			client := clientIter.Value.(*Client)
-			select {
-			case client.Messages <- &message:
-			default:
+		MongoInsertPad(pad.Id, pad.Name, pad.CreateTime)
+		message := SPadList{Pads: []string{pad.Name}}
+		CacherSendPadList(&message, &message)
+	}
+	return pad
+}
+
+func CacherPadPage(user *User, request *CPadListRequest) *SPadPage {
+	count := request.Count
+	if count == 0 || count > 200 {
+		count = 200
+	}
+	search := strings.ToLower(strings.TrimSpace(request.Search))
+	isMod := user.Perms&PERM_MOD != 0
+	UserMutex.RLock()
+	recent := user.Recent
+	favorites := map[uint32]bool{}
+	for _, id := range user.Favorites {
+		favorites[id] = true
+	}
+	UserMutex.RUnlock()
+	pads := []*Pad{}
+	PadMutex.RLock()
+	if request.Filter == PADLIST_FILTER_RECENT {
+		padIds := map[uint32]*Pad{}
+		for _, pad := range PadMap {
+			padIds[pad.Id] = pad
+		}
+		for _, id := range recent {
+			if pad := padIds[id]; pad != nil && pad.DeleteTime.IsZero() && cacherPadVisible(user, pad.Name, pad) {
+				pads = append(pads, pad)
+			}
+		}
+	} else {
+		for _, pad := range PadMap {
+			if request.Filter == PADLIST_FILTER_DELETED {
+				if !isMod || pad.DeleteTime.IsZero() {
+					continue
+				}
+			} else if !pad.DeleteTime.IsZero() {
+				continue
+			}
+			if request.Filter == PADLIST_FILTER_FAVORITE && !favorites[pad.Id] || !cacherPadVisible(user, pad.Name, pad) {
+				continue
 			}
+			pads = append(pads, pad)
+		}
+	}
+	ret := &SPadPage{Offset: request.Offset, Pads: []*SPadInfo{}}
+	infos := []*SPadInfo{}
+	for _, pad := range pads {
+		name := strings.ToLower(pad.Name)
+		if request.Prefix && !strings.HasPrefix(name, search) ||
+			!request.Prefix && !strings.Contains(name, search) {
+			continue
+		}
+		info := &SPadInfo{Name: pad.Name, Favorite: favorites[pad.Id]}
+		if !pad.CreateTime.IsZero() {
+			info.CreateTime = pad.CreateTime.Unix()
+		}
+		pad.DeltaMutex.RLock()
+		info.Revision = pad.DeltaCounter
+		if !pad.EditTime.IsZero() {
+			info.EditTime = pad.EditTime.Unix()
+		}
+		pad.DeltaMutex.RUnlock()
+		infos = append(infos, info)
+	}
+	PadMutex.RUnlock()
+	if request.Filter != PADLIST_FILTER_RECENT {
+		less := func(i, j int) bool {
+			return infos[i].Name < infos[j].Name
+		}
+		switch request.Sort {
+		case PADLIST_SORT_EDIT:
+			less = func(i, j int) bool {
+				return infos[i].EditTime < infos[j].EditTime
+			}
+		case PADLIST_SORT_CREATE:
+			less = func(i, j int) bool {
+				return infos[i].CreateTime < infos[j].CreateTime
+			}
+		}
+		if request.Descending {
+			sort.SliceStable(infos, func(i, j int) bool { return less(j, i) })
+		} else {
+			sort.SliceStable(infos, less)
+		}
+	}
+	ret.Total = uint32(len(infos))
+	if request.Offset < ret.Total {
+		end := ret.Total
+		if request.Offset+count < end {
+			end = request.Offset + count
+		}
+		ret.Pads = infos[request.Offset:end]
+	}
+	return ret
+}
+
+func CacherAddRecentPad(user *User, padId uint32) {
+	UserMutex.Lock()
+	recent := []uint32{padId}
+	for _, id := range user.Recent {
+		if id != padId && len(recent) < maxRecentPads {
+			recent = append(recent, id)
+		}
+	}
+	user.Recent = recent
+	UserMutex.Unlock()
+	MongoChangeRecent(user.Id, recent)
+}
+
+func CacherSetFavoritePad(user *User, name string, favorite bool) bool {
+	PadMutex.RLock()
+	pad := PadMap[name]
+	PadMutex.RUnlock()
+	if pad == nil {
+		return false
+	}
+	UserMutex.Lock()
+	favorites := []uint32{}
+	for _, id := range user.Favorites {
+		if id != pad.Id {
+			favorites = append(favorites, id)
+		}
+	}
+	if favorite {
+		favorites = append(favorites, pad.Id)
+	}
+	user.Favorites = favorites
+	UserMutex.Unlock()
+	MongoChangeFavorites(user.Id, favorites)
+	return true
+}
+
+func CacherRenamePad(name string, newName string) bool {
+	newName = CacherCheckPadName(newName)
+	if len(newName) == 0 {
+		return false
+	}
+	PadMutex.Lock()
+	pad := PadMap[name]
+	if pad == nil || !pad.DeleteTime.IsZero() || PadMap[newName] != nil {
+		PadMutex.Unlock()
+		return false
+	}
+	delete(PadMap, name)
+	pad.Name = newName
+	PadMap[newName] = pad
+	private := pad.Private
+	PadMutex.Unlock()
+	cacherLogger.Log(LOG_INFO, "rename pad", pad.Id, name, newName)
+	MongoRenamePad(pad.Id, newName)
+	pad.SendPadState()
+	message := SPadList{Pads: []string{newName}, Removed: []string{name}}
+	if private {
+		CacherSendPadList(nil, &message)
+	} else {
+		CacherSendPadList(&message, &message)
+	}
+	return true
+}
+
+func CacherDeletePad(name string) bool {
+	PadMutex.Lock()
+	pad := PadMap[name]
+	if pad == nil || !pad.DeleteTime.IsZero() {
+		PadMutex.Unlock()
+		return false
+	}
+	pad.DeleteTime = time.Now()
+	PadMutex.Unlock()
+	pad.KickAll()
+	cacherLogger.Log(LOG_INFO, "delete pad", pad.Id, name)
+	MongoDeletePad(pad.Id, pad.DeleteTime)
+	message := SPadList{Removed: []string{name}}
+	modMessage := SPadList{Removed: []string{name}, Deleted: []string{name}}
+	CacherSendPadList(&message, &modMessage)
+	return true
+}
+
+// cacherRestorePad clears the delete time of pad name, it returns nil if
+// the pad isn't deleted.
+func cacherRestorePad(name string) (pad *Pad, private bool) {
+	PadMutex.Lock()
+	defer PadMutex.Unlock()
+	pad = PadMap[name]
+	if pad == nil || pad.DeleteTime.IsZero() {
+		return nil, false
+	}
+	pad.DeleteTime = time.Time{}
+	return pad, pad.Private
+}
+
+func CacherRestorePad(name string) bool {
+	pad, private := cacherRestorePad(name)
+	if pad == nil {
+		return false
+	}
+	cacherLogger.Log(LOG_INFO, "restore pad", pad.Id, name)
+	MongoRestorePad(pad.Id)
+	message := SPadList{Pads: []string{name}}
+	if private {
+		CacherSendPadList(nil, &message)
+	} else {
+		CacherSendPadList(&message, &message)
+	}
+	return true
+}
+
+// cacherPurgePad removes pad name and its share tokens from the maps, it
+// returns nil if there is no such pad.
+func cacherPurgePad(name string) *Pad {
+	PadMutex.Lock()
+	defer PadMutex.Unlock()
+	pad := PadMap[name]
+	if pad == nil {
+		return nil
+	}
+	delete(PadMap, name)
+	if pad.DeleteTime.IsZero() {
+		pad.DeleteTime = time.Now()
+	}
+	for token, share := range ShareMap {
+		if share.PadId == pad.Id {
+			delete(ShareMap, token)
 		}
-		GlobalClientsMutex.RUnlock()
 	}
 	return pad
 }
 
+// purgeHistory clears chat, threads and revisions of the pad. Revision 0
+// stays the empty document, so clients racing with the purge still find it.
+func (p *Pad) purgeHistory() {
+	p.ChatMutex.Lock()
+	p.ChatArray = []*PChat{}
+	p.ChatCounter = 0
+	p.ChatMutex.Unlock()
+	p.DeltaMutex.Lock()
+	p.DeltaArray = []*PDelta{}
+	p.DocumentArray = []*PDocument{&PDocument{Rope: DefaultDocument}}
+	p.DeltaCounter = 0
+	p.UndoStacks = map[uint32]*PUndoStack{}
+	p.LockArray = nil
+	p.DeltaMutex.Unlock()
+	p.ThreadMutex.Lock()
+	p.ThreadArray = nil
+	p.ThreadMutex.Unlock()
+}
+
+func CacherPurgePad(name string) bool {
+	pad := cacherPurgePad(name)
+	if pad == nil {
+		return false
+	}
+	pad.KickAll()
+	cacherLogger.Log(LOG_INFO, "purge pad", pad.Id, name)
+	pad.purgeHistory()
+	pad.CacherChannel <- PPurge{}
+	SearchRemovePad(pad.Id)
+	MongoPurgePad(pad.Id)
+	UploadPurgePad(pad.Id)
+	message := SPadList{Removed: []string{name}}
+	CacherSendPadList(&message, &message)
+	return true
+}
+
+func CacherPurgeHandler() {
+	restoreWindow := 7 * 24 * time.Hour
+	if window, ok := Config["pad"]["restore-window"].(string); ok {
+		if duration, err := time.ParseDuration(window); err == nil {
+			restoreWindow = duration
+		} else {
+			cacherLogger.Log(LOG_ERROR, "invalid restore window", window, err)
+		}
+	}
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		expired := []string{}
+		PadMutex.RLock()
+		for name, pad := range PadMap {
+			if !pad.DeleteTime.IsZero() && now.Sub(pad.DeleteTime) > restoreWindow {
+				expired = append(expired, name)
+			}
+		}
+		PadMutex.RUnlock()
+		for _, name := range expired {
+			CacherPurgePad(name)
+		}
+	}
+}
+
 func CacherGetUser(userId uint32) *User {
 	UserMutex.RLock()
 	user := UserMap[userId]
@@ -121,7 +624,10 @@ func CacherInit() {
 		if UserCounter < user.UserId {
 			UserCounter = user.UserId
 		}
-		UserMap[user.UserId] = &User{user.UserId, user.Nickname, user.Color, user.Perms}
+		UserMap[user.UserId] = &User{
+			Id: user.UserId, Nickname: user.Nickname, Color: user.Color, Perms: user.Perms,
+			Recent: user.Recent, Favorites: user.Favorites}
+		user = MongoUser{}
 	}
 	if err := userIter.Close(); err != nil {
 		mongoLogger.Log(LOG_ERROR, "mongo find err", err)
@@ -131,8 +637,31 @@ func CacherInit() {
 	for padIter.Next(&pad) {
 		PadCounter = pad.Id
 		PadMap[pad.Name] = PadLoad(pad.Id, pad.Name)
+		PadMap[pad.Name].CreateTime = pad.CreateTime
+		PadMap[pad.Name].DeleteTime = pad.DeleteTime
+		PadMap[pad.Name].ReadOnly = pad.ReadOnly
+		PadMap[pad.Name].Private = pad.Private
+		pad = MongoPad{}
 	}
 	if err := padIter.Close(); err != nil {
 		mongoLogger.Log(LOG_ERROR, "mongo find err", err)
 	}
+	folderIter := FolderCollection.Find(nil).Iter()
+	folder := MongoFolder{}
+	for folderIter.Next(&folder) {
+		FolderMap[folder.Path] = folder.Perms
+	}
+	if err := folderIter.Close(); err != nil {
+		mongoLogger.Log(LOG_ERROR, "mongo find err", err)
+	}
+	shareIter := ShareCollection.Find(nil).Iter()
+	share := MongoShare{}
+	for shareIter.Next(&share) {
+		ShareMap[share.Token] = &PShare{share.Token, share.PadId, share.Write}
+	}
+	if err := shareIter.Close(); err != nil {
+		mongoLogger.Log(LOG_ERROR, "mongo find err", err)
+	}
+	BanLoad()
+	go CacherPurgeHandler()
 }
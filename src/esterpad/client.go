@@ -23,9 +23,7 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	. "esterpad_utils"
-	"github.com/golang/protobuf/proto"
 	"github.com/gorilla/websocket"
-	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -39,15 +37,17 @@ const (
 	PERM_WHITEWASH = 1 << 4
 	PERM_MOD       = 1 << 5
 	PERM_ADMIN     = 1 << 6
+	PERM_SUGGEST   = 1 << 7
 )
 
 const (
-	pongWait       = 60 * time.Second
-	pingPeriod     = (pongWait * 9) / 10
-	maxMessageSize = 64 * 1024 * 1024
+	writeWait  = 10 * time.Second
+	pongWait   = 60 * time.Second
+	pingPeriod = (pongWait * 9) / 10
 )
 
 type ClientEnterPad struct {
+	OffsetUnit uint32
 }
 
 type ClientLeavePad struct {
@@ -57,24 +57,43 @@ type ClientPadContext struct {
 	MaxChatId  uint32
 	MaxDeltaId uint32
 	SentUsers  map[uint32]bool
+	OffsetUnit uint32
+	// Last delta sent in the current batch, consecutive deltas of the same
+	// author are composed into it.
+	coalesceDelta   *PDelta
+	coalesceCount   uint32
+	coalesceMessage *SMessage
 }
 
 type User struct {
-	Id       uint32
-	Nickname string
-	Color    uint32
-	Perms    uint32
+	Id        uint32
+	Nickname  string
+	Color     uint32
+	Perms     uint32
+	Recent    []uint32
+	Favorites []uint32
 }
 
 type Client struct {
-	Messages  chan interface{}
-	User      *User
-	UserId    uint32
-	SessId    [16]byte
-	Ip        string
-	UserAgent string
-	Pad       *Pad
-	pc        *ClientPadContext
+	Messages          chan interface{}
+	User              *User
+	UserId            uint32
+	SessId            [16]byte
+	Ip                string
+	UserAgent         string
+	Json              bool
+	Pad               *Pad
+	ShareToken        string
+	OffsetUnit        uint32
+	PadListSubscribed bool
+	pc                *ClientPadContext
+	conn              *websocket.Conn
+	rateBuckets       [rateKinds]rateBucket
+	Version           uint32
+	Capabilities      uint32
+	requestSeq        uint32
+	request           string
+	requestAnswered   bool
 }
 
 type SessionInfo struct {
@@ -106,25 +125,67 @@ func (c *Client) AddUserInfo(buffer []*SMessage, user *User) []*SMessage {
 	return buffer
 }
 
-func (c *Client) AddAllUsersFromOps(buffer []*SMessage, ops *list.List) []*SMessage {
-	for op := ops.Front(); op != nil; op = op.Next() {
-		switch op := op.Value.(type) {
-		case *POpInsert:
-			if op.Meta.Changemask&32 != 0 && op.Meta.User != nil {
-				buffer = c.AddUserInfo(buffer, op.Meta.User)
-			}
-		case *POpRetain:
-			if op.Meta.Changemask&32 != 0 && op.Meta.User != nil {
-				buffer = c.AddUserInfo(buffer, op.Meta.User)
-			}
+func (c *Client) AddAllUsersFromOps(buffer []*SMessage, ops []POp) []*SMessage {
+	for _, op := range ops {
+		if op.Type == OP_DELETE {
+			continue
+		}
+		if op.Meta.Changemask&32 != 0 && op.Meta.User != nil {
+			buffer = c.AddUserInfo(buffer, op.Meta.User)
+		}
+		if op.Meta.SuggestInsert != nil {
+			buffer = c.AddUserInfo(buffer, op.Meta.SuggestInsert)
+		}
+		if op.Meta.SuggestDelete != nil {
+			buffer = c.AddUserInfo(buffer, op.Meta.SuggestDelete)
 		}
 	}
 	return buffer
 }
 
+func (c *Client) DeltaToProtobuf(delta *PDelta) []*Op {
+	ops := delta.Ops
+	if c.pc.OffsetUnit == OFFSET_UNIT_UTF16 {
+		if document := c.Pad.CopyDocumentRevision(delta.Id - 1); document != nil {
+			ops = DeltaToUtf16(ops, document.Rope)
+		}
+	}
+	return DeltaToProtobuf(ops)
+}
+
+// CoalesceDelta composes delta with the previous one if it is the last
+// message of buffer and comes from the same author, it returns nil if the
+// deltas can't be coalesced.
+func (c *Client) CoalesceDelta(delta *PDelta, buffer []*SMessage) *PDelta {
+	prev := c.pc.coalesceDelta
+	if !c.HasCapability(CAP_COALESCE) || delta.UserId == c.UserId || prev == nil ||
+		len(buffer) == 0 || buffer[len(buffer)-1] != c.pc.coalesceMessage ||
+		prev.UserId != delta.UserId || prev.Id+1 != delta.Id {
+		return nil
+	}
+	ops := DeltaComposeOld(delta.Ops, prev.Ops)
+	if ops == nil {
+		return nil
+	}
+	return &PDelta{Id: delta.Id, UserId: delta.UserId, Ops: ops}
+}
+
+// AddDelta appends delta spanning count revisions, ops are based on the
+// document of revision delta.Id - count.
+func (c *Client) AddDelta(buffer []*SMessage, delta *PDelta, count uint32) []*SMessage {
+	base := &PDelta{Id: delta.Id - count + 1, UserId: delta.UserId, Ops: delta.Ops}
+	smessage := &SDelta{delta.Id, delta.UserId, c.DeltaToProtobuf(base), count}
+	clientLogger.Log(LOG_INFO, c.UserId, "send broadcast new delta message", smessage)
+	SMessageOneOf := &SMessage_Delta{smessage}
+	message := &SMessage{SMessageOneOf}
+	c.pc.coalesceDelta, c.pc.coalesceCount, c.pc.coalesceMessage = delta, count, message
+	return append(buffer, message)
+}
+
 func (c *Client) AddOfflineInfo(buffer []*SMessage) []*SMessage {
+	buffer = c.AddPadState(buffer)
 	for _, client := range c.Pad.CopyOnlineUsers() {
-		if c != client {
+		if c != client && c.HasCapability(CAP_PRESENCE) {
 			user := client.User
 			if user != nil {
 				smessage := &SUserInfo{
@@ -157,11 +218,19 @@ func (c *Client) AddOfflineInfo(buffer []*SMessage) []*SMessage {
 		}
 	}
 
+	for _, thread := range c.Pad.CopyThreads() {
+		buffer = c.AddThread(buffer, thread)
+	}
+	for _, lock := range c.Pad.CopyLocks() {
+		buffer = c.AddLock(buffer, lock)
+	}
+
 	offlineDocument := c.Pad.CopyDocument()
 	if offlineDocument != nil {
 		c.pc.MaxDeltaId = offlineDocument.Revision
-		buffer = c.AddAllUsersFromOps(buffer, offlineDocument.Ops)
-		smessage := &SDocument{offlineDocument.Revision, DeltaToProtobuf(offlineDocument.Ops)}
+		ops := offlineDocument.Rope.Ops()
+		buffer = c.AddAllUsersFromOps(buffer, ops)
+		smessage := &SDocument{offlineDocument.Revision, DeltaToProtobuf(ops), c.pc.OffsetUnit}
 		clientLogger.Log(LOG_INFO, c.UserId, "send document message", smessage)
 		SMessageOneOf := &SMessage_Document{smessage}
 		buffer = append(buffer, &SMessage{SMessageOneOf})
@@ -181,11 +250,20 @@ func (c *Client) WritePumpProcessChan(message interface{}, buffer []*SMessage) [
 		}
 	case *PDelta:
 		if c.pc != nil && message.Id > c.pc.MaxDeltaId {
+			if coalesced := c.CoalesceDelta(message, buffer); coalesced != nil {
+				buffer = c.AddAllUsersFromOps(buffer[:len(buffer)-1], message.Ops)
+				return c.AddDelta(buffer, coalesced, c.pc.coalesceCount+1)
+			}
 			buffer = c.AddAllUsersFromOps(buffer, message.Ops)
-			smessage := &SDelta{message.Id, message.UserId, DeltaToProtobuf(message.Ops)}
-			clientLogger.Log(LOG_INFO, c.UserId, "send broadcast new delta message", smessage)
-			SMessageOneOf := &SMessage_Delta{smessage}
-			buffer = append(buffer, &SMessage{SMessageOneOf})
+			buffer = c.AddDelta(buffer, message, 1)
+		}
+	case *PThread:
+		if c.pc != nil {
+			buffer = c.AddThread(buffer, message)
+		}
+	case *PLock:
+		if c.pc != nil {
+			buffer = c.AddLock(buffer, message)
 		}
 	case *SDeltaDropped:
 		if c.pc != nil {
@@ -210,14 +288,49 @@ func (c *Client) WritePumpProcessChan(message interface{}, buffer []*SMessage) [
 		clientLogger.Log(LOG_INFO, c.UserId, "send auth success", message)
 		SMessageOneOf := &SMessage_Auth{message}
 		buffer = append(buffer, &SMessage{SMessageOneOf})
-	case *SAuthError:
-		clientLogger.Log(LOG_INFO, c.UserId, "send auth error", message)
-		SMessageOneOf := &SMessage_AuthError{message}
+	case *SHello:
+		clientLogger.Log(LOG_INFO, c.UserId, "send hello", message)
+		SMessageOneOf := &SMessage_Hello{message}
+		buffer = append(buffer, &SMessage{SMessageOneOf})
+	case *SAck:
+		SMessageOneOf := &SMessage_Ack{message}
+		buffer = append(buffer, &SMessage{SMessageOneOf})
+	case *SError:
+		clientLogger.Log(LOG_INFO, c.UserId, "send error", message)
+		SMessageOneOf := &SMessage_Error{message}
 		buffer = append(buffer, &SMessage{SMessageOneOf})
 	case *SPadList:
 		clientLogger.Log(LOG_INFO, c.UserId, "send pad list", message)
 		SMessageOneOf := &SMessage_PadList{message}
 		buffer = append(buffer, &SMessage{SMessageOneOf})
+	case *SPadKick:
+		clientLogger.Log(LOG_INFO, c.UserId, "send pad kick", message)
+		SMessageOneOf := &SMessage_PadKick{message}
+		buffer = append(buffer, &SMessage{SMessageOneOf})
+	case *SPadPage:
+		clientLogger.Log(LOG_INFO, c.UserId, "send pad page", message)
+		SMessageOneOf := &SMessage_PadPage{message}
+		buffer = append(buffer, &SMessage{SMessageOneOf})
+	case *SSearchResults:
+		clientLogger.Log(LOG_INFO, c.UserId, "send search results", message)
+		SMessageOneOf := &SMessage_SearchResults{message}
+		buffer = append(buffer, &SMessage{SMessageOneOf})
+	case *SPadTree:
+		clientLogger.Log(LOG_INFO, c.UserId, "send pad tree", message)
+		SMessageOneOf := &SMessage_PadTree{message}
+		buffer = append(buffer, &SMessage{SMessageOneOf})
+	case *SBanList:
+		clientLogger.Log(LOG_INFO, c.UserId, "send ban list", len(message.Bans))
+		SMessageOneOf := &SMessage_BanList{message}
+		buffer = append(buffer, &SMessage{SMessageOneOf})
+	case *SShareList:
+		clientLogger.Log(LOG_INFO, c.UserId, "send share list", message.Name, len(message.Shares))
+		SMessageOneOf := &SMessage_ShareList{message}
+		buffer = append(buffer, &SMessage{SMessageOneOf})
+	case PPadState:
+		if c.pc != nil {
+			buffer = c.AddPadState(buffer)
+		}
 	case *CChatRequest:
 		if c.pc != nil {
 			clientLogger.Log(LOG_INFO, c.UserId, "processs chat request", message)
@@ -241,21 +354,22 @@ func (c *Client) WritePumpProcessChan(message interface{}, buffer []*SMessage) [
 			clientLogger.Log(LOG_INFO, c.UserId, "processs revision request", message.Revision)
 			document := c.Pad.CopyDocumentRevision(message.Revision)
 			if document != nil {
-				buffer = c.AddAllUsersFromOps(buffer, document.Ops)
-				smessage := &SDocument{document.Revision, DeltaToProtobuf(document.Ops)}
+				ops := document.Rope.Ops()
+				buffer = c.AddAllUsersFromOps(buffer, ops)
+				smessage := &SDocument{document.Revision, DeltaToProtobuf(ops), c.pc.OffsetUnit}
 				SMessageOneOf := &SMessage_Document{smessage}
 				buffer = append(buffer, &SMessage{SMessageOneOf})
 			}
 			delta := c.Pad.CopyDeltaRevision(message.Revision)
 			if delta != nil {
 				buffer = c.AddAllUsersFromOps(buffer, delta.Ops)
-				smessage := &SDelta{delta.Id, delta.UserId, DeltaToProtobuf(delta.Ops)}
+				smessage := &SDelta{delta.Id, delta.UserId, c.DeltaToProtobuf(delta), 1}
 				SMessageOneOf := &SMessage_Delta{smessage}
 				buffer = append(buffer, &SMessage{SMessageOneOf})
 			}
 		}
 	case ClientEnterPad:
-		c.pc = &ClientPadContext{SentUsers: map[uint32]bool{}}
+		c.pc = &ClientPadContext{SentUsers: map[uint32]bool{}, OffsetUnit: message.OffsetUnit}
 		buffer = c.AddOfflineInfo(buffer)
 	case ClientLeavePad:
 		c.pc = nil
@@ -288,6 +402,10 @@ func (c *Client) WritePump(wsConn *websocket.Conn) {
 					clientLogger.Log(LOG_INFO, c.UserId, "client closed")
 					return
 				}
+				if disconnect, ok := message.(ClientDisconnect); ok {
+					c.WritePumpDisconnect(wsConn, buffer, disconnect.Reason)
+					return
+				}
 				buffer = c.WritePumpProcessChan(message, buffer)
 				if len(buffer) > 0 {
 					break clientwrite1
@@ -309,14 +427,19 @@ func (c *Client) WritePump(wsConn *websocket.Conn) {
 					clientLogger.Log(LOG_INFO, c.UserId, "client closed")
 					return
 				}
+				if disconnect, ok := message.(ClientDisconnect); ok {
+					c.WritePumpDisconnect(wsConn, buffer, disconnect.Reason)
+					return
+				}
 				buffer = c.WritePumpProcessChan(message, buffer)
 			default:
 				break clientwrite2
 			}
 		}
-		data, err := proto.Marshal(&SMessages{Sm: buffer})
+		messageType, data, err := c.WsMarshal(&SMessages{Sm: buffer})
 		if err == nil {
-			if err := wsConn.WriteMessage(websocket.BinaryMessage, data); err != nil {
+			wsConn.EnableWriteCompression(c.HasCapability(CAP_COMPRESSION))
+			if err := wsConn.WriteMessage(messageType, data); err != nil {
 				clientLogger.Log(LOG_ERROR, c.UserId, "ws write err", err)
 				wsConn.Close()
 				return
@@ -328,6 +451,21 @@ func (c *Client) WritePump(wsConn *websocket.Conn) {
 	}
 }
 
+// WritePumpDisconnect sends buffer and closes the connection, so the read
+// loop of Process ends too.
+func (c *Client) WritePumpDisconnect(wsConn *websocket.Conn, buffer []*SMessage, reason string) {
+	clientLogger.Log(LOG_INFO, c.UserId, "disconnect", reason)
+	if len(buffer) > 0 {
+		if messageType, data, err := c.WsMarshal(&SMessages{Sm: buffer}); err == nil {
+			wsConn.EnableWriteCompression(c.HasCapability(CAP_COMPRESSION))
+			wsConn.WriteMessage(messageType, data)
+		}
+	}
+	closeMessage := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason)
+	wsConn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(writeWait))
+	wsConn.Close()
+}
+
 func (c *Client) AuthSession(sessIdString string) bool {
 	if sessIdSlice, err := hex.DecodeString(sessIdString); err == nil && len(sessIdSlice) == 16 {
 		sessId := [16]byte{}
@@ -365,24 +503,24 @@ func (c *Client) AuthNew(user *User) bool {
 
 func (c *Client) NewUser(email string, password string, nickname string) uint32 {
 	if len(email) == 0 {
-		return 2
+		return ERROR_INVALID_REQUEST
 	}
 	colorBytes := [3]byte{}
 	if _, err := rand.Read(colorBytes[:]); err != nil {
 		clientLogger.Log(LOG_ERROR, c.UserId, "color gen err", err)
-		return 3
+		return ERROR_INTERNAL
 	}
 	if !MongoRegister(email, password) {
-		return 2
+		return ERROR_EMAIL_EXISTS
 	}
 	user := User{
 		Nickname: nickname,
 		Color:    uint32(colorBytes[0])*256*256 + uint32(colorBytes[1])*256 + uint32(colorBytes[2]),
-		Perms:    PERM_NOTGUEST | PERM_CHAT | PERM_WRITE | PERM_EDIT | PERM_WHITEWASH | PERM_MOD | PERM_ADMIN,
+		Perms:    PERM_NOTGUEST | PERM_CHAT | PERM_WRITE | PERM_EDIT | PERM_WHITEWASH | PERM_MOD | PERM_ADMIN | PERM_SUGGEST,
 	}
 	CacherAddUser(&user, email)
 	if !c.AuthNew(&user) {
-		return 3
+		return ERROR_INTERNAL
 	}
 	return 0
 }
@@ -391,33 +529,49 @@ func (c *Client) NewGuest() uint32 {
 	colorBytes := [3]byte{}
 	if _, err := rand.Read(colorBytes[:]); err != nil {
 		clientLogger.Log(LOG_ERROR, c.UserId, "color gen err", err)
-		return 3
+		return ERROR_INTERNAL
 	}
 	user := User{
 		Color: uint32(colorBytes[0])*256*256 + uint32(colorBytes[1])*256 + uint32(colorBytes[2]),
-		Perms: PERM_CHAT | PERM_WRITE | PERM_EDIT | PERM_WHITEWASH | PERM_MOD | PERM_ADMIN}
+		Perms: PERM_CHAT | PERM_WRITE | PERM_EDIT | PERM_WHITEWASH | PERM_MOD | PERM_ADMIN | PERM_SUGGEST}
 	CacherAddUser(&user, nil)
 	if !c.AuthNew(&user) {
-		return 3
+		return ERROR_INTERNAL
 	}
 	return 0
 }
 
 func (c *Client) Login(email string, password string) uint32 {
 	if len(email) == 0 {
-		return 2
+		return ERROR_WRONG_CREDENTIALS
+	}
+	if !RateLoginAllow(email) {
+		return ERROR_RATE_LIMITED
 	}
 	userId := MongoLoginUser(email, password)
 	if userId == nil {
-		return 1
+		return ERROR_WRONG_CREDENTIALS
+	}
+	if BanFind(userId.(uint32), c.Ip) != nil {
+		return ERROR_BANNED
 	}
 	user := CacherGetUser(userId.(uint32))
 	if user == nil || !c.AuthNew(user) {
-		return 3
+		return ERROR_INTERNAL
 	}
 	return 0
 }
 
+func (c *Client) PadPerms() uint32 {
+	if c.Pad == nil {
+		return c.User.Perms
+	}
+	PadMutex.RLock()
+	name := c.Pad.Name
+	PadMutex.RUnlock()
+	return CacherUserPadPerms(c.User, name, c.ShareToken)
+}
+
 func (c *Client) LeavePad(clientListIter *list.Element, toWrite bool) {
 	if c.Pad != nil {
 		c.Pad.ClientsMutex.Lock()
@@ -437,14 +591,6 @@ func (c *Client) SendWelcome(wsConn *websocket.Conn, newSessId bool) {
 		message.SessId = hex.EncodeToString(c.SessId[:])
 	}
 	c.Messages <- &message
-	pads := []string{}
-	PadMutex.RLock()
-	for k := range PadMap {
-		pads = append(pads, k)
-	}
-	PadMutex.RUnlock()
-	sort.Strings(pads)
-	c.Messages <- &SPadList{pads}
 }
 
 func (c *Client) SendGlobalUserInfo(user *User) {
@@ -461,62 +607,85 @@ func (c *Client) SendGlobalUserInfo(user *User) {
 	GlobalClientsMutex.RUnlock()
 }
 
+// adminUserAllowed tells whether a user with perms may change nickname and
+// color, and permissions of a user with editedPerms. Admins may edit anyone,
+// moderators everyone but admins, users only guests.
+func adminUserAllowed(perms uint32, editedPerms uint32) (info bool, permsAllowed bool) {
+	admin := perms&PERM_ADMIN != 0
+	mod := perms&PERM_MOD != 0 && editedPerms&PERM_ADMIN == 0
+	info = admin || mod || perms&PERM_NOTGUEST != 0 && editedPerms&PERM_NOTGUEST == 0
+	return info, admin || mod
+}
+
 func (c *Client) AdminUser(m *CAdminUser) {
 	perms := c.User.Perms
 	changemask := m.Changemask
 	editedUser := CacherGetUser(m.UserId)
+	if editedUser == nil {
+		c.SendError(ERROR_NOT_FOUND, "no such user")
+		return
+	}
 	editedUserPerms := editedUser.Perms
-	if editedUser != nil {
-		needUpdateGlobal := false
-		if changemask&3 != 0 && perms&PERM_ADMIN != 0 ||
-			perms&PERM_MOD != 0 && editedUserPerms&PERM_ADMIN == 0 ||
-			perms&PERM_NOTGUEST != 0 && editedUserPerms&PERM_NOTGUEST == 0 {
-			if changemask&1 != 0 {
-				nickname := strings.TrimSpace(m.Nickname)
-				editedUser.Nickname = nickname
-				MongoChangeNickname(c.UserId, nickname)
-			}
-			if changemask&2 != 0 {
-				editedUser.Color = m.Color
-				MongoChangeColor(c.UserId, m.Color)
-			}
-			needUpdateGlobal = true
-		}
-		if changemask&4 != 0 && perms&PERM_ADMIN != 0 ||
-			perms&PERM_MOD != 0 && editedUserPerms&PERM_ADMIN == 0 {
-			newPerms := m.Perms&126 | editedUserPerms&PERM_NOTGUEST
-			if perms&PERM_ADMIN == 0 {
-				newPerms &= 62
-			}
-			editedUser.Perms = newPerms
-			MongoChangePerms(editedUser.Id, newPerms)
-			needUpdateGlobal = true
-		}
-		if changemask&8 != 0 && perms&PERM_ADMIN != 0 && len(m.Email) > 0 {
-			MongoChangeEmail(editedUser.Id, m.Email)
+	infoAllowed, permsAllowed := adminUserAllowed(perms, editedUserPerms)
+	denied := false
+	needUpdateGlobal := false
+	if changemask&3 != 0 && infoAllowed {
+		if changemask&1 != 0 {
+			nickname := strings.TrimSpace(m.Nickname)
+			editedUser.Nickname = nickname
+			MongoChangeNickname(editedUser.Id, nickname)
 		}
-		if changemask&16 != 0 && perms&PERM_ADMIN != 0 {
-			MongoChangePassword(editedUser.Id, m.Password)
+		if changemask&2 != 0 {
+			editedUser.Color = m.Color
+			MongoChangeColor(editedUser.Id, m.Color)
 		}
-		if needUpdateGlobal {
-			c.SendGlobalUserInfo(editedUser)
+		needUpdateGlobal = true
+	} else if changemask&3 != 0 {
+		denied = true
+	}
+	if changemask&4 != 0 && permsAllowed {
+		newPerms := m.Perms&254 | editedUserPerms&PERM_NOTGUEST
+		if perms&PERM_ADMIN == 0 {
+			newPerms &= 190
 		}
+		editedUser.Perms = newPerms
+		MongoChangePerms(editedUser.Id, newPerms)
+		needUpdateGlobal = true
+	} else if changemask&4 != 0 {
+		denied = true
+	}
+	if changemask&24 != 0 && perms&PERM_ADMIN == 0 {
+		denied = true
+	}
+	if changemask&8 != 0 && perms&PERM_ADMIN != 0 && len(m.Email) > 0 {
+		MongoChangeEmail(editedUser.Id, m.Email)
+	}
+	if changemask&16 != 0 && perms&PERM_ADMIN != 0 {
+		MongoChangePassword(editedUser.Id, m.Password)
+	}
+	if needUpdateGlobal {
+		c.SendGlobalUserInfo(editedUser)
+	}
+	if denied {
+		c.SendError(ERROR_PERMISSION_DENIED, "")
 	}
 }
 
 func (c *Client) Process(wsConn *websocket.Conn) {
 	c.Messages = make(chan interface{}, 200)
+	c.conn = wsConn
 	padClientIter := (*list.Element)(nil)
 	GlobalClientsMutex.Lock()
 	globalClientIter := GlobalClients.PushBack(c)
 	GlobalClientsMutex.Unlock()
-	wsConn.SetReadLimit(maxMessageSize)
+	wsConn.SetReadLimit(int64(limitMessageSize))
 	/*wsConn.SetReadDeadline(time.Now().Add(pongWait))
 	wsConn.SetPongHandler(func(string) error {
 		wsConn.SetReadDeadline(time.Now().Add(pongWait))
 		return nil
 	})*/
 	go c.WritePump(wsConn)
+clientread:
 	for {
 		_, dataBytes, err := wsConn.ReadMessage()
 		if err != nil {
@@ -524,16 +693,45 @@ func (c *Client) Process(wsConn *websocket.Conn) {
 			break
 		}
 		messages := &CMessages{}
-		err = proto.Unmarshal(dataBytes, messages)
+		err = c.WsUnmarshal(dataBytes, messages)
 		if err != nil {
 			clientLogger.Log(LOG_ERROR, c.UserId, "unmarshal err", err)
 			break
 		}
 		clientLogger.Log(LOG_INFO, c.UserId, "recv messages", messages)
 		for _, m := range messages.Cm {
+			c.requestSeq++
+			c.request = requestName(m)
+			c.requestAnswered = false
+			if hello, ok := m.CMessage.(*CMessage_Hello); ok {
+				if c.Version != 0 {
+					c.SendError(ERROR_INVALID_REQUEST, "hello is already received")
+				} else if reason := c.Hello(hello.Hello); reason != "" {
+					c.SendError(ERROR_INCOMPATIBLE, reason)
+					c.Messages <- ClientDisconnect{reason}
+					break clientread
+				}
+				continue
+			}
+			if c.Version == 0 {
+				reason := "hello is required before other requests"
+				c.SendError(ERROR_INCOMPATIBLE, reason)
+				c.Messages <- ClientDisconnect{reason}
+				break clientread
+			}
+			if kind := rateKind(m); kind >= 0 && !c.RateAllow(kind) {
+				if !c.RateWarn(kind) {
+					break clientread
+				}
+				c.SendRateLimited(m.CMessage, kind)
+				continue
+			}
+			if c.Pad != nil && (c.Pad.IsDeleted() || !CacherCanEnterPad(c.User, c.Pad, c.ShareToken)) {
+				c.LeavePad(padClientIter, false)
+			}
 			switch m := m.CMessage.(type) {
 			case *CMessage_EditUser:
-				if c.User != nil {
+				if c.CheckUser(0) {
 					changemask := m.EditUser.Changemask
 					if changemask&1 != 0 {
 						nickname := strings.TrimSpace(m.EditUser.Nickname)
@@ -544,6 +742,9 @@ func (c *Client) Process(wsConn *websocket.Conn) {
 						c.User.Color = m.EditUser.Color
 						MongoChangeColor(c.UserId, m.EditUser.Color)
 					}
+					if changemask&12 != 0 && c.User.Perms&PERM_NOTGUEST == 0 {
+						c.SendError(ERROR_PERMISSION_DENIED, "guests have no email and password")
+					}
 					if changemask&4 != 0 && c.User.Perms&PERM_NOTGUEST != 0 && len(m.EditUser.Email) > 0 {
 						MongoChangeEmail(c.UserId, m.EditUser.Email)
 					}
@@ -555,25 +756,52 @@ func (c *Client) Process(wsConn *websocket.Conn) {
 					}
 				}
 			case *CMessage_Delta:
-				if c.User != nil && c.Pad != nil && c.User.Perms&PERM_WRITE != 0 {
+				if c.CheckPad(0) {
 					c.Pad.SendDelta(c, m.Delta)
 				}
 			case *CMessage_Chat:
-				if c.User != nil && c.Pad != nil && c.User.Perms&PERM_CHAT != 0 {
+				if c.CheckPad(PERM_CHAT) {
 					c.Pad.SendChat(c, m.Chat)
 				}
 			case *CMessage_Logout:
-				if c.User != nil {
+				if c.CheckUser(0) {
 					c.LeavePad(padClientIter, true)
 					c.User = nil
 					c.UserId = 0
 				}
 			case *CMessage_EnterPad:
-				if c.User != nil {
+				if c.CheckUser(0) {
 					c.LeavePad(padClientIter, true)
-					c.Pad = CacherGetPad(m.EnterPad.Name)
+					c.OffsetUnit = OFFSET_UNIT_RUNE
+					if m.EnterPad.OffsetUnit == OFFSET_UNIT_UTF16 {
+						c.OffsetUnit = OFFSET_UNIT_UTF16
+					}
+					c.ShareToken = m.EnterPad.Token
+					if len(c.ShareToken) > 0 {
+						if c.Pad = CacherGetSharePad(c.ShareToken); c.Pad == nil {
+							c.SendError(ERROR_NOT_FOUND, "share link is revoked")
+						}
+					} else if len(CacherCheckPadName(m.EnterPad.Name)) == 0 {
+						c.SendError(ERROR_INVALID_PAD_NAME, "")
+					} else if CacherPadExists(m.EnterPad.Name) || c.RateAllow(RATE_PAD_CREATE) {
+						if c.Pad = CacherGetPad(m.EnterPad.Name); c.Pad == nil {
+							c.SendError(ERROR_NOT_FOUND, "pad is deleted")
+						}
+					} else if c.RateWarn(RATE_PAD_CREATE) {
+						c.SendRateLimited(m, RATE_PAD_CREATE)
+					} else {
+						break clientread
+					}
+					if c.Pad != nil && !CacherCanEnterPad(c.User, c.Pad, c.ShareToken) {
+						c.Pad = nil
+						c.SendError(ERROR_PERMISSION_DENIED, "pad is private")
+						c.Messages <- &SPadKick{m.EnterPad.Name}
+					} else if c.Pad == nil && len(c.ShareToken) > 0 {
+						c.Messages <- &SPadKick{m.EnterPad.Name}
+					}
 					if c.Pad != nil {
-						c.Messages <- ClientEnterPad{}
+						CacherAddRecentPad(c.User, c.Pad.Id)
+						c.Messages <- ClientEnterPad{c.OffsetUnit}
 						c.Pad.ClientsMutex.Lock()
 						padClientIter = c.Pad.Clients.PushBack(c)
 						c.Pad.ClientsMutex.Unlock()
@@ -581,7 +809,7 @@ func (c *Client) Process(wsConn *websocket.Conn) {
 					}
 				}
 			case *CMessage_LeavePad:
-				if c.User != nil {
+				if c.CheckUser(0) {
 					c.LeavePad(padClientIter, true)
 				}
 			case *CMessage_Session:
@@ -590,10 +818,14 @@ func (c *Client) Process(wsConn *websocket.Conn) {
 					c.User = nil
 					c.UserId = 0
 				}
-				if c.AuthSession(m.Session.SessId) {
-					c.SendWelcome(wsConn, false)
+				if !c.AuthSession(m.Session.SessId) {
+					c.SendError(ERROR_INVALID_SESSION, "")
+				} else if BanFind(c.UserId, c.Ip) != nil {
+					c.User = nil
+					c.UserId = 0
+					c.SendError(ERROR_BANNED, "")
 				} else {
-					c.Messages <- &SAuthError{4}
+					c.SendWelcome(wsConn, false)
 				}
 			case *CMessage_Login:
 				if c.User != nil {
@@ -604,7 +836,7 @@ func (c *Client) Process(wsConn *websocket.Conn) {
 				if authError := c.Login(m.Login.Email, m.Login.Password); authError == 0 {
 					c.SendWelcome(wsConn, true)
 				} else {
-					c.Messages <- &SAuthError{authError}
+					c.SendError(authError, "")
 				}
 			case *CMessage_Register:
 				if c.User != nil {
@@ -615,38 +847,163 @@ func (c *Client) Process(wsConn *websocket.Conn) {
 				if authError := c.NewUser(m.Register.Email, m.Register.Password, m.Register.Nickname); authError == 0 {
 					c.SendWelcome(wsConn, true)
 				} else {
-					c.Messages <- &SAuthError{authError}
+					c.SendError(authError, "")
 				}
 			case *CMessage_GuestLogin:
 				if authError := c.NewGuest(); authError == 0 {
 					c.SendWelcome(wsConn, true)
 				} else {
-					c.Messages <- &SAuthError{authError}
+					c.SendError(authError, "")
 				}
 			case *CMessage_AdminUser:
-				if c.User != nil {
+				if c.CheckUser(0) {
 					c.AdminUser(m.AdminUser)
 				}
 			case *CMessage_ChatRequest:
-				if c.User != nil && c.Pad != nil {
+				if c.CheckPad(0) {
 					c.Messages <- m.ChatRequest
 				}
 			case *CMessage_RevisionRequest:
-				if c.User != nil && c.Pad != nil {
+				if c.CheckPad(0) {
 					c.Messages <- m.RevisionRequest
 				}
 			case *CMessage_InvertDelta:
-				if c.User != nil && c.User.Perms&PERM_MOD != 0 && c.Pad != nil {
+				if c.CheckUser(PERM_MOD) && c.CheckPad(0) {
 					c.Pad.InvertDelta(c, m.InvertDelta.Id)
 				}
 			case *CMessage_InvertUserDelta:
-				if c.User != nil && c.User.Perms&PERM_MOD != 0 && c.Pad != nil {
-					c.Pad.InvertUserDelta(c, m.InvertUserDelta.UserId)
+				if c.CheckUser(PERM_MOD) && c.CheckPad(0) {
+					c.Pad.InvertUserDelta(c, m.InvertUserDelta.UserId, m.InvertUserDelta.From, m.InvertUserDelta.To)
 				}
 			case *CMessage_RestoreRevision:
-				if c.User != nil && c.User.Perms&PERM_MOD != 0 && c.Pad != nil {
-					c.Pad.RestoreRevision(c, m.RestoreRevision.Rev)
+				if c.CheckUser(PERM_MOD) && c.CheckPad(0) {
+					c.Pad.RestoreRevision(c, m.RestoreRevision.Rev, m.RestoreRevision.From, m.RestoreRevision.To)
+				}
+			case *CMessage_ThreadCreate:
+				if c.CheckPad(PERM_CHAT) {
+					c.Pad.CreateThread(c, m.ThreadCreate)
+				}
+			case *CMessage_ThreadReply:
+				if c.CheckPad(PERM_CHAT) {
+					c.Pad.ReplyThread(c, m.ThreadReply)
 				}
+			case *CMessage_ThreadResolve:
+				if c.CheckPad(PERM_CHAT) {
+					c.Pad.ResolveThread(c, m.ThreadResolve)
+				}
+			case *CMessage_LockCreate:
+				if c.CheckPad(PERM_EDIT | PERM_MOD) {
+					c.Pad.CreateLock(c, m.LockCreate)
+				}
+			case *CMessage_LockRemove:
+				if c.CheckPad(PERM_EDIT | PERM_MOD) {
+					c.Pad.RemoveLock(c, m.LockRemove)
+				}
+			case *CMessage_SuggestionResolve:
+				if c.CheckPad(PERM_WRITE | PERM_SUGGEST) {
+					c.Pad.ResolveSuggestions(c, m.SuggestionResolve)
+				}
+			case *CMessage_Undo:
+				if c.CheckPad(PERM_WRITE) {
+					c.Pad.Undo(c)
+				}
+			case *CMessage_Redo:
+				if c.CheckPad(PERM_WRITE) {
+					c.Pad.Redo(c)
+				}
+			case *CMessage_RenamePad:
+				if c.CheckUser(PERM_MOD) {
+					if len(CacherCheckPadName(m.RenamePad.NewName)) == 0 {
+						c.SendError(ERROR_INVALID_PAD_NAME, "")
+					} else if !CacherRenamePad(m.RenamePad.Name, m.RenamePad.NewName) {
+						c.SendError(ERROR_NOT_FOUND, "no such pad or new name is taken")
+					}
+				}
+			case *CMessage_DeletePad:
+				if c.CheckUser(PERM_MOD) && !CacherDeletePad(m.DeletePad.Name) {
+					c.SendError(ERROR_NOT_FOUND, "no such pad")
+				}
+			case *CMessage_RestorePad:
+				if c.CheckUser(PERM_MOD) && !CacherRestorePad(m.RestorePad.Name) {
+					c.SendError(ERROR_NOT_FOUND, "no such deleted pad")
+				}
+			case *CMessage_PurgePad:
+				if c.CheckUser(PERM_MOD) && !CacherPurgePad(m.PurgePad.Name) {
+					c.SendError(ERROR_NOT_FOUND, "no such pad")
+				}
+			case *CMessage_PadTree:
+				if c.CheckUser(0) {
+					c.Messages <- CacherPadTree(c.User, m.PadTree.Path)
+				}
+			case *CMessage_PadListRequest:
+				if c.CheckUser(0) {
+					c.Messages <- CacherPadPage(c.User, m.PadListRequest)
+				}
+			case *CMessage_PadListSubscribe:
+				GlobalClientsMutex.Lock()
+				c.PadListSubscribed = m.PadListSubscribe.Subscribe
+				GlobalClientsMutex.Unlock()
+			case *CMessage_FavoritePad:
+				if c.CheckUser(0) && !CacherSetFavoritePad(c.User, m.FavoritePad.Name, m.FavoritePad.Favorite) {
+					c.SendError(ERROR_NOT_FOUND, "no such pad")
+				}
+			case *CMessage_Search:
+				if c.CheckUser(0) {
+					c.Messages <- Search(c.User, m.Search.Query, m.Search.Count, m.Search.Chat)
+				}
+			case *CMessage_PadFlags:
+				if c.CheckUser(PERM_MOD) && !CacherSetPadFlags(m.PadFlags.Name, m.PadFlags.ReadOnly, m.PadFlags.Private) {
+					c.SendError(ERROR_NOT_FOUND, "no such pad")
+				}
+			case *CMessage_ShareCreate:
+				if c.CheckUser(0) && c.CheckPerms(CacherUserPadPerms(c.User, m.ShareCreate.Name, ""), PERM_EDIT|PERM_MOD) {
+					if !CacherCreateShare(m.ShareCreate.Name, m.ShareCreate.Write) {
+						c.SendError(ERROR_NOT_FOUND, "no such pad")
+					}
+					c.Messages <- CacherPadShares(m.ShareCreate.Name)
+				}
+			case *CMessage_ShareRevoke:
+				if c.CheckUser(0) && c.CheckPerms(CacherUserPadPerms(c.User, m.ShareRevoke.Name, ""), PERM_EDIT|PERM_MOD) {
+					if !CacherRevokeShare(m.ShareRevoke.Name, m.ShareRevoke.Token) {
+						c.SendError(ERROR_NOT_FOUND, "no such share")
+					}
+					c.Messages <- CacherPadShares(m.ShareRevoke.Name)
+				}
+			case *CMessage_ShareListRequest:
+				if c.CheckUser(0) && c.CheckPerms(CacherUserPadPerms(c.User, m.ShareListRequest.Name, ""), PERM_EDIT|PERM_MOD) {
+					c.Messages <- CacherPadShares(m.ShareListRequest.Name)
+				}
+			case *CMessage_Ban:
+				if c.CheckUser(PERM_MOD) {
+					if !BanAdd(c.User, m.Ban) {
+						c.SendError(ERROR_INVALID_REQUEST, "invalid ban target")
+					}
+					c.Messages <- BanList()
+				}
+			case *CMessage_Unban:
+				if c.CheckUser(PERM_MOD) {
+					if !BanRemove(c.User, m.Unban.BanId) {
+						c.SendError(ERROR_NOT_FOUND, "no such ban")
+					}
+					c.Messages <- BanList()
+				}
+			case *CMessage_BanListRequest:
+				if c.CheckUser(PERM_MOD) {
+					c.Messages <- BanList()
+				}
+			case *CMessage_Kick:
+				if c.CheckUser(PERM_MOD) && !BanKick(c.User, m.Kick) {
+					c.SendError(ERROR_INVALID_REQUEST, "invalid kick target")
+				}
+			case *CMessage_FolderPerms:
+				if c.CheckUser(PERM_MOD) && !CacherSetFolderPerms(m.FolderPerms.Path, m.FolderPerms.Perms, m.FolderPerms.Clear) {
+					c.SendError(ERROR_INVALID_PAD_NAME, "")
+				}
+			default:
+				c.SendError(ERROR_INVALID_REQUEST, "unknown request")
+			}
+			if !c.requestAnswered && c.HasCapability(CAP_ACKS) {
+				c.SendAck(0)
 			}
 		}
 	}
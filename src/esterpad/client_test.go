@@ -0,0 +1,43 @@
+/*
+Esterpad online collaborative editor
+Copyright (C) 2017 Anon2Anon
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package esterpad
+
+import "testing"
+
+func TestAdminUserAllowed(t *testing.T) {
+	guest := uint32(PERM_CHAT)
+	user := uint32(PERM_NOTGUEST | PERM_CHAT | PERM_WRITE)
+	mod := user | PERM_MOD
+	admin := user | PERM_ADMIN
+	for _, test := range []struct {
+		perms, edited  uint32
+		info, setPerms bool
+	}{
+		{admin, admin, true, true},
+		{mod, user, true, true},
+		{mod, admin, false, false},
+		{user, guest, true, false},
+		{user, user, false, false},
+		{guest, guest, false, false},
+	} {
+		if info, perms := adminUserAllowed(test.perms, test.edited); info != test.info || perms != test.setPerms {
+			t.Errorf("%d editing %d: info %v perms %v", test.perms, test.edited, info, perms)
+		}
+	}
+}
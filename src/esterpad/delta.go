@@ -19,153 +19,330 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 package esterpad
 
 import (
-	"container/list"
 	. "esterpad_utils"
 	"fmt"
+	"strings"
 )
 
 var deltaLogger = LogInit("delta")
 
-func DeltaAddInsert(ops *list.List, text []rune, meta *PMeta, textRO bool) {
-	if back := ops.Back(); back != nil {
-		switch op := back.Value.(type) {
-		case *POpInsert:
-			if *op.Meta == *meta {
-				if op.TextRO {
-					t := make([]rune, len(op.Text)+len(text))
-					copy(t, op.Text)
-					copy(t[len(op.Text):], text)
-					op.Text = t
-					op.TextRO = false
-				} else {
-					op.Text = append(op.Text, text...)
-				}
-				return
-			}
+const (
+	OFFSET_UNIT_RUNE  = 0
+	OFFSET_UNIT_UTF16 = 1
+)
+
+const (
+	META_BOLD           = 1
+	META_ITALIC         = 2
+	META_UNDERLINE      = 4
+	META_STRIKE         = 8
+	META_FONTSIZE       = 16
+	META_AUTHOR         = 32
+	META_LINK           = 64
+	META_COLOR          = 128
+	META_HIGHLIGHT      = 256
+	META_CODE           = 512
+	META_HEADING        = 1024
+	META_LIST           = 2048
+	META_QUOTE          = 4096
+	META_CODEBLOCK      = 8192
+	META_ALL            = 16383
+	META_FORMAT         = META_ALL &^ META_AUTHOR
+	META_EMBED          = 16384
+	META_SUGGEST_INSERT = 32768
+	META_SUGGEST_DELETE = 65536
+)
+
+// EmbedRune stands for an embedded object in document text.
+const EmbedRune = '\uFFFC'
+
+const (
+	LIST_BULLET    = 1
+	LIST_ORDERED   = 2
+	LIST_CHECKED   = 3
+	LIST_UNCHECKED = 4
+)
+
+const (
+	metaLinkMaxLen  = 2048
+	metaColorMax    = 0xffffff
+	metaHeadingMax  = 6
+	embedNameMaxLen = 256
+)
+
+var metaLinkSchemes = []string{"http://", "https://", "mailto:"}
+
+// metaAttrs lists attributes of PMeta, set copies the attribute from one meta
+// to another. A new attribute only needs a field, a mask and an entry here
+// besides the wire formats.
+var metaAttrs = []struct {
+	mask uint32
+	set  func(meta *PMeta, from *PMeta)
+}{
+	{META_BOLD, func(meta *PMeta, from *PMeta) { meta.Bold = from.Bold }},
+	{META_ITALIC, func(meta *PMeta, from *PMeta) { meta.Italic = from.Italic }},
+	{META_UNDERLINE, func(meta *PMeta, from *PMeta) { meta.Underline = from.Underline }},
+	{META_STRIKE, func(meta *PMeta, from *PMeta) { meta.Strike = from.Strike }},
+	{META_FONTSIZE, func(meta *PMeta, from *PMeta) { meta.FontSize = from.FontSize }},
+	{META_AUTHOR, func(meta *PMeta, from *PMeta) { meta.User = from.User }},
+	{META_LINK, func(meta *PMeta, from *PMeta) { meta.Link = from.Link }},
+	{META_COLOR, func(meta *PMeta, from *PMeta) { meta.Color = from.Color }},
+	{META_HIGHLIGHT, func(meta *PMeta, from *PMeta) { meta.Highlight = from.Highlight }},
+	{META_CODE, func(meta *PMeta, from *PMeta) { meta.Code = from.Code }},
+	{META_HEADING, func(meta *PMeta, from *PMeta) { meta.Heading = from.Heading }},
+	{META_LIST, func(meta *PMeta, from *PMeta) { meta.List = from.List }},
+	{META_QUOTE, func(meta *PMeta, from *PMeta) { meta.Quote = from.Quote }},
+	{META_CODEBLOCK, func(meta *PMeta, from *PMeta) { meta.CodeBlock = from.CodeBlock }},
+	{META_EMBED, func(meta *PMeta, from *PMeta) { meta.Embed = from.Embed }},
+	{META_SUGGEST_INSERT, func(meta *PMeta, from *PMeta) { meta.SuggestInsert = from.SuggestInsert }},
+	{META_SUGGEST_DELETE, func(meta *PMeta, from *PMeta) { meta.SuggestDelete = from.SuggestDelete }},
+}
+
+var metaEmpty = PMeta{}
+
+type deltaIter struct {
+	ops []POp
+	pos int
+	op  POp
+	end bool
+}
+
+func newDeltaIter(ops []POp) deltaIter {
+	it := deltaIter{ops: ops}
+	it.next()
+	return it
+}
+
+func (it *deltaIter) next() {
+	for it.pos < len(it.ops) {
+		it.op = it.ops[it.pos]
+		it.pos++
+		if it.op.Len > 0 {
+			return
 		}
 	}
-	ops.PushBack(&POpInsert{text, meta, textRO})
+	it.op = POp{}
+	it.end = true
 }
 
-func DeltaAddDelete(ops *list.List, len uint32) {
-	if back := ops.Back(); back != nil {
-		switch op := back.Value.(type) {
-		case *POpDelete:
-			op.Len = op.Len + len
-			return
+func (it *deltaIter) is(opType uint8) bool {
+	return !it.end && it.op.Type == opType
+}
+
+// take returns the first n characters of the current op and advances past them.
+func (it *deltaIter) take(n uint32) POp {
+	op := it.op
+	if n >= op.Len {
+		it.next()
+		return op
+	}
+	op.Len = n
+	if op.Type == OP_INSERT {
+		op.Text = op.Text[:n]
+		it.op.Text = it.op.Text[n:]
+	}
+	it.op.Len -= n
+	return op
+}
+
+func deltaMin(a uint32, b uint32) uint32 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func DeltaAddInsert(ops []POp, text []rune, meta *PMeta, textRO bool) []POp {
+	if len(text) == 0 {
+		return ops
+	}
+	if n := len(ops); n > 0 && ops[n-1].Type == OP_INSERT && *ops[n-1].Meta == *meta {
+		op := &ops[n-1]
+		if op.TextRO {
+			t := make([]rune, len(op.Text)+len(text))
+			copy(t, op.Text)
+			copy(t[len(op.Text):], text)
+			op.Text = t
+			op.TextRO = false
+		} else {
+			op.Text = append(op.Text, text...)
 		}
+		op.Len = uint32(len(op.Text))
+		return ops
 	}
-	ops.PushBack(&POpDelete{len})
+	return append(ops, POp{Type: OP_INSERT, TextRO: textRO, Len: uint32(len(text)), Text: text, Meta: meta})
 }
 
-func DeltaAddRetain(ops *list.List, len uint32, meta *PMeta) {
-	if back := ops.Back(); back != nil {
-		switch op := back.Value.(type) {
-		case *POpRetain:
-			if *op.Meta == *meta {
-				op.Len = op.Len + len
-				return
+func DeltaAddDelete(ops []POp, count uint32) []POp {
+	if count == 0 {
+		return ops
+	}
+	if n := len(ops); n > 0 && ops[n-1].Type == OP_DELETE {
+		ops[n-1].Len += count
+		return ops
+	}
+	return append(ops, POp{Type: OP_DELETE, Len: count})
+}
+
+func DeltaAddRetain(ops []POp, count uint32, meta *PMeta) []POp {
+	if count == 0 {
+		return ops
+	}
+	if n := len(ops); n > 0 && ops[n-1].Type == OP_RETAIN && *ops[n-1].Meta == *meta {
+		ops[n-1].Len += count
+		return ops
+	}
+	return append(ops, POp{Type: OP_RETAIN, Len: count, Meta: meta})
+}
+
+func deltaLinkValid(link string) bool {
+	if len(link) == 0 || len(link) > metaLinkMaxLen {
+		return false
+	}
+	lower := strings.ToLower(link)
+	for _, scheme := range metaLinkSchemes {
+		if strings.HasPrefix(lower, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// deltaMetaFromClient copies formatting attributes from client meta, invalid
+// values are dropped.
+func deltaMetaFromClient(meta *OpMeta) PMeta {
+	from := PMeta{Bold: meta.Bold, Italic: meta.Italic, Underline: meta.Underline, Strike: meta.Strike,
+		FontSize: meta.FontSize, Link: meta.Link, Color: meta.Color, Highlight: meta.Highlight,
+		Code: meta.Code, Heading: meta.Heading, List: meta.List, Quote: meta.Quote, CodeBlock: meta.CodeBlock}
+	changemask := meta.Changemask & META_FORMAT
+	if changemask&META_LINK != 0 && !deltaLinkValid(from.Link) {
+		changemask &^= META_LINK
+	}
+	if changemask&META_COLOR != 0 && from.Color > metaColorMax {
+		changemask &^= META_COLOR
+	}
+	if changemask&META_HIGHLIGHT != 0 && from.Highlight > metaColorMax {
+		changemask &^= META_HIGHLIGHT
+	}
+	if changemask&META_HEADING != 0 && from.Heading > metaHeadingMax {
+		changemask &^= META_HEADING
+	}
+	if changemask&META_LIST != 0 && from.List > LIST_UNCHECKED {
+		changemask &^= META_LIST
+	}
+	pmeta := PMeta{Changemask: changemask}
+	for _, attr := range metaAttrs {
+		if changemask&attr.mask != 0 {
+			attr.set(&pmeta, &from)
+		}
+	}
+	return pmeta
+}
+
+// deltaInsertMeta returns meta of text inserted by userId, only whitewashers
+// may set another author.
+func deltaInsertMeta(meta *OpMeta, canWriteWash bool, userId uint32) PMeta {
+	pmeta := PMeta{}
+	if meta != nil {
+		pmeta = deltaMetaFromClient(meta)
+		pmeta.Changemask |= META_AUTHOR
+		if meta.Changemask&META_AUTHOR != 0 && canWriteWash {
+			if meta.UserId != 0 {
+				pmeta.User = CacherGetUser(meta.UserId)
 			}
+		} else {
+			pmeta.User = CacherGetUser(userId)
 		}
+	} else {
+		pmeta.Changemask = META_AUTHOR
+		pmeta.User = CacherGetUser(userId)
 	}
-	ops.PushBack(&POpRetain{len, meta})
+	return pmeta
 }
 
-func DeltaValidateFromClient(ops []*Op, canWriteWash bool, userId uint32) *list.List {
-	listOps := list.New()
+// deltaEmbedFromClient returns nil for embeds of unknown type or with a
+// reference which is neither an upload nor a link.
+func deltaEmbedFromClient(embed *OpEmbed) *PEmbed {
+	ret := PEmbed{Type: embed.Type, Name: embed.Name}
+	if len([]rune(ret.Name)) > embedNameMaxLen {
+		return nil
+	}
+	switch embed.Type {
+	case EMBED_IMAGE:
+		if !UploadRefValid(embed.Ref) && !deltaLinkValid(embed.Ref) {
+			return nil
+		}
+		ret.Ref = embed.Ref
+	case EMBED_FILE:
+		if !UploadRefValid(embed.Ref) {
+			return nil
+		}
+		ret.Ref = embed.Ref
+	case EMBED_CHECKBOX:
+		ret.Checked = embed.Checked
+	default:
+		return nil
+	}
+	return &ret
+}
+
+// DeltaValidateFromClient converts ops of a client to a delta, it returns
+// the reason instead if the ops exceed the delta limits.
+func DeltaValidateFromClient(ops []*Op, canWriteWash bool, userId uint32) ([]POp, string) {
+	if len(ops) > limitDeltaOps {
+		return nil, fmt.Sprintf("delta has more than %d ops", limitDeltaOps)
+	}
+	listOps := []POp{}
+	inserted := 0
 	for _, op := range ops {
 		switch op := op.Op.(type) {
 		case *Op_Insert:
 			text := []rune(op.Insert.Text)
+			if inserted += len(text); inserted > limitDeltaInsert {
+				return nil, fmt.Sprintf("delta inserts more than %d characters", limitDeltaInsert)
+			}
 			if len(text) > 0 {
-				meta := op.Insert.Meta
-				pmeta := PMeta{}
-				if meta != nil {
-					pmeta.Changemask = meta.Changemask&31 | 32
-					if meta.Changemask&1 != 0 {
-						pmeta.Bold = meta.Bold
-					}
-					if meta.Changemask&2 != 0 {
-						pmeta.Italic = meta.Italic
-					}
-					if meta.Changemask&4 != 0 {
-						pmeta.Underline = meta.Underline
-					}
-					if meta.Changemask&8 != 0 {
-						pmeta.Strike = meta.Strike
-					}
-					if meta.Changemask&16 != 0 {
-						pmeta.FontSize = meta.FontSize
-					}
-					if meta.Changemask&32 != 0 && canWriteWash {
-						if meta.UserId != 0 {
-							pmeta.User = CacherGetUser(meta.UserId)
-						}
-					} else {
-						pmeta.User = CacherGetUser(userId)
-					}
-				} else {
-					pmeta.Changemask = 32
-					pmeta.User = CacherGetUser(userId)
-				}
-				DeltaAddInsert(listOps, text, &pmeta, false)
+				pmeta := deltaInsertMeta(op.Insert.Meta, canWriteWash, userId)
+				listOps = DeltaAddInsert(listOps, text, &pmeta, false)
+			}
+		case *Op_Embed:
+			if inserted++; inserted > limitDeltaInsert {
+				return nil, fmt.Sprintf("delta inserts more than %d characters", limitDeltaInsert)
+			}
+			if embed := deltaEmbedFromClient(op.Embed); embed != nil {
+				pmeta := deltaInsertMeta(op.Embed.Meta, canWriteWash, userId)
+				pmeta.Changemask |= META_EMBED
+				pmeta.Embed = embed
+				listOps = DeltaAddInsert(listOps, []rune{EmbedRune}, &pmeta, false)
 			}
 		case *Op_Delete:
 			if op.Delete.Len > 0 {
-				DeltaAddDelete(listOps, op.Delete.Len)
+				listOps = DeltaAddDelete(listOps, op.Delete.Len)
 			}
 		case *Op_Retain:
 			if op.Retain.Len > 0 {
 				meta := op.Retain.Meta
 				pmeta := PMeta{}
 				if meta != nil {
-					pmeta.Changemask = meta.Changemask & 31
-					if meta.Changemask&1 != 0 {
-						pmeta.Bold = meta.Bold
-					}
-					if meta.Changemask&2 != 0 {
-						pmeta.Italic = meta.Italic
-					}
-					if meta.Changemask&4 != 0 {
-						pmeta.Underline = meta.Underline
-					}
-					if meta.Changemask&8 != 0 {
-						pmeta.Strike = meta.Strike
-					}
-					if meta.Changemask&16 != 0 {
-						pmeta.FontSize = meta.FontSize
-					}
-					if meta.Changemask&32 != 0 && (canWriteWash || meta.UserId == userId) {
-						pmeta.Changemask |= 32
+					pmeta = deltaMetaFromClient(meta)
+					if meta.Changemask&META_AUTHOR != 0 && (canWriteWash || meta.UserId == userId) {
+						pmeta.Changemask |= META_AUTHOR
 						pmeta.User = CacherGetUser(meta.UserId)
 					}
 				}
-				DeltaAddRetain(listOps, op.Retain.Len, &pmeta)
+				listOps = DeltaAddRetain(listOps, op.Retain.Len, &pmeta)
 			}
 		}
 	}
-	return listOps
+	return listOps, ""
 }
 
 func DeltaMetaAppend(what *PMeta, to *PMeta) *PMeta {
 	meta := *to
-	if what.Changemask&1 != 0 {
-		meta.Bold = what.Bold
-	}
-	if what.Changemask&2 != 0 {
-		meta.Italic = what.Italic
-	}
-	if what.Changemask&4 != 0 {
-		meta.Underline = what.Underline
-	}
-	if what.Changemask&8 != 0 {
-		meta.Strike = what.Strike
-	}
-	if what.Changemask&16 != 0 {
-		meta.FontSize = what.FontSize
-	}
-	if what.Changemask&32 != 0 {
-		meta.User = what.User
+	for _, attr := range metaAttrs {
+		if what.Changemask&attr.mask != 0 {
+			attr.set(&meta, what)
+		}
 	}
 	meta.Changemask |= what.Changemask
 	return &meta
@@ -173,498 +350,518 @@ func DeltaMetaAppend(what *PMeta, to *PMeta) *PMeta {
 
 func DeltaMetaComplement(what *PMeta, to *PMeta) *PMeta {
 	meta := *to
-	if what.Changemask&1 != 0 {
-		meta.Bold = false
-	}
-	if what.Changemask&2 != 0 {
-		meta.Italic = false
-	}
-	if what.Changemask&4 != 0 {
-		meta.Underline = false
-	}
-	if what.Changemask&8 != 0 {
-		meta.Strike = false
-	}
-	if what.Changemask&16 != 0 {
-		meta.FontSize = 0
-	}
-	if what.Changemask&32 != 0 {
-		meta.User = nil
+	for _, attr := range metaAttrs {
+		if what.Changemask&attr.mask != 0 {
+			attr.set(&meta, &metaEmpty)
+		}
 	}
-	meta.Changemask &= what.Changemask ^ 63
+	meta.Changemask &^= what.Changemask
 	return &meta
 }
 
 func DeltaMetaInvert(what *PMeta, to *PMeta) *PMeta {
 	meta := *to
-	if what.Changemask&1 == 0 {
-		meta.Bold = false
-	}
-	if what.Changemask&2 == 0 {
-		meta.Italic = false
-	}
-	if what.Changemask&4 == 0 {
-		meta.Underline = false
-	}
-	if what.Changemask&8 == 0 {
-		meta.Strike = false
-	}
-	if what.Changemask&16 == 0 {
-		meta.FontSize = 0
-	}
-	if what.Changemask&32 == 0 {
-		meta.User = nil
+	for _, attr := range metaAttrs {
+		if what.Changemask&attr.mask == 0 {
+			attr.set(&meta, &metaEmpty)
+		}
 	}
 	meta.Changemask = what.Changemask
 	return &meta
 }
 
-func DeltaInvert(delta *list.List, text *list.List) *list.List {
-	ret := list.New()
-	ai := delta.Front()
-	bi := text.Front()
-	at := 0
-	bt := 0
-	ac := interface{}(nil)
-	bc := interface{}(nil)
-	am := (*PMeta)(nil)
-	bm := (*PMeta)(nil)
-	nexta := func() {
-		at = -1
-		if ai != nil {
-			switch op := ai.Value.(type) {
-			case *POpInsert:
-				ac = op.Text
-				at = 0
-				am = op.Meta
-			case *POpDelete:
-				ac = op.Len
-				at = 1
-				am = nil
-			case *POpRetain:
-				ac = op.Len
-				at = 2
-				am = op.Meta
+func DeltaInvert(delta []POp, document *Rope) []POp {
+	ret := []POp{}
+	pos := uint32(0)
+	length := document.Len()
+	for _, op := range delta {
+		switch op.Type {
+		case OP_INSERT:
+			ret = DeltaAddDelete(ret, op.Len)
+		case OP_DELETE, OP_RETAIN:
+			if pos+op.Len > length {
+				return nil
+			}
+			if op.Type == OP_RETAIN && op.Meta.Changemask == 0 {
+				ret = DeltaAddRetain(ret, op.Len, op.Meta)
+			} else {
+				document.Each(pos, pos+op.Len, func(text []rune, meta *PMeta) {
+					if op.Type == OP_DELETE {
+						ret = DeltaAddInsert(ret, text, meta, true)
+					} else {
+						ret = DeltaAddRetain(ret, uint32(len(text)), DeltaMetaInvert(op.Meta, meta))
+					}
+				})
 			}
-			ai = ai.Next()
+			pos += op.Len
 		}
 	}
-	nextb := func() {
-		bt = -1
-		if bi != nil {
-			switch op := bi.Value.(type) {
-			case *POpInsert:
-				bc = op.Text
-				bt = 0
-				bm = op.Meta
+	if pos != length {
+		return nil
+	}
+	return ret
+}
+
+// DeltaApply applies delta to document and returns the new revision, or nil
+// if the delta doesn't cover the document exactly.
+func DeltaApply(delta []POp, document *Rope) *Rope {
+	ret := (*ropeNode)(nil)
+	rest := document.root
+	for _, op := range delta {
+		switch op.Type {
+		case OP_INSERT:
+			ret = ropeAppend(ret, op.Text, op.Meta)
+		case OP_DELETE, OP_RETAIN:
+			if op.Len > ropeLength(rest) {
+				return nil
+			}
+			part, right := ropeSplit(rest, op.Len)
+			rest = right
+			if op.Type == OP_DELETE {
+				break
+			}
+			if op.Meta.Changemask == 0 {
+				ret = ropeJoin(ret, part)
+			} else {
+				ropeEach(part, 0, op.Len, func(text []rune, meta *PMeta) {
+					ret = ropeAppend(ret, text, DeltaMetaAppend(op.Meta, meta))
+				})
 			}
-			bi = bi.Next()
 		}
 	}
-	nexta()
-	nextb()
-	for at != -1 && (at == 0 || bt != -1) {
-		if at == 0 {
-			DeltaAddDelete(ret, uint32(len(ac.([]rune))))
-			nexta()
+	if rest != nil {
+		return nil
+	}
+	return &Rope{ret}
+}
+
+// DeltaComposeOld merges two consecutive deltas into one.
+func DeltaComposeOld(what []POp, to []POp) []POp {
+	ret := []POp{}
+	a := newDeltaIter(what)
+	b := newDeltaIter(to)
+	for !a.end || !b.end {
+		if b.is(OP_DELETE) {
+			ret = DeltaAddDelete(ret, b.op.Len)
+			b.next()
+		} else if a.is(OP_INSERT) {
+			ret = DeltaAddInsert(ret, a.op.Text, a.op.Meta, true)
+			a.next()
+		} else if a.end || b.end {
+			return nil
 		} else {
-			aq := ac.(uint32)
-			bq := uint32(len(bc.([]rune)))
-			minq := bq
-			if aq < bq {
-				minq = aq
-			}
-			if at == 1 {
-				DeltaAddInsert(ret, bc.([]rune)[:minq], bm, minq < bq)
-			} else if at == 2 {
-				DeltaAddRetain(ret, minq, DeltaMetaInvert(am, bm))
+			n := deltaMin(a.op.Len, b.op.Len)
+			aop := a.take(n)
+			bop := b.take(n)
+			if aop.Type == OP_RETAIN && bop.Type == OP_RETAIN {
+				ret = DeltaAddRetain(ret, n, DeltaMetaAppend(aop.Meta, bop.Meta))
+			} else if aop.Type == OP_RETAIN && bop.Type == OP_INSERT {
+				ret = DeltaAddInsert(ret, bop.Text, DeltaMetaAppend(aop.Meta, bop.Meta), true)
+			} else if aop.Type == OP_DELETE && bop.Type == OP_RETAIN {
+				ret = DeltaAddDelete(ret, n)
 			}
-			if aq == minq {
-				nexta()
+		}
+	}
+	return ret
+}
+
+// DeltaCompose applies what to document, dropping the parts user may not do:
+// without canEdit only own text can be deleted or restyled. It returns the
+// accepted delta, the new document and whether anything was rejected.
+func DeltaCompose(what []POp, document *Rope, canWriteWash bool, canEdit bool, user *User) ([]POp, *Rope, bool) {
+	accepted := []POp{}
+	rejected := false
+	pos := uint32(0)
+	length := document.Len()
+	for _, op := range what {
+		switch op.Type {
+		case OP_INSERT:
+			accepted = DeltaAddInsert(accepted, op.Text, op.Meta, true)
+		case OP_DELETE, OP_RETAIN:
+			if pos+op.Len > length {
+				return nil, nil, false
+			}
+			if op.Type == OP_RETAIN && op.Meta.Changemask == 0 {
+				accepted = DeltaAddRetain(accepted, op.Len, op.Meta)
 			} else {
-				ac = aq - minq
+				document.Each(pos, pos+op.Len, func(text []rune, meta *PMeta) {
+					n := uint32(len(text))
+					if canWriteWash || canEdit && meta.User != nil || meta.User == user {
+						if op.Type == OP_DELETE {
+							accepted = DeltaAddDelete(accepted, n)
+						} else {
+							accepted = DeltaAddRetain(accepted, n, op.Meta)
+						}
+					} else {
+						rejected = true
+						accepted = DeltaAddRetain(accepted, n, &PMeta{})
+					}
+				})
 			}
-			if bq == minq {
-				nextb()
+			pos += op.Len
+		}
+	}
+	if pos != length {
+		return nil, nil, false
+	}
+	return accepted, DeltaApply(accepted, document), rejected
+}
+
+// DeltaSuggest turns delta based on document into a suggestion of user:
+// inserted text is marked as suggested and deleted text is marked for
+// deletion, unless it is an own suggested insert which is deleted at once.
+// Formatting is kept only for own suggested text. converted tells that the
+// result differs from delta.
+func DeltaSuggest(delta []POp, document *Rope, user *User) (ret []POp, converted bool) {
+	ret = []POp{}
+	deleteMeta := &PMeta{Changemask: META_SUGGEST_DELETE, SuggestDelete: user}
+	pos := uint32(0)
+	length := document.Len()
+	for _, op := range delta {
+		switch op.Type {
+		case OP_INSERT:
+			meta := *op.Meta
+			meta.Changemask |= META_SUGGEST_INSERT
+			meta.SuggestInsert = user
+			ret = DeltaAddInsert(ret, op.Text, &meta, true)
+			converted = true
+		case OP_DELETE, OP_RETAIN:
+			if pos+op.Len > length {
+				return nil, false
+			}
+			if op.Type == OP_RETAIN && op.Meta.Changemask == 0 {
+				ret = DeltaAddRetain(ret, op.Len, op.Meta)
 			} else {
-				bc = bc.([]rune)[minq:]
+				document.Each(pos, pos+op.Len, func(text []rune, meta *PMeta) {
+					n := uint32(len(text))
+					own := meta.SuggestInsert != nil && meta.SuggestInsert == user
+					if own && op.Type == OP_DELETE {
+						ret = DeltaAddDelete(ret, n)
+					} else if own {
+						ret = DeltaAddRetain(ret, n, op.Meta)
+					} else if op.Type == OP_DELETE {
+						ret = DeltaAddRetain(ret, n, deleteMeta)
+						converted = true
+					} else {
+						ret = DeltaAddRetain(ret, n, &PMeta{})
+						converted = true
+					}
+				})
 			}
+			pos += op.Len
 		}
 	}
-	if at == -1 && bt == -1 {
-		return ret
-	}
-	return nil
-}
-
-func DeltaComposeOld(what *list.List, to *list.List) *list.List {
-	ret := list.New()
-	ai := what.Front()
-	bi := to.Front()
-	at := 0
-	bt := 0
-	ac := interface{}(nil)
-	bc := interface{}(nil)
-	am := (*PMeta)(nil)
-	bm := (*PMeta)(nil)
-	nexta := func() {
-		at = -1
-		if ai != nil {
-			switch op := ai.Value.(type) {
-			case *POpInsert:
-				ac = op.Text
-				at = 0
-				am = op.Meta
-			case *POpDelete:
-				ac = op.Len
-				at = 1
-				am = nil
-			case *POpRetain:
-				ac = op.Len
-				at = 2
-				am = op.Meta
-			}
-			ai = ai.Next()
-		}
-	}
-	nextb := func() {
-		bt = -1
-		if bi != nil {
-			switch op := bi.Value.(type) {
-			case *POpInsert:
-				bc = op.Text
-				bt = 0
-				bm = op.Meta
-			case *POpDelete:
-				bc = op.Len
-				bt = 1
-				bm = nil
-			case *POpRetain:
-				bc = op.Len
-				bt = 2
-				bm = op.Meta
-			}
-			bi = bi.Next()
-		}
-	}
-	nexta()
-	nextb()
-	for (at != -1 || bt == 1) && (at == 0 || bt != -1) {
-		if bt == 1 {
-			DeltaAddDelete(ret, bc.(uint32))
-			nextb()
-		} else if at == 0 {
-			DeltaAddInsert(ret, ac.([]rune), am, false)
-			nexta()
+	if pos != length {
+		return nil, false
+	}
+	return ret, converted
+}
+
+// DeltaResolveSuggestions returns delta accepting or rejecting suggestions of
+// user userId, or of everyone if it is 0, in range from..to of document.
+func DeltaResolveSuggestions(document *Rope, from uint32, to uint32, userId uint32, accept bool) []POp {
+	length := document.Len()
+	if from > to || to > length {
+		return nil
+	}
+	ret := DeltaAddRetain([]POp{}, from, &PMeta{})
+	clearInsert := &PMeta{Changemask: META_SUGGEST_INSERT}
+	clearDelete := &PMeta{Changemask: META_SUGGEST_DELETE}
+	document.Each(from, to, func(text []rune, meta *PMeta) {
+		n := uint32(len(text))
+		insert := meta.SuggestInsert != nil && (userId == 0 || meta.SuggestInsert.Id == userId)
+		del := meta.SuggestDelete != nil && (userId == 0 || meta.SuggestDelete.Id == userId)
+		switch {
+		case accept && del, !accept && insert:
+			ret = DeltaAddDelete(ret, n)
+		case insert:
+			ret = DeltaAddRetain(ret, n, clearInsert)
+		case del:
+			ret = DeltaAddRetain(ret, n, clearDelete)
+		default:
+			ret = DeltaAddRetain(ret, n, &PMeta{})
+		}
+	})
+	return DeltaAddRetain(ret, length-to, &PMeta{})
+}
+
+func DeltaTransform(a []POp, b []POp) []POp {
+	return DeltaTransformPriority(a, b, true)
+}
+
+// DeltaTransformPriority rebases a over concurrent b. When aFirst is false
+// inserts at the same position go after b's and attributes set by both
+// deltas are left to b, so both sides converge.
+func DeltaTransformPriority(a []POp, b []POp, aFirst bool) []POp {
+	ret := []POp{}
+	ai := newDeltaIter(a)
+	bi := newDeltaIter(b)
+	for !ai.end || !bi.end {
+		if ai.is(OP_INSERT) && (aFirst || !bi.is(OP_INSERT)) {
+			ret = DeltaAddInsert(ret, ai.op.Text, ai.op.Meta, true)
+			ai.next()
+		} else if bi.is(OP_INSERT) {
+			ret = DeltaAddRetain(ret, bi.op.Len, &PMeta{})
+			bi.next()
+		} else if ai.end || bi.end {
+			return nil
 		} else {
-			aq := ac.(uint32)
-			bq := uint32(0)
-			if bt == 0 {
-				bq = uint32(len(bc.([]rune)))
-			} else {
-				bq = bc.(uint32)
-			}
-			minq := bq
-			if aq < bq {
-				minq = aq
-			}
-			if at == 2 && bt == 2 {
-				DeltaAddRetain(ret, minq, DeltaMetaAppend(am, bm))
-			} else if at == 2 && bt == 0 {
-				DeltaAddInsert(ret, bc.([]rune)[:minq], DeltaMetaAppend(am, bm), minq < bq)
-			} else if at == 1 && bt == 2 {
-				DeltaAddDelete(ret, minq)
-			}
-			if aq == minq {
-				nexta()
-			} else {
-				ac = aq - minq
-			}
-			if bq == minq {
-				nextb()
-			} else {
-				if bt == 0 {
-					bc = bc.([]rune)[minq:]
+			n := deltaMin(ai.op.Len, bi.op.Len)
+			aop := ai.take(n)
+			bop := bi.take(n)
+			if aop.Type == OP_RETAIN && bop.Type == OP_RETAIN {
+				if aFirst {
+					ret = DeltaAddRetain(ret, n, aop.Meta)
 				} else {
-					bc = bq - minq
+					ret = DeltaAddRetain(ret, n, DeltaMetaComplement(bop.Meta, aop.Meta))
 				}
+			} else if bop.Type == OP_RETAIN {
+				ret = DeltaAddDelete(ret, n)
 			}
 		}
 	}
-	if at == -1 && bt == -1 {
-		return ret
-	}
-	return nil
-}
-
-func DeltaCompose(what *list.List, to *list.List, canWriteWash bool, canEdit bool, user *User) [2]*list.List {
-	an := list.New()
-	bn := list.New()
-	ai := what.Front()
-	bi := to.Front()
-	at := 0
-	bt := 0
-	ac := interface{}(nil)
-	bc := interface{}(nil)
-	am := (*PMeta)(nil)
-	bm := (*PMeta)(nil)
-	nexta := func() {
-		at = -1
-		if ai != nil {
-			switch op := ai.Value.(type) {
-			case *POpInsert:
-				ac = op.Text
-				at = 0
-				am = op.Meta
-			case *POpDelete:
-				ac = op.Len
-				at = 1
-				am = nil
-			case *POpRetain:
-				ac = op.Len
-				at = 2
-				am = op.Meta
-			}
-			ai = ai.Next()
-		}
-	}
-	nextb := func() {
-		bt = -1
-		if bi != nil {
-			switch op := bi.Value.(type) {
-			case *POpInsert:
-				bc = op.Text
-				bt = 0
-				bm = op.Meta
-			case *POpDelete:
-				bc = op.Len
-				bt = 1
-				bm = nil
-			case *POpRetain:
-				bc = op.Len
-				bt = 2
-				bm = op.Meta
+	return ret
+}
+
+func DeltaIsNoop(delta []POp) bool {
+	for _, op := range delta {
+		if op.Type != OP_RETAIN || op.Meta.Changemask != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func deltaUtf16Len(r rune) uint32 {
+	if r >= 0x10000 {
+		return 2
+	}
+	return 1
+}
+
+// DeltaToUtf16 converts lengths of delta based on document from runes to
+// UTF-16 code units for clients counting offsets the javascript way.
+func DeltaToUtf16(delta []POp, document *Rope) []POp {
+	ret := make([]POp, len(delta))
+	pos := uint32(0)
+	for i, op := range delta {
+		units := uint32(0)
+		if op.Type == OP_INSERT {
+			for _, r := range op.Text {
+				units += deltaUtf16Len(r)
 			}
-			bi = bi.Next()
-		}
-	}
-	nexta()
-	nextb()
-	for (at != -1 || bt == 1) && (at == 0 || bt != -1) {
-		if bt == 1 {
-			DeltaAddDelete(bn, bc.(uint32))
-			nextb()
-		} else if at == 0 {
-			DeltaAddInsert(an, ac.([]rune), am, false)
-			DeltaAddInsert(bn, ac.([]rune), am, false)
-			nexta()
 		} else {
-			aq := ac.(uint32)
-			bq := uint32(0)
-			if bt == 0 {
-				bq = uint32(len(bc.([]rune)))
-			} else {
-				bq = bc.(uint32)
-			}
-			minq := bq
-			if aq < bq {
-				minq = aq
-			}
-			if at == 2 && bt == 2 {
-				if canWriteWash || canEdit && bm.User != nil || bm.User == user {
-					DeltaAddRetain(an, minq, am)
-					DeltaAddRetain(bn, minq, DeltaMetaAppend(am, bm))
-				} else {
-					DeltaAddRetain(an, minq, &PMeta{})
-					DeltaAddRetain(bn, minq, bm)
-				}
-			} else if at == 2 && bt == 0 {
-				if canWriteWash || canEdit && bm.User != nil || bm.User == user {
-					DeltaAddRetain(an, minq, am)
-					DeltaAddInsert(bn, bc.([]rune)[:minq], DeltaMetaAppend(am, bm), minq < bq)
-				} else {
-					DeltaAddRetain(an, minq, &PMeta{})
-					DeltaAddInsert(bn, bc.([]rune)[:minq], bm, minq < bq)
-				}
-			} else if at == 1 && bt == 2 {
-				if canWriteWash || canEdit && bm.User != nil || bm.User == user {
-					DeltaAddDelete(an, minq)
-					DeltaAddDelete(bn, minq)
-				} else {
-					DeltaAddRetain(an, minq, &PMeta{})
-					DeltaAddRetain(bn, minq, bm)
-				}
-			} else if at == 1 && bt == 0 {
-				if canWriteWash || canEdit && bm.User != nil || bm.User == user {
-					DeltaAddDelete(an, minq)
-				} else {
-					DeltaAddRetain(an, minq, &PMeta{})
-					DeltaAddInsert(bn, bc.([]rune)[:minq], bm, minq < bq)
+			document.Each(pos, pos+op.Len, func(text []rune, meta *PMeta) {
+				for _, r := range text {
+					units += deltaUtf16Len(r)
 				}
-			}
-			if aq == minq {
-				nexta()
-			} else {
-				ac = aq - minq
-			}
-			if bq == minq {
-				nextb()
-			} else {
-				if bt == 0 {
-					bc = bc.([]rune)[minq:]
-				} else {
-					bc = bq - minq
+			})
+			pos += op.Len
+		}
+		ret[i] = op
+		ret[i].Len = units
+	}
+	return ret
+}
+
+// DeltaFromUtf16 converts lengths of delta based on document from UTF-16
+// code units to runes. It returns nil if an op ends inside a surrogate pair
+// or past the end of document.
+func DeltaFromUtf16(delta []POp, document *Rope) []POp {
+	ret := make([]POp, 0, len(delta))
+	pos := uint32(0)
+	for _, op := range delta {
+		if op.Type == OP_INSERT {
+			op.Len = uint32(len(op.Text))
+		} else {
+			units := uint32(0)
+			runes := uint32(0)
+			document.Each(pos, pos+op.Len, func(text []rune, meta *PMeta) {
+				for _, r := range text {
+					if units >= op.Len {
+						return
+					}
+					units += deltaUtf16Len(r)
+					runes++
 				}
+			})
+			if units != op.Len {
+				return nil
 			}
+			op.Len = runes
+			pos += runes
 		}
+		ret = append(ret, op)
 	}
-	if at == -1 && bt == -1 {
-		return [2]*list.List{an, bn}
-	}
-	return [2]*list.List{nil, nil}
-}
-
-func DeltaTransform(a *list.List, b *list.List) *list.List {
-	an := list.New()
-	//bn := list.New()
-	ai := a.Front()
-	bi := b.Front()
-	at := 0
-	bt := 0
-	ac := interface{}(nil)
-	bc := interface{}(nil)
-	am := (*PMeta)(nil)
-	bm := (*PMeta)(nil)
-	nexta := func() {
-		at = -1
-		if ai != nil {
-			switch op := ai.Value.(type) {
-			case *POpInsert:
-				ac = op.Text
-				at = 0
-				am = op.Meta
-			case *POpDelete:
-				ac = op.Len
-				at = 1
-				am = nil
-			case *POpRetain:
-				ac = op.Len
-				at = 2
-				am = op.Meta
-			}
-			ai = ai.Next()
-		}
-	}
-	nextb := func() {
-		bt = -1
-		if bi != nil {
-			switch op := bi.Value.(type) {
-			case *POpInsert:
-				bc = op.Text
-				bt = 0
-				bm = op.Meta
-			case *POpDelete:
-				bc = op.Len
-				bt = 1
-				bm = nil
-			case *POpRetain:
-				bc = op.Len
-				bt = 2
-				bm = op.Meta
-			}
-			bi = bi.Next()
-		}
-	}
-	nexta()
-	nextb()
-	for (at != -1 || bt == 0) && (at == 0 || bt != -1) {
-		if at == 0 {
-			DeltaAddInsert(an, ac.([]rune), am, false)
-			//DeltaAddRetain(bn, uint32(len(ac.([]rune))), &PMeta{})
-			nexta()
-		} else if bt == 0 {
-			DeltaAddRetain(an, uint32(len(bc.([]rune))), &PMeta{})
-			//DeltaAddInsert(bn, bc.([]rune), bm, false)
-			nextb()
-		} else {
-			aq := ac.(uint32)
-			bq := bc.(uint32)
-			minq := bq
-			if aq < bq {
-				minq = aq
+	return ret
+}
+
+// DeltaOffsetFromUtf16 converts offset in document from UTF-16 code units
+// to runes.
+func DeltaOffsetFromUtf16(offset uint32, document *Rope) (uint32, bool) {
+	units := uint32(0)
+	runes := uint32(0)
+	document.Each(0, offset, func(text []rune, meta *PMeta) {
+		for _, r := range text {
+			if units >= offset {
+				return
 			}
-			if at == 2 && bt == 2 {
-				DeltaAddRetain(an, minq, am)
-				//	DeltaAddRetain(bn, minq, DeltaMetaComplement(am, bm))
-			} else if bt == 2 {
-				DeltaAddDelete(an, minq)
-			} /* else if at == 2 {
-				DeltaAddDelete(bn, minq)
-			}*/
-			if aq == minq {
-				nexta()
+			units += deltaUtf16Len(r)
+			runes++
+		}
+	})
+	return runes, units == offset
+}
+
+// DeltaOffsetToUtf16 converts offset in document from runes to UTF-16 code
+// units.
+func DeltaOffsetToUtf16(offset uint32, document *Rope) uint32 {
+	units := uint32(0)
+	document.Each(0, offset, func(text []rune, meta *PMeta) {
+		for _, r := range text {
+			units += deltaUtf16Len(r)
+		}
+	})
+	return units
+}
+
+// DeltaTransformPosition moves pos in the document delta is based on to the
+// document after delta. Text inserted exactly at pos goes before it unless
+// stick is set.
+func DeltaTransformPosition(delta []POp, pos uint32, stick bool) uint32 {
+	ret := pos
+	cur := uint32(0)
+	for _, op := range delta {
+		if cur > pos {
+			break
+		}
+		switch op.Type {
+		case OP_INSERT:
+			if cur < pos || !stick {
+				ret += op.Len
+			}
+		case OP_DELETE:
+			if cur < pos {
+				ret -= deltaMin(op.Len, pos-cur)
+			}
+			cur += op.Len
+		case OP_RETAIN:
+			cur += op.Len
+		}
+	}
+	return ret
+}
+
+// DeltaRestrict keeps only the part of delta which changes document range
+// from..to, text outside of the range is retained unchanged.
+func DeltaRestrict(delta []POp, from uint32, to uint32) []POp {
+	ret := []POp{}
+	pos := uint32(0)
+	for _, op := range delta {
+		if op.Type == OP_INSERT {
+			if pos >= from && pos <= to {
+				ret = DeltaAddInsert(ret, op.Text, op.Meta, true)
+			}
+			continue
+		}
+		end := pos + op.Len
+		if pos < from {
+			ret = DeltaAddRetain(ret, deltaMin(end, from)-pos, &PMeta{})
+		}
+		start := pos
+		if start < from {
+			start = from
+		}
+		if stop := deltaMin(end, to); start < stop {
+			if op.Type == OP_DELETE {
+				ret = DeltaAddDelete(ret, stop-start)
 			} else {
-				ac = aq - minq
+				ret = DeltaAddRetain(ret, stop-start, op.Meta)
 			}
-			if bq == minq {
-				nextb()
-			} else {
-				bc = bq - minq
+		}
+		if end > to {
+			start = pos
+			if start < to {
+				start = to
 			}
+			ret = DeltaAddRetain(ret, end-start, &PMeta{})
 		}
+		pos = end
 	}
-	if at == -1 && bt == -1 {
-		return an
-	}
-	return nil
+	return ret
 }
 
-func DeltaToProtobuf(opsList *list.List) []*Op {
-	ops := make([]*Op, opsList.Len())
-	count := 0
-	for op := opsList.Front(); op != nil; op = op.Next() {
-		switch op := op.Value.(type) {
-		case *POpInsert:
-			meta := OpMeta{op.Meta.Changemask, op.Meta.Bold, op.Meta.Italic, op.Meta.Underline, op.Meta.Strike, op.Meta.FontSize, 0}
-			if op.Meta.User != nil {
-				meta.UserId = op.Meta.User.Id
+// DeltaClip drops the part of delta which changes document range from..to,
+// inserts at the bounds of the range are kept. It also returns whether
+// anything was dropped.
+func DeltaClip(delta []POp, from uint32, to uint32) ([]POp, bool) {
+	ret := []POp{}
+	clipped := false
+	pos := uint32(0)
+	for _, op := range delta {
+		if op.Type == OP_INSERT {
+			if pos > from && pos < to {
+				clipped = true
+			} else {
+				ret = DeltaAddInsert(ret, op.Text, op.Meta, true)
 			}
-			ops[count] = &Op{&Op_Insert{&OpInsert{string(op.Text), &meta}}}
-		case *POpDelete:
-			ops[count] = &Op{&Op_Delete{&OpDelete{op.Len}}}
-		case *POpRetain:
-			meta := OpMeta{op.Meta.Changemask, op.Meta.Bold, op.Meta.Italic, op.Meta.Underline, op.Meta.Strike, op.Meta.FontSize, 0}
-			if op.Meta.User != nil {
-				meta.UserId = op.Meta.User.Id
+			continue
+		}
+		end := pos + op.Len
+		for pos < end {
+			inside := pos >= from && pos < to
+			stop := end
+			if inside {
+				stop = deltaMin(end, to)
+			} else if pos < from {
+				stop = deltaMin(end, from)
+			}
+			if inside && (op.Type == OP_DELETE || op.Meta.Changemask != 0) {
+				clipped = true
+				ret = DeltaAddRetain(ret, stop-pos, &PMeta{})
+			} else if op.Type == OP_DELETE {
+				ret = DeltaAddDelete(ret, stop-pos)
+			} else {
+				ret = DeltaAddRetain(ret, stop-pos, op.Meta)
 			}
-			ops[count] = &Op{&Op_Retain{&OpRetain{op.Len, &meta}}}
+			pos = stop
 		}
-		count++
 	}
-	return ops
+	return ret, clipped
 }
 
-func DeltaToString(opsList *list.List) string {
-	ops := make([]*Op, opsList.Len())
-	count := 0
-	for op := opsList.Front(); op != nil; op = op.Next() {
-		switch op := op.Value.(type) {
-		case *POpInsert:
-			meta := OpMeta{op.Meta.Changemask, op.Meta.Bold, op.Meta.Italic, op.Meta.Underline, op.Meta.Strike, op.Meta.FontSize, 0}
-			if op.Meta.User != nil {
-				meta.UserId = op.Meta.User.Id
-			}
-			ops[count] = &Op{&Op_Insert{&OpInsert{string(op.Text), &meta}}}
-		case *POpDelete:
-			ops[count] = &Op{&Op_Delete{&OpDelete{op.Len}}}
-		case *POpRetain:
-			meta := OpMeta{op.Meta.Changemask, op.Meta.Bold, op.Meta.Italic, op.Meta.Underline, op.Meta.Strike, op.Meta.FontSize, 0}
-			if op.Meta.User != nil {
-				meta.UserId = op.Meta.User.Id
+func DeltaToProtobuf(delta []POp) []*Op {
+	ops := make([]*Op, 0, len(delta))
+	for _, op := range delta {
+		if op.Type == OP_DELETE {
+			ops = append(ops, &Op{&Op_Delete{&OpDelete{op.Len}}})
+			continue
+		}
+		meta := OpMeta{op.Meta.Changemask &^ META_EMBED, op.Meta.Bold, op.Meta.Italic, op.Meta.Underline, op.Meta.Strike, op.Meta.FontSize, 0,
+			op.Meta.Link, op.Meta.Color, op.Meta.Highlight, op.Meta.Code, op.Meta.Heading, op.Meta.List, op.Meta.Quote, op.Meta.CodeBlock, 0, 0}
+		if op.Meta.User != nil {
+			meta.UserId = op.Meta.User.Id
+		}
+		if op.Meta.SuggestInsert != nil {
+			meta.SuggestInsert = op.Meta.SuggestInsert.Id
+		}
+		if op.Meta.SuggestDelete != nil {
+			meta.SuggestDelete = op.Meta.SuggestDelete.Id
+		}
+		if op.Type == OP_INSERT && op.Meta.Embed != nil {
+			embed := op.Meta.Embed
+			for range op.Text {
+				ops = append(ops, &Op{&Op_Embed{&OpEmbed{embed.Type, embed.Ref, embed.Name, embed.Checked, &meta}}})
 			}
-			ops[count] = &Op{&Op_Retain{&OpRetain{op.Len, &meta}}}
+		} else if op.Type == OP_INSERT {
+			ops = append(ops, &Op{&Op_Insert{&OpInsert{string(op.Text), &meta}}})
+		} else {
+			ops = append(ops, &Op{&Op_Retain{&OpRetain{op.Len, &meta}}})
 		}
-		count++
 	}
-	return fmt.Sprintf("%v", ops)
+	return ops
+}
+
+func DeltaToString(delta []POp) string {
+	return fmt.Sprintf("%v", DeltaToProtobuf(delta))
 }
@@ -0,0 +1,899 @@
+/*
+Esterpad online collaborative editor
+Copyright (C) 2017 Anon2Anon
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package esterpad
+
+import (
+	. "esterpad_utils"
+	"math/rand"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+const testIterations = 500
+
+var testUsers = []*User{{Id: 1, Nickname: "one"}, {Id: 2, Nickname: "two"}, {Id: 3, Nickname: "three"}}
+
+type testChar struct {
+	Rune          rune
+	Bold          bool
+	Italic        bool
+	Underline     bool
+	Strike        bool
+	FontSize      uint32
+	User          *User
+	Link          string
+	Color         uint32
+	Highlight     uint32
+	Code          bool
+	Heading       uint32
+	List          uint32
+	Quote         bool
+	CodeBlock     bool
+	Embed         *PEmbed
+	SuggestInsert *User
+	SuggestDelete *User
+}
+
+func init() {
+	UserMutex.Lock()
+	for _, user := range testUsers {
+		UserMap[user.Id] = user
+	}
+	UserMutex.Unlock()
+}
+
+func testRandomMeta(r *rand.Rand, insert bool) *PMeta {
+	meta := &PMeta{Changemask: uint32(r.Intn(META_ALL + 1))}
+	if r.Intn(3) == 0 {
+		meta.Changemask = 0
+	}
+	if insert {
+		meta.Changemask |= 32
+	}
+	if meta.Changemask&1 != 0 {
+		meta.Bold = r.Intn(2) == 0
+	}
+	if meta.Changemask&2 != 0 {
+		meta.Italic = r.Intn(2) == 0
+	}
+	if meta.Changemask&4 != 0 {
+		meta.Underline = r.Intn(2) == 0
+	}
+	if meta.Changemask&8 != 0 {
+		meta.Strike = r.Intn(2) == 0
+	}
+	if meta.Changemask&16 != 0 {
+		meta.FontSize = uint32(r.Intn(3))
+	}
+	if meta.Changemask&32 != 0 {
+		meta.User = testUsers[r.Intn(len(testUsers))]
+	}
+	if meta.Changemask&META_LINK != 0 {
+		meta.Link = []string{"", "https://a", "https://b"}[r.Intn(3)]
+	}
+	if meta.Changemask&META_COLOR != 0 {
+		meta.Color = uint32(r.Intn(3))
+	}
+	if meta.Changemask&META_HIGHLIGHT != 0 {
+		meta.Highlight = uint32(r.Intn(3))
+	}
+	if meta.Changemask&META_CODE != 0 {
+		meta.Code = r.Intn(2) == 0
+	}
+	if meta.Changemask&META_HEADING != 0 {
+		meta.Heading = uint32(r.Intn(3))
+	}
+	if meta.Changemask&META_LIST != 0 {
+		meta.List = uint32(r.Intn(3))
+	}
+	if meta.Changemask&META_QUOTE != 0 {
+		meta.Quote = r.Intn(2) == 0
+	}
+	if meta.Changemask&META_CODEBLOCK != 0 {
+		meta.CodeBlock = r.Intn(2) == 0
+	}
+	return meta
+}
+
+func testRandomText(r *rand.Rand) []rune {
+	alphabet := []rune("ab\nя😀𝄞")
+	text := make([]rune, 1+r.Intn(4))
+	for i := range text {
+		text[i] = alphabet[r.Intn(len(alphabet))]
+	}
+	return text
+}
+
+func testRandomDocument(r *rand.Rand) *Rope {
+	ops := []POp{}
+	for i := r.Intn(6); i > 0; i-- {
+		ops = DeltaAddInsert(ops, testRandomText(r), testRandomMeta(r, true), false)
+	}
+	return RopeFromOps(ops)
+}
+
+func testRandomDelta(r *rand.Rand, length uint32) []POp {
+	delta := []POp{}
+	for length > 0 {
+		n := 1 + uint32(r.Intn(4))
+		if n > length {
+			n = length
+		}
+		switch r.Intn(4) {
+		case 0:
+			delta = DeltaAddInsert(delta, testRandomText(r), testRandomMeta(r, true), false)
+		case 1:
+			delta = DeltaAddDelete(delta, n)
+			length -= n
+		default:
+			delta = DeltaAddRetain(delta, n, testRandomMeta(r, false))
+			length -= n
+		}
+	}
+	if r.Intn(2) == 0 {
+		delta = DeltaAddInsert(delta, testRandomText(r), testRandomMeta(r, true), false)
+	}
+	return delta
+}
+
+func testResultLen(delta []POp) uint32 {
+	ret := uint32(0)
+	for _, op := range delta {
+		if op.Type != OP_DELETE {
+			ret += op.Len
+		}
+	}
+	return ret
+}
+
+func testChars(document *Rope) []testChar {
+	ret := []testChar{}
+	document.Each(0, document.Len(), func(text []rune, meta *PMeta) {
+		c := testChar{}
+		if meta.Changemask&1 != 0 {
+			c.Bold = meta.Bold
+		}
+		if meta.Changemask&2 != 0 {
+			c.Italic = meta.Italic
+		}
+		if meta.Changemask&4 != 0 {
+			c.Underline = meta.Underline
+		}
+		if meta.Changemask&8 != 0 {
+			c.Strike = meta.Strike
+		}
+		if meta.Changemask&16 != 0 {
+			c.FontSize = meta.FontSize
+		}
+		if meta.Changemask&32 != 0 {
+			c.User = meta.User
+		}
+		if meta.Changemask&META_LINK != 0 {
+			c.Link = meta.Link
+		}
+		if meta.Changemask&META_COLOR != 0 {
+			c.Color = meta.Color
+		}
+		if meta.Changemask&META_HIGHLIGHT != 0 {
+			c.Highlight = meta.Highlight
+		}
+		if meta.Changemask&META_CODE != 0 {
+			c.Code = meta.Code
+		}
+		if meta.Changemask&META_HEADING != 0 {
+			c.Heading = meta.Heading
+		}
+		if meta.Changemask&META_LIST != 0 {
+			c.List = meta.List
+		}
+		if meta.Changemask&META_QUOTE != 0 {
+			c.Quote = meta.Quote
+		}
+		if meta.Changemask&META_CODEBLOCK != 0 {
+			c.CodeBlock = meta.CodeBlock
+		}
+		if meta.Changemask&META_EMBED != 0 {
+			c.Embed = meta.Embed
+		}
+		if meta.Changemask&META_SUGGEST_INSERT != 0 {
+			c.SuggestInsert = meta.SuggestInsert
+		}
+		if meta.Changemask&META_SUGGEST_DELETE != 0 {
+			c.SuggestDelete = meta.SuggestDelete
+		}
+		for _, r := range text {
+			c.Rune = r
+			ret = append(ret, c)
+		}
+	})
+	return ret
+}
+
+func testApply(t *testing.T, seed int, delta []POp, document *Rope) *Rope {
+	ret := DeltaApply(delta, document)
+	if ret == nil {
+		t.Fatalf("seed %d: can't apply %s to %s", seed, DeltaToString(delta), DeltaToString(document.Ops()))
+	}
+	return ret
+}
+
+func testCompose(t *testing.T, seed int, what []POp, to []POp) []POp {
+	ret := DeltaComposeOld(what, to)
+	if ret == nil {
+		t.Fatalf("seed %d: can't compose %s to %s", seed, DeltaToString(what), DeltaToString(to))
+	}
+	return ret
+}
+
+func testEqualDocuments(t *testing.T, seed int, got *Rope, want *Rope) {
+	if g, w := testChars(got), testChars(want); !reflect.DeepEqual(g, w) {
+		t.Fatalf("seed %d: documents differ\ngot  %s\nwant %s", seed, DeltaToString(got.Ops()), DeltaToString(want.Ops()))
+	}
+}
+
+func testDocument(text string, meta *PMeta) *Rope {
+	return RopeFromOps(DeltaAddInsert(nil, []rune(text), meta, false))
+}
+
+func TestDeltaApply(t *testing.T) {
+	bold := &PMeta{Changemask: 1, Bold: true}
+	author := &PMeta{Changemask: 32, User: testUsers[0]}
+	document := testDocument("hello", author)
+	delta := DeltaAddRetain(nil, 1, &PMeta{})
+	delta = DeltaAddDelete(delta, 3)
+	delta = DeltaAddInsert(delta, []rune("ipp"), author, false)
+	delta = DeltaAddRetain(delta, 1, bold)
+	result := testApply(t, 0, delta, document)
+	if text := string(result.Text()); text != "hippo" {
+		t.Fatalf("got %q, want %q", text, "hippo")
+	}
+	chars := testChars(result)
+	if !chars[4].Bold || chars[4].User != testUsers[0] || chars[0].Bold {
+		t.Fatalf("wrong meta %s", DeltaToString(result.Ops()))
+	}
+	if string(document.Text()) != "hello" {
+		t.Fatal("source document was modified")
+	}
+	if DeltaApply(DeltaAddRetain(nil, 4, &PMeta{}), document) != nil {
+		t.Fatal("delta shorter than document was applied")
+	}
+	if DeltaApply(DeltaAddRetain(nil, 6, &PMeta{}), document) != nil {
+		t.Fatal("delta longer than document was applied")
+	}
+}
+
+func TestDeltaApplyMatchesCompose(t *testing.T) {
+	for seed := 0; seed < testIterations; seed++ {
+		r := rand.New(rand.NewSource(int64(seed)))
+		document := testRandomDocument(r)
+		delta := testRandomDelta(r, document.Len())
+		composed := RopeFromOps(testCompose(t, seed, delta, document.Ops()))
+		testEqualDocuments(t, seed, testApply(t, seed, delta, document), composed)
+	}
+}
+
+func TestDeltaComposeOldAssociative(t *testing.T) {
+	for seed := 0; seed < testIterations; seed++ {
+		r := rand.New(rand.NewSource(int64(seed)))
+		document := testRandomDocument(r)
+		a := testRandomDelta(r, document.Len())
+		b := testRandomDelta(r, testResultLen(a))
+		c := testRandomDelta(r, testResultLen(b))
+
+		sequential := testApply(t, seed, c, testApply(t, seed, b, testApply(t, seed, a, document)))
+		left := testApply(t, seed, testCompose(t, seed, c, testCompose(t, seed, b, a)), document)
+		right := testApply(t, seed, c, testApply(t, seed, testCompose(t, seed, b, a), document))
+		grouped := testApply(t, seed, testCompose(t, seed, testCompose(t, seed, c, b), a), document)
+		testEqualDocuments(t, seed, left, sequential)
+		testEqualDocuments(t, seed, right, sequential)
+		testEqualDocuments(t, seed, grouped, sequential)
+	}
+}
+
+func TestDeltaInvert(t *testing.T) {
+	for seed := 0; seed < testIterations; seed++ {
+		r := rand.New(rand.NewSource(int64(seed)))
+		document := testRandomDocument(r)
+		original := testChars(document)
+		delta := testRandomDelta(r, document.Len())
+		inverted := DeltaInvert(delta, document)
+		if inverted == nil {
+			t.Fatalf("seed %d: can't invert %s", seed, DeltaToString(delta))
+		}
+		restored := testApply(t, seed, inverted, testApply(t, seed, delta, document))
+		testEqualDocuments(t, seed, restored, document)
+		if !reflect.DeepEqual(testChars(document), original) {
+			t.Fatalf("seed %d: source document was modified", seed)
+		}
+	}
+	if DeltaInvert(DeltaAddRetain(nil, 4, &PMeta{}), testDocument("abc", &PMeta{})) != nil {
+		t.Fatal("delta longer than document was inverted")
+	}
+}
+
+func TestDeltaTransformConverges(t *testing.T) {
+	for seed := 0; seed < testIterations; seed++ {
+		r := rand.New(rand.NewSource(int64(seed)))
+		document := testRandomDocument(r)
+		a := testRandomDelta(r, document.Len())
+		b := testRandomDelta(r, document.Len())
+		a1 := DeltaTransform(a, b)
+		b1 := DeltaTransformPriority(b, a, false)
+		if a1 == nil || b1 == nil {
+			t.Fatalf("seed %d: can't transform %s and %s", seed, DeltaToString(a), DeltaToString(b))
+		}
+		ab := testApply(t, seed, a1, testApply(t, seed, b, document))
+		ba := testApply(t, seed, b1, testApply(t, seed, a, document))
+		testEqualDocuments(t, seed, ab, ba)
+	}
+}
+
+func TestDeltaTransformInsertPriority(t *testing.T) {
+	document := testDocument("ab", &PMeta{})
+	a := DeltaAddRetain(nil, 1, &PMeta{})
+	a = DeltaAddInsert(a, []rune("x"), &PMeta{}, false)
+	a = DeltaAddRetain(a, 1, &PMeta{})
+	b := DeltaAddRetain(nil, 1, &PMeta{})
+	b = DeltaAddInsert(b, []rune("y"), &PMeta{}, false)
+	b = DeltaAddRetain(b, 1, &PMeta{})
+	result := testApply(t, 0, DeltaTransform(a, b), testApply(t, 0, b, document))
+	if text := string(result.Text()); text != "axyb" {
+		t.Fatalf("got %q, want %q", text, "axyb")
+	}
+	if DeltaTransform(a, DeltaAddRetain(nil, 1, &PMeta{})) != nil {
+		t.Fatal("deltas of different length were transformed")
+	}
+}
+
+func TestDeltaCompose(t *testing.T) {
+	for seed := 0; seed < testIterations; seed++ {
+		r := rand.New(rand.NewSource(int64(seed)))
+		document := testRandomDocument(r)
+		delta := testRandomDelta(r, document.Len())
+		user := testUsers[r.Intn(len(testUsers))]
+		canWriteWash := r.Intn(2) == 0
+		canEdit := r.Intn(2) == 0
+		accepted, result, rejected := DeltaCompose(delta, document, canWriteWash, canEdit, user)
+		if accepted == nil || result == nil {
+			t.Fatalf("seed %d: can't compose %s", seed, DeltaToString(delta))
+		}
+		testEqualDocuments(t, seed, testApply(t, seed, accepted, document), result)
+		if canWriteWash || !rejected {
+			testEqualDocuments(t, seed, result, testApply(t, seed, delta, document))
+		}
+	}
+}
+
+func TestDeltaComposeForeignText(t *testing.T) {
+	ops := DeltaAddInsert(nil, []rune("own"), &PMeta{Changemask: 32, User: testUsers[0]}, false)
+	ops = DeltaAddInsert(ops, []rune("foreign"), &PMeta{Changemask: 32, User: testUsers[1]}, false)
+	document := RopeFromOps(ops)
+	delta := DeltaAddDelete(nil, 10)
+	_, result, rejected := DeltaCompose(delta, document, false, false, testUsers[0])
+	if text := string(result.Text()); text != "foreign" || !rejected {
+		t.Fatalf("got %q, want %q", text, "foreign")
+	}
+	_, result, rejected = DeltaCompose(delta, document, false, true, testUsers[0])
+	if text := string(result.Text()); text != "" || rejected {
+		t.Fatalf("got %q, want empty document", text)
+	}
+
+	bold := DeltaAddRetain(nil, 3, &PMeta{Changemask: 1, Bold: true})
+	bold = DeltaAddRetain(bold, 7, &PMeta{})
+	bold = DeltaAddInsert(bold, []rune("!"), &PMeta{Changemask: 32, User: testUsers[0]}, false)
+	_, result, rejected = DeltaCompose(bold, document, false, false, testUsers[0])
+	if rejected || string(result.Text()) != "ownforeign!" || !testChars(result)[0].Bold {
+		t.Fatalf("own text formatting or append rejected: %s", DeltaToString(result.Ops()))
+	}
+	restyle := DeltaAddRetain(nil, 10, &PMeta{Changemask: 2, Italic: true})
+	_, result, rejected = DeltaCompose(restyle, document, false, false, testUsers[0])
+	chars := testChars(result)
+	if !rejected || !chars[0].Italic || chars[3].Italic {
+		t.Fatalf("foreign text formatting accepted: %s", DeltaToString(result.Ops()))
+	}
+}
+
+func TestDeltaValidateFromClient(t *testing.T) {
+	bold := &OpMeta{Changemask: 1 | 32, Bold: true, UserId: 2}
+	ops := []*Op{
+		{&Op_Retain{&OpRetain{0, nil}}},
+		{&Op_Retain{&OpRetain{2, nil}}},
+		{&Op_Retain{&OpRetain{3, nil}}},
+		{&Op_Insert{&OpInsert{"", nil}}},
+		{&Op_Insert{&OpInsert{"ab", nil}}},
+		{&Op_Insert{&OpInsert{"c", bold}}},
+		{&Op_Delete{&OpDelete{0}}},
+		{&Op_Delete{&OpDelete{1}}},
+		{&Op_Delete{&OpDelete{1}}},
+		{&Op_Retain{&OpRetain{1, bold}}},
+	}
+
+	delta, _ := DeltaValidateFromClient(ops, false, 1)
+	want := []POp{
+		{Type: OP_RETAIN, Len: 5, Meta: &PMeta{}},
+		{Type: OP_INSERT, Len: 2, Text: []rune("ab"), Meta: &PMeta{Changemask: 32, User: testUsers[0]}},
+		{Type: OP_INSERT, Len: 1, Text: []rune("c"), Meta: &PMeta{Changemask: 1 | 32, Bold: true, User: testUsers[0]}},
+		{Type: OP_DELETE, Len: 2},
+		{Type: OP_RETAIN, Len: 1, Meta: &PMeta{Changemask: 1, Bold: true}},
+	}
+	if !reflect.DeepEqual(delta, want) {
+		t.Fatalf("got %s", DeltaToString(delta))
+	}
+
+	delta, _ = DeltaValidateFromClient(ops, true, 1)
+	if insert := delta[2]; string(insert.Text) != "c" || !insert.Meta.Bold || insert.Meta.User != testUsers[1] {
+		t.Fatalf("whitewash author not kept: %s", DeltaToString(delta))
+	}
+	if retain := delta[4]; retain.Meta.Changemask != 1|32 || retain.Meta.User != testUsers[1] {
+		t.Fatalf("whitewash retain not kept: %s", DeltaToString(delta))
+	}
+
+	delta, _ = DeltaValidateFromClient(ops, false, 2)
+	if retain := delta[4]; retain.Meta.Changemask != 1|32 || retain.Meta.User != testUsers[1] {
+		t.Fatalf("own author retain not kept: %s", DeltaToString(delta))
+	}
+}
+
+func TestDeltaValidateAttributes(t *testing.T) {
+	valid := &OpMeta{Changemask: META_LINK | META_COLOR | META_HIGHLIGHT | META_CODE | META_HEADING | META_LIST | META_QUOTE | META_CODEBLOCK,
+		Link: "HTTPS://example.com", Color: 0xff0000, Highlight: 0xffff00, Code: true, Heading: 2, List: LIST_ORDERED, Quote: true, CodeBlock: true,
+		Bold: true}
+	invalid := &OpMeta{Changemask: META_LINK | META_COLOR | META_HEADING | META_LIST | 1<<20,
+		Link: "javascript:alert(1)", Color: 0x1000000, Heading: 7, List: 9}
+	ops := []*Op{{&Op_Retain{&OpRetain{1, valid}}}, {&Op_Retain{&OpRetain{1, invalid}}}}
+	delta, _ := DeltaValidateFromClient(ops, false, 1)
+	want := &PMeta{Changemask: valid.Changemask, Link: valid.Link, Color: valid.Color, Highlight: valid.Highlight,
+		Code: true, Heading: 2, List: LIST_ORDERED, Quote: true, CodeBlock: true}
+	if len(delta) != 2 || !reflect.DeepEqual(delta[0].Meta, want) {
+		t.Fatalf("valid attributes not kept: %+v", delta[0].Meta)
+	}
+	if *delta[1].Meta != (PMeta{}) {
+		t.Fatalf("invalid attributes kept: %+v", delta[1].Meta)
+	}
+
+	document := testDocument("ab\n", &PMeta{Changemask: 32, User: testUsers[0]})
+	heading := DeltaAddRetain(DeltaAddRetain(nil, 2, &PMeta{}), 1, &PMeta{Changemask: META_HEADING, Heading: 1})
+	result := testApply(t, 0, heading, document)
+	if chars := testChars(result); chars[2].Heading != 1 || chars[0].Heading != 0 || chars[2].User != testUsers[0] {
+		t.Fatalf("heading not applied to the newline: %+v", chars)
+	}
+	testEqualDocuments(t, 0, testApply(t, 0, DeltaInvert(heading, document), result), document)
+}
+
+func TestDeltaValidateLimits(t *testing.T) {
+	defer func(ops int, insert int) {
+		limitDeltaOps, limitDeltaInsert = ops, insert
+	}(limitDeltaOps, limitDeltaInsert)
+	limitDeltaOps, limitDeltaInsert = 3, 4
+	insert := func(text string) *Op { return &Op{&Op_Insert{&OpInsert{text, nil}}} }
+	embed := &Op{&Op_Embed{&OpEmbed{EMBED_CHECKBOX, "", "", false, nil}}}
+	for _, test := range []struct {
+		ops []*Op
+		ok  bool
+	}{
+		{[]*Op{insert("ab"), insert("я😀")}, true},
+		{[]*Op{insert("ab"), embed, insert("я")}, true},
+		{[]*Op{insert("ab"), insert("cde")}, false},
+		{[]*Op{insert("abcd"), embed}, false},
+		{[]*Op{insert("a"), insert("b"), insert("c"), insert("d")}, false},
+	} {
+		delta, reason := DeltaValidateFromClient(test.ops, false, 1)
+		if (delta != nil) != test.ok || (reason == "") != test.ok {
+			t.Fatalf("ops %v: delta %v, reason %q", test.ops, delta != nil, reason)
+		}
+	}
+}
+
+func TestDeltaEmbed(t *testing.T) {
+	ref := "/.upload/1/" + strings.Repeat("ab", 32)
+	ops := []*Op{
+		{&Op_Insert{&OpInsert{"a", nil}}},
+		{&Op_Embed{&OpEmbed{EMBED_IMAGE, ref, "shot.png", false, nil}}},
+		{&Op_Embed{&OpEmbed{EMBED_CHECKBOX, "", "", true, &OpMeta{Changemask: 1, Bold: true}}}},
+		{&Op_Embed{&OpEmbed{EMBED_FILE, "javascript:alert(1)", "", false, nil}}},
+		{&Op_Embed{&OpEmbed{42, ref, "", false, nil}}},
+		{&Op_Insert{&OpInsert{"b", nil}}},
+	}
+	delta, _ := DeltaValidateFromClient(ops, false, 1)
+	document := testApply(t, 0, delta, DefaultDocument)
+	if text := string(document.Text()); text != "a\uFFFC\uFFFCb" {
+		t.Fatalf("document text %q", text)
+	}
+	out := DeltaToProtobuf(document.Ops())
+	if len(out) != 4 {
+		t.Fatalf("got %d ops, want 4", len(out))
+	}
+	image, ok := out[1].Op.(*Op_Embed)
+	if !ok || image.Embed.Type != EMBED_IMAGE || image.Embed.Ref != ref || image.Embed.Meta.Changemask&META_EMBED != 0 {
+		t.Fatalf("image embed lost: %v", out[1])
+	}
+	checkbox, ok := out[2].Op.(*Op_Embed)
+	if !ok || !checkbox.Embed.Checked || !checkbox.Embed.Meta.Bold || checkbox.Embed.Meta.UserId != 1 {
+		t.Fatalf("checkbox embed lost: %v", out[2])
+	}
+
+	// Formatting and deleting embeds inverts back to the same objects.
+	retain := &PMeta{}
+	format := DeltaAddRetain(DeltaAddRetain(DeltaAddRetain(nil, 1, retain), 1, &PMeta{Changemask: META_ITALIC, Italic: true}), 2, retain)
+	remove := DeltaAddRetain(DeltaAddDelete(DeltaAddRetain(nil, 2, retain), 1), 1, retain)
+	for _, d := range [][]POp{format, remove} {
+		result := testApply(t, 0, d, document)
+		testEqualDocuments(t, 0, testApply(t, 0, DeltaInvert(d, document), result), document)
+		if d[1].Type == OP_RETAIN {
+			if chars := testChars(result); !chars[1].Italic || chars[1].Embed == nil || chars[1].Embed.Type != EMBED_IMAGE {
+				t.Fatalf("formatted embed %+v", chars[1])
+			}
+		}
+	}
+}
+
+func TestDeltaSuggest(t *testing.T) {
+	author := &PMeta{Changemask: 32, User: testUsers[0]}
+	suggester := &PMeta{Changemask: 32, User: testUsers[1]}
+	retain := &PMeta{}
+	document := testDocument("hello world", author)
+	delta := DeltaAddInsert(nil, []rune("hi "), suggester, false)
+	delta = DeltaAddDelete(delta, 6)
+	delta = DeltaAddRetain(delta, 5, retain)
+	suggestion, converted := DeltaSuggest(delta, document, testUsers[1])
+	if !converted {
+		t.Fatal("suggestion not reported as converted")
+	}
+	suggested := testApply(t, 0, suggestion, document)
+	if text := string(suggested.Text()); text != "hi hello world" {
+		t.Fatalf("suggested text %q", text)
+	}
+	chars := testChars(suggested)
+	if chars[0].SuggestInsert != testUsers[1] || chars[3].SuggestDelete != testUsers[1] || chars[9].SuggestDelete != nil {
+		t.Fatalf("suggestion marks %+v %+v %+v", chars[0], chars[3], chars[9])
+	}
+
+	// Own suggested text is deleted at once, others' text can't be restyled.
+	delta = DeltaAddDelete(nil, 1)
+	delta = DeltaAddRetain(delta, 8, retain)
+	delta = DeltaAddRetain(delta, 5, &PMeta{Changemask: META_BOLD, Bold: true})
+	suggestion, _ = DeltaSuggest(delta, suggested, testUsers[1])
+	suggested = testApply(t, 0, suggestion, suggested)
+	if text := string(suggested.Text()); text != "i hello world" {
+		t.Fatalf("suggested text %q", text)
+	}
+	if chars := testChars(suggested); chars[8].Bold {
+		t.Fatalf("foreign text was restyled %+v", chars[8])
+	}
+	if suggestion, _ := DeltaSuggest(DeltaAddRetain(nil, 3, retain), suggested, testUsers[1]); suggestion != nil {
+		t.Fatal("suggestion of wrong length accepted")
+	}
+	// Deleting own suggested text and plain retains are stored as sent.
+	delta = DeltaAddDelete(nil, 2)
+	delta = DeltaAddRetain(delta, 11, retain)
+	if suggestion, converted := DeltaSuggest(delta, suggested, testUsers[1]); suggestion == nil || converted {
+		t.Fatal("own suggestion delete converted")
+	}
+
+	for _, test := range []struct {
+		userId uint32
+		accept bool
+		text   string
+	}{
+		{0, true, "i world"},
+		{2, true, "i world"},
+		{0, false, "hello world"},
+		{2, false, "hello world"},
+	} {
+		result := testApply(t, 0, DeltaResolveSuggestions(suggested, 0, suggested.Len(), test.userId, test.accept), suggested)
+		if text := string(result.Text()); text != test.text {
+			t.Fatalf("resolve %+v: text %q", test, text)
+		}
+		for _, char := range testChars(result) {
+			if char.SuggestInsert != nil || char.SuggestDelete != nil {
+				t.Fatalf("resolve %+v: mark left %+v", test, char)
+			}
+		}
+	}
+	if !DeltaIsNoop(DeltaResolveSuggestions(suggested, 0, suggested.Len(), 3, true)) {
+		t.Fatal("suggestions of another user resolved")
+	}
+	partial := testApply(t, 0, DeltaResolveSuggestions(suggested, 0, 1, 0, true), suggested)
+	if text := string(partial.Text()); text != "i hello world" {
+		t.Fatalf("partial resolve text %q", text)
+	}
+	if chars := testChars(partial); chars[0].SuggestInsert != nil || chars[2].SuggestDelete == nil {
+		t.Fatalf("partial resolve marks %+v %+v", chars[0], chars[2])
+	}
+}
+
+func TestDeltaTransformPosition(t *testing.T) {
+	author := &PMeta{Changemask: 32, User: testUsers[0]}
+	for seed := 0; seed < testIterations; seed++ {
+		r := rand.New(rand.NewSource(int64(seed)))
+		text := make([]rune, r.Intn(20))
+		for i := range text {
+			text[i] = rune(0x4e00 + i)
+		}
+		document := testDocument(string(text), author)
+		delta := testRandomDelta(r, document.Len())
+		result := testApply(t, seed, delta, document).Text()
+		kept := map[rune]bool{}
+		for _, c := range result {
+			kept[c] = true
+		}
+		for i, c := range text {
+			before := DeltaTransformPosition(delta, uint32(i), false)
+			after := DeltaTransformPosition(delta, uint32(i+1), true)
+			if kept[c] && (result[before] != c || after != before+1) {
+				t.Fatalf("seed %d: char %d moved to %d..%d in %q", seed, i, before, after, string(result))
+			}
+		}
+		if end := DeltaTransformPosition(delta, document.Len(), true); end > uint32(len(result)) {
+			t.Fatalf("seed %d: end moved to %d past %d", seed, end, len(result))
+		}
+	}
+}
+
+// testApplyUtf16 applies delta with lengths in UTF-16 code units the way a
+// browser client does.
+func testApplyUtf16(t *testing.T, seed int, delta []POp, text []uint16) []uint16 {
+	ret := []uint16{}
+	pos := uint32(0)
+	for _, op := range delta {
+		if op.Type == OP_INSERT {
+			ret = append(ret, utf16.Encode(op.Text)...)
+			continue
+		}
+		if pos+op.Len > uint32(len(text)) {
+			t.Fatalf("seed %d: delta %v is longer than text %q", seed, DeltaToString(delta), string(utf16.Decode(text)))
+		}
+		if op.Type == OP_RETAIN {
+			ret = append(ret, text[pos:pos+op.Len]...)
+		}
+		pos += op.Len
+	}
+	if pos != uint32(len(text)) {
+		t.Fatalf("seed %d: delta %v is shorter than text %q", seed, DeltaToString(delta), string(utf16.Decode(text)))
+	}
+	return ret
+}
+
+func TestDeltaUtf16RoundTrip(t *testing.T) {
+	for seed := 0; seed < testIterations; seed++ {
+		r := rand.New(rand.NewSource(int64(seed)))
+		document := testRandomDocument(r)
+		delta := testRandomDelta(r, document.Len())
+		units := DeltaToUtf16(delta, document)
+		got := testApplyUtf16(t, seed, units, utf16.Encode(document.Text()))
+		want := utf16.Encode(testApply(t, seed, delta, document).Text())
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("seed %d: UTF-16 apply %q, want %q", seed, string(utf16.Decode(got)), string(utf16.Decode(want)))
+		}
+		back := DeltaFromUtf16(units, document)
+		if !reflect.DeepEqual(back, delta) {
+			t.Fatalf("seed %d: round trip %v, want %v", seed, DeltaToString(back), DeltaToString(delta))
+		}
+	}
+}
+
+func TestDeltaUtf16SplitSurrogate(t *testing.T) {
+	document := testDocument("a😀b", &PMeta{Changemask: 32, User: testUsers[0]})
+	retain := &PMeta{}
+	ok := DeltaAddRetain(DeltaAddDelete(DeltaAddRetain(nil, 1, retain), 2), 1, retain)
+	if got := DeltaFromUtf16(ok, document); !reflect.DeepEqual(got, DeltaAddRetain(DeltaAddDelete(DeltaAddRetain(nil, 1, retain), 1), 1, retain)) {
+		t.Fatalf("delete of astral character converted to %v", DeltaToString(got))
+	}
+	split := DeltaAddRetain(DeltaAddInsert(DeltaAddRetain(nil, 2, retain), []rune("x"), &PMeta{Changemask: 32, User: testUsers[1]}, false), 2, retain)
+	if got := DeltaFromUtf16(split, document); got != nil {
+		t.Fatalf("insert inside surrogate pair converted to %v", DeltaToString(got))
+	}
+	long := DeltaAddRetain(nil, 5, retain)
+	if got := DeltaFromUtf16(long, document); got != nil {
+		t.Fatalf("retain past the end converted to %v", DeltaToString(got))
+	}
+}
+
+// TestDeltaUtf16Concurrent runs one browser client counting UTF-16 code units
+// against one client counting runes and checks both end with the server text.
+func TestDeltaUtf16Concurrent(t *testing.T) {
+	for seed := 0; seed < testIterations; seed++ {
+		r := rand.New(rand.NewSource(int64(seed)))
+		base := testRandomDocument(r)
+		a := testRandomDelta(r, base.Len())
+		b := testRandomDelta(r, base.Len())
+		// Client A sends a in UTF-16 units, the server applied b first.
+		aUnits := DeltaToUtf16(a, base)
+		aServer := DeltaFromUtf16(aUnits, base)
+		if aServer == nil {
+			t.Fatalf("seed %d: can't convert %v", seed, DeltaToString(aUnits))
+		}
+		afterB := testApply(t, seed, b, base)
+		aTransformed := DeltaTransform(aServer, b)
+		server := testApply(t, seed, aTransformed, afterB)
+		// Client B receives transformed a in runes.
+		clientB := testApply(t, seed, aTransformed, afterB)
+		// Client A receives b in UTF-16 units based on its base revision and
+		// transforms it against its pending delta locally.
+		bUnits := DeltaToUtf16(b, base)
+		bTransformed := DeltaTransformPriority(bUnits, aUnits, false)
+		clientA := testApplyUtf16(t, seed, bTransformed, testApplyUtf16(t, seed, aUnits, utf16.Encode(base.Text())))
+		want := utf16.Encode(server.Text())
+		if !reflect.DeepEqual(clientA, want) {
+			t.Fatalf("seed %d: UTF-16 client has %q, server %q", seed, string(utf16.Decode(clientA)), server.Text())
+		}
+		if string(clientB.Text()) != string(server.Text()) {
+			t.Fatalf("seed %d: rune client has %q, server %q", seed, string(clientB.Text()), string(server.Text()))
+		}
+	}
+}
+
+func TestDeltaRestrict(t *testing.T) {
+	for seed := 0; seed < testIterations; seed++ {
+		r := rand.New(rand.NewSource(int64(seed)))
+		document := testRandomDocument(r)
+		delta := testRandomDelta(r, document.Len())
+		full := testApply(t, seed, DeltaRestrict(delta, 0, document.Len()), document)
+		testEqualDocuments(t, seed, full, testApply(t, seed, delta, document))
+		from := uint32(r.Intn(int(document.Len()) + 1))
+		to := from + uint32(r.Intn(int(document.Len()-from)+1))
+		restricted := testChars(testApply(t, seed, DeltaRestrict(delta, from, to), document))
+		chars := testChars(document)
+		if len(restricted) < len(chars)-int(to-from) {
+			t.Fatalf("seed %d: text outside of %d..%d was deleted", seed, from, to)
+		}
+		if !reflect.DeepEqual(restricted[:from], chars[:from]) {
+			t.Fatalf("seed %d: text before %d was changed", seed, from)
+		}
+		if !reflect.DeepEqual(restricted[len(restricted)-len(chars[to:]):], chars[to:]) {
+			t.Fatalf("seed %d: text after %d was changed", seed, to)
+		}
+	}
+}
+
+func TestDeltaRestrictRange(t *testing.T) {
+	author := &PMeta{Changemask: 32, User: testUsers[0]}
+	document := testDocument("aaa bbb ccc", author)
+	retain := &PMeta{}
+	delta := DeltaAddDelete(nil, 2)
+	delta = DeltaAddRetain(delta, 2, retain)
+	delta = DeltaAddDelete(delta, 3)
+	delta = DeltaAddInsert(delta, []rune("BBB"), author, false)
+	delta = DeltaAddRetain(delta, 1, retain)
+	delta = DeltaAddDelete(delta, 3)
+	if text := string(testApply(t, 0, DeltaRestrict(delta, 4, 7), document).Text()); text != "aaa BBB ccc" {
+		t.Fatalf("restricted delta gives %q", text)
+	}
+	if !DeltaIsNoop(DeltaRestrict(DeltaAddRetain(DeltaAddDelete(nil, 3), 8, retain), 4, 11)) {
+		t.Fatal("delta outside of range isn't a noop")
+	}
+}
+
+func TestDeltaClip(t *testing.T) {
+	for seed := 0; seed < testIterations; seed++ {
+		r := rand.New(rand.NewSource(int64(seed)))
+		document := testRandomDocument(r)
+		delta := testRandomDelta(r, document.Len())
+		from := uint32(r.Intn(int(document.Len()) + 1))
+		to := from + uint32(r.Intn(int(document.Len()-from)+1))
+		clipped, _ := DeltaClip(delta, from, to)
+		result := testChars(testApply(t, seed, clipped, document))
+		chars := testChars(document)
+		offset := DeltaTransformPosition(clipped, from, false)
+		if int(offset)+int(to-from) > len(result) || !reflect.DeepEqual(result[offset:offset+to-from], chars[from:to]) {
+			t.Fatalf("seed %d: range %d..%d was changed", seed, from, to)
+		}
+	}
+	retain := &PMeta{}
+	delta := DeltaAddInsert(DeltaAddRetain(nil, 2, retain), []rune("x"), retain, false)
+	delta = DeltaAddRetain(DeltaAddDelete(delta, 2), 1, retain)
+	document := testDocument("abcde", retain)
+	if clipped, ok := DeltaClip(delta, 0, 2); ok || string(testApply(t, 0, clipped, document).Text()) != "abxe" {
+		t.Fatalf("insert at the bound was clipped: %+v", clipped)
+	}
+	if clipped, ok := DeltaClip(delta, 1, 5); !ok || !DeltaIsNoop(clipped) {
+		t.Fatalf("edits inside the range were kept: %+v", clipped)
+	}
+}
+
+func TestDeltaOffsetFromUtf16(t *testing.T) {
+	document := testDocument("a😀b", &PMeta{Changemask: 32, User: testUsers[0]})
+	for _, c := range []struct {
+		units uint32
+		runes uint32
+		ok    bool
+	}{{0, 0, true}, {1, 1, true}, {2, 0, false}, {3, 2, true}, {4, 3, true}, {5, 0, false}} {
+		runes, ok := DeltaOffsetFromUtf16(c.units, document)
+		if ok != c.ok || ok && runes != c.runes {
+			t.Fatalf("offset %d converted to %d %v", c.units, runes, ok)
+		}
+	}
+}
+
+func benchDocument(size int) *Rope {
+	text := make([]rune, size)
+	for i := range text {
+		text[i] = 'a' + rune(i%26)
+		if i%80 == 79 {
+			text[i] = '\n'
+		}
+	}
+	return testDocument(string(text), &PMeta{Changemask: 32, User: testUsers[0]})
+}
+
+func benchTyping(r *rand.Rand, length uint32, user *User) []POp {
+	pos := uint32(r.Intn(int(length)))
+	delta := DeltaAddRetain(nil, pos, &PMeta{})
+	delta = DeltaAddInsert(delta, []rune("x"), &PMeta{Changemask: 32, User: user}, false)
+	return DeltaAddRetain(delta, length-pos, &PMeta{})
+}
+
+func BenchmarkDeltaApplyTyping(b *testing.B) {
+	r := rand.New(rand.NewSource(1))
+	document := benchDocument(100000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		document = DeltaApply(benchTyping(r, document.Len(), testUsers[i%2]), document)
+	}
+}
+
+func BenchmarkDeltaTransform(b *testing.B) {
+	r := rand.New(rand.NewSource(1))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		DeltaTransform(benchTyping(r, 100000, testUsers[0]), benchTyping(r, 100000, testUsers[1]))
+	}
+}
+
+func BenchmarkDeltaInvert(b *testing.B) {
+	r := rand.New(rand.NewSource(1))
+	document := benchDocument(100000)
+	for i := 0; i < 1000; i++ {
+		document = DeltaApply(benchTyping(r, document.Len(), testUsers[i%2]), document)
+	}
+	delta := DeltaAddRetain(nil, 1000, &PMeta{})
+	delta = DeltaAddDelete(delta, 50000)
+	delta = DeltaAddRetain(delta, document.Len()-51000, &PMeta{Changemask: 1, Bold: true})
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		DeltaInvert(delta, document)
+	}
+}
+
+// BenchmarkDeltaRevisionMemory reports the heap kept alive by every revision
+// of a 100 KB document edited by two users typing at random places.
+func BenchmarkDeltaRevisionMemory(b *testing.B) {
+	r := rand.New(rand.NewSource(1))
+	document := benchDocument(100000)
+	revisions := make([]*Rope, 0, b.N)
+	runtime.GC()
+	before := runtime.MemStats{}
+	runtime.ReadMemStats(&before)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		document = DeltaApply(benchTyping(r, document.Len(), testUsers[i%2]), document)
+		revisions = append(revisions, document)
+	}
+	b.StopTimer()
+	runtime.GC()
+	after := runtime.MemStats{}
+	runtime.ReadMemStats(&after)
+	b.ReportMetric(float64(int64(after.HeapAlloc)-int64(before.HeapAlloc))/float64(b.N), "heap-B/rev")
+	runtime.KeepAlive(revisions)
+}
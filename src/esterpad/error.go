@@ -0,0 +1,126 @@
+/*
+Esterpad online collaborative editor
+Copyright (C) 2017 Anon2Anon
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package esterpad
+
+import (
+	. "esterpad_utils"
+	"reflect"
+	"strings"
+)
+
+// Error codes of SError, they are part of the protocol and never change.
+const (
+	ERROR_WRONG_CREDENTIALS = 1
+	ERROR_EMAIL_EXISTS      = 2
+	ERROR_INTERNAL          = 3
+	ERROR_INVALID_SESSION   = 4
+	ERROR_RATE_LIMITED      = 5
+	ERROR_BANNED            = 6
+	ERROR_NOT_LOGGED_IN     = 7
+	ERROR_NOT_IN_PAD        = 8
+	ERROR_PERMISSION_DENIED = 9
+	ERROR_INVALID_PAD_NAME  = 10
+	ERROR_NOT_FOUND         = 11
+	ERROR_INVALID_REQUEST   = 12
+	ERROR_TOO_LARGE         = 13
+	ERROR_NOTHING_TO_DO     = 14
+	ERROR_INCOMPATIBLE      = 15
+)
+
+var errorMessages = map[uint32]string{
+	ERROR_WRONG_CREDENTIALS: "invalid email or password",
+	ERROR_EMAIL_EXISTS:      "user with this email already exists",
+	ERROR_INTERNAL:          "internal error",
+	ERROR_INVALID_SESSION:   "session is invalid",
+	ERROR_RATE_LIMITED:      "too many requests",
+	ERROR_BANNED:            "you are banned",
+	ERROR_NOT_LOGGED_IN:     "you are not logged in",
+	ERROR_NOT_IN_PAD:        "you are not in a pad",
+	ERROR_PERMISSION_DENIED: "permission denied",
+	ERROR_INVALID_PAD_NAME:  "invalid pad name",
+	ERROR_NOT_FOUND:         "not found",
+	ERROR_INVALID_REQUEST:   "invalid request",
+	ERROR_TOO_LARGE:         "request is too large",
+	ERROR_NOTHING_TO_DO:     "nothing to do",
+	ERROR_INCOMPATIBLE:      "client is incompatible",
+}
+
+// requestName returns the name of a client message like "EnterPad".
+func requestName(m *CMessage) string {
+	if m.CMessage == nil {
+		return ""
+	}
+	return strings.TrimPrefix(reflect.TypeOf(m.CMessage).Elem().Name(), "CMessage_")
+}
+
+// SendError reports failure of the request Process is handling, an empty
+// message is replaced with the default one of code.
+func (c *Client) SendError(code uint32, message string) {
+	if len(message) == 0 {
+		message = errorMessages[code]
+	}
+	clientLogger.Log(LOG_INFO, c.UserId, "request error", c.requestSeq, c.request, code, message)
+	c.requestAnswered = true
+	c.Messages <- &SError{code, message, c.requestSeq, c.request}
+}
+
+// SendDeltaDropped reports a dropped delta, the client reverts it.
+func (c *Client) SendDeltaDropped(revision uint32, reason string) {
+	c.requestAnswered = true
+	c.Messages <- &SDeltaDropped{revision, reason}
+}
+
+// SendAck acknowledges the request Process is handling, revision is the one
+// stored for a delta of the client, it comes before the delta itself.
+func (c *Client) SendAck(revision uint32) {
+	c.requestAnswered = true
+	c.Messages <- &SAck{c.requestSeq, revision}
+}
+
+// CheckUser reports an error unless the client is logged in and has one of
+// perms, zero perms allow any user.
+func (c *Client) CheckUser(perms uint32) bool {
+	if c.User == nil {
+		c.SendError(ERROR_NOT_LOGGED_IN, "")
+		return false
+	}
+	return c.CheckPerms(c.User.Perms, perms)
+}
+
+// CheckPad reports an error unless the client is in a pad and has one of
+// perms there, zero perms allow anyone in the pad.
+func (c *Client) CheckPad(perms uint32) bool {
+	if c.User == nil {
+		c.SendError(ERROR_NOT_LOGGED_IN, "")
+		return false
+	}
+	if c.Pad == nil {
+		c.SendError(ERROR_NOT_IN_PAD, "")
+		return false
+	}
+	return perms == 0 || c.CheckPerms(c.PadPerms(), perms)
+}
+
+func (c *Client) CheckPerms(userPerms uint32, perms uint32) bool {
+	if perms != 0 && userPerms&perms == 0 {
+		c.SendError(ERROR_PERMISSION_DENIED, "")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,65 @@
+/*
+Esterpad online collaborative editor
+Copyright (C) 2017 Anon2Anon
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package esterpad
+
+import (
+	. "esterpad_utils"
+	"fmt"
+)
+
+// Protocol versions the server speaks, clients send theirs in CHello which
+// must be the first request of a connection.
+const (
+	PROTOCOL_VERSION     = 1
+	PROTOCOL_MIN_VERSION = 1
+)
+
+// Capabilities are optional features enabled per connection if both the
+// client and the server support them.
+const (
+	CAP_PRESENCE    = 1
+	CAP_ACKS        = 2
+	CAP_COMPRESSION = 4
+	CAP_COALESCE    = 8
+)
+
+var serverCapabilities uint32 = CAP_PRESENCE | CAP_ACKS | CAP_COMPRESSION | CAP_COALESCE
+
+// defaultCapabilities are enabled for every client since older clients rely
+// on them without asking.
+var defaultCapabilities uint32 = CAP_PRESENCE
+
+// Hello negotiates the protocol with the client, it returns the reason to
+// reject an incompatible client or an empty string.
+func (c *Client) Hello(message *CHello) string {
+	if message.Version < PROTOCOL_MIN_VERSION || message.Version > PROTOCOL_VERSION {
+		return fmt.Sprintf("protocol version %d is not supported, server supports versions %d to %d",
+			message.Version, PROTOCOL_MIN_VERSION, PROTOCOL_VERSION)
+	}
+	c.Version = message.Version
+	c.Capabilities = (message.Capabilities | defaultCapabilities) & serverCapabilities
+	clientLogger.Log(LOG_INFO, c.UserId, "hello", message.Version, message.Capabilities, message.Client)
+	c.Messages <- &SHello{PROTOCOL_VERSION, PROTOCOL_MIN_VERSION, c.Capabilities}
+	return ""
+}
+
+// HasCapability returns whether capability is enabled for the connection.
+func (c *Client) HasCapability(capability uint32) bool {
+	return c.Capabilities&capability != 0
+}
@@ -20,14 +20,19 @@ package esterpad
 
 import (
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"html"
 	"net/http"
 	"os"
+	"path"
 	"runtime"
+	"strconv"
 	"strings"
 )
 
+const httpSessionHeader = "X-Esterpad-Session"
+
 type staticHanlderStruct struct {
 	root http.Dir
 }
@@ -54,13 +59,8 @@ func (this *staticHanlderStruct) ServeHTTP(w http.ResponseWriter, r *http.Reques
 
 	url := r.URL.Path
 	isStaticFile := false
-	for i, c := range url {
-		if c != '/' {
-			if !strings.HasPrefix(url[i:], ".") && strings.Contains(url[i:], ".") {
-				isStaticFile = true
-			}
-			break
-		}
+	if trimmed := strings.TrimLeft(url, "/"); !strings.HasPrefix(trimmed, ".") {
+		isStaticFile = strings.Contains(path.Base(trimmed), ".")
 	}
 
 	if !isStaticFile {
@@ -129,6 +129,7 @@ len(GlobalClientList): %d<br/>
 	}
 	PadMutex.RUnlock()
 	for _, p := range padMapCopy {
+		name := p.GetName()
 		p.ClientsMutex.RLock()
 		p.ChatMutex.RLock()
 		p.DeltaMutex.RLock()
@@ -140,7 +141,7 @@ len(GlobalClientList): %d<br/>
     len(DocumentArray): %d<br/>
     <table border="1">
     <tr><th>Id</th><th>UserId</th><th>Nickname</th><th>SessId</th><th>Color</th><th>len(messages)</th></tr>
-		`, p.Id, html.EscapeString(p.Name), len(p.CacherChannel),
+		`, p.Id, html.EscapeString(name), len(p.CacherChannel),
 			p.Clients.Len(), len(p.ChatArray), len(p.DeltaArray), len(p.DocumentArray))
 		p.DeltaMutex.RUnlock()
 		p.ChatMutex.RUnlock()
@@ -165,11 +166,53 @@ func HttpClearAll(w http.ResponseWriter, r *http.Request) {
 	CacherClearAll()
 }
 
+// httpSession returns the session given by the X-Esterpad-Session header
+// or the "sessid" cookie or nil. Session ids are never taken from the URL,
+// where they would leak into logs and referrers.
+func httpSession(r *http.Request) *SessionInfo {
+	sessIdHex := r.Header.Get(httpSessionHeader)
+	if cookie, err := r.Cookie("sessid"); len(sessIdHex) == 0 && err == nil {
+		sessIdHex = cookie.Value
+	}
+	sessIdSlice, err := hex.DecodeString(sessIdHex)
+	if err != nil || len(sessIdSlice) != 16 {
+		return nil
+	}
+	sessId := [16]byte{}
+	copy(sessId[:], sessIdSlice)
+	ClientSessionsMutex.RLock()
+	sessInfo := ClientSessions[sessId]
+	ClientSessionsMutex.RUnlock()
+	return sessInfo
+}
+
+func HttpSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "405 Method not allowed", 405)
+		return
+	}
+	sessInfo := httpSession(r)
+	if sessInfo == nil {
+		http.Error(w, "403 Forbidden", http.StatusForbidden)
+		return
+	}
+	count, _ := strconv.ParseUint(r.FormValue("count"), 10, 32)
+	chat, _ := strconv.ParseBool(r.FormValue("chat"))
+	results := Search(sessInfo.User, r.FormValue("q"), uint32(count), chat)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(results); err != nil {
+		searchLogger.Log(LOG_ERROR, "json encode err", err)
+	}
+}
+
 func HttpInit() {
 	httpLogger := LogInit("http")
 	http.Handle("/", staticHanlder(http.Dir("frontend/dist")))
 	http.HandleFunc("/.clearall", HttpClearAll)
 	http.HandleFunc("/.stat", HttpStat)
+	http.HandleFunc("/.search", HttpSearch)
+	http.HandleFunc("/.upload", HttpUpload)
+	http.HandleFunc(uploadPrefix, HttpUploaded)
 	http.HandleFunc("/.ws", WsHandler)
 	httpListen := Config["http"]["listen"].(string)
 	httpLogger.Log(LOG_INFO, "Listening on", httpListen)
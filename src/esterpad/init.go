@@ -21,6 +21,8 @@ package esterpad
 import "runtime/debug"
 
 func Start() {
+	ConfigRead("config.json")
+	LogOpen()
 	initLogger := LogInit("init")
 	defer func() {
 		if err := recover(); err != nil {
@@ -29,5 +31,9 @@ func Start() {
 	}()
 	MongoInit()
 	CacherInit()
+	SearchInit()
+	UploadInit()
+	LimitsInit()
+	RateInit()
 	HttpInit()
 }
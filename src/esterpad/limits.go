@@ -0,0 +1,53 @@
+/*
+Esterpad online collaborative editor
+Copyright (C) 2017 Anon2Anon
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package esterpad
+
+import (
+	"strconv"
+)
+
+// Limits of client input, lengths are counted in characters.
+var (
+	limitsLogger        = LogInit("limits")
+	limitDocumentLength = 1024 * 1024
+	limitDeltaOps       = 10000
+	limitDeltaInsert    = 256 * 1024
+	limitChatLength     = 4096
+	limitMessageSize    = 8 * 1024 * 1024
+)
+
+func LimitsInit() {
+	for key, limit := range map[string]*int{
+		"document-length": &limitDocumentLength,
+		"delta-ops":       &limitDeltaOps,
+		"delta-insert":    &limitDeltaInsert,
+		"chat-length":     &limitChatLength,
+		"message-size":    &limitMessageSize,
+	} {
+		value, ok := Config["limits"][key].(string)
+		if !ok {
+			continue
+		}
+		if n, err := strconv.Atoi(value); err == nil && n > 0 {
+			*limit = n
+		} else {
+			limitsLogger.Log(LOG_ERROR, "invalid limit", key, value, err)
+		}
+	}
+}
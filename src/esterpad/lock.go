@@ -0,0 +1,180 @@
+/*
+Esterpad online collaborative editor
+Copyright (C) 2017 Anon2Anon
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package esterpad
+
+import (
+	. "esterpad_utils"
+)
+
+const deltaLockedReason = "delta edits a locked section"
+
+// PLock makes range From..To of document Revision read-only for everyone
+// but the user who set it and moderators. Locks broadcast to clients are
+// copies, the pad ones are guarded by DeltaMutex.
+type PLock struct {
+	Id       uint32
+	User     *User
+	Revision uint32
+	From     uint32
+	To       uint32
+	Removed  bool
+}
+
+func (p *Pad) LockLoad() {
+	lockIter := p.LockCollection.Find(nil).Sort("_id").Iter()
+	lock := MongoLock{}
+	for lockIter.Next(&lock) {
+		for i := uint32(len(p.LockArray)) + 1; i < lock.Id; i++ {
+			p.LockArray = append(p.LockArray, &PLock{Id: i, Removed: true})
+		}
+		plock := &PLock{lock.Id, CacherGetUser(lock.UserId), lock.Revision, lock.From, lock.To, lock.Removed}
+		if plock.Revision > p.DeltaCounter {
+			plock.Revision, plock.From, plock.To = p.DeltaCounter, 0, 0
+		}
+		p.LockArray = append(p.LockArray, plock)
+	}
+	if err := lockIter.Close(); err != nil {
+		padLogger.Log(LOG_ERROR, p.Id, "mongo find err", err)
+	}
+}
+
+// lockAnchor transforms the range of lock through revisions made since it
+// was set. DeltaMutex should be locked.
+func (p *Pad) lockAnchor(lock *PLock) {
+	lock.Revision, lock.From, lock.To = p.transformRange(lock.Revision, lock.From, lock.To)
+}
+
+func (p *Pad) CreateLock(c *Client, message *CLockCreate) {
+	padLogger.Log(LOG_INFO, p.Id, c.UserId, "process create lock message", message.Revision, message.From, message.To)
+	from, to := message.From, message.To
+	p.DeltaMutex.Lock()
+	if message.Revision > p.DeltaCounter {
+		p.DeltaMutex.Unlock()
+		c.SendError(ERROR_NOT_FOUND, "no such revision")
+		return
+	}
+	document := p.DocumentArray[message.Revision].Rope
+	if c.OffsetUnit == OFFSET_UNIT_UTF16 {
+		var okFrom, okTo bool
+		from, okFrom = DeltaOffsetFromUtf16(from, document)
+		to, okTo = DeltaOffsetFromUtf16(to, document)
+		if !okFrom || !okTo {
+			p.DeltaMutex.Unlock()
+			c.SendError(ERROR_INVALID_REQUEST, "range splits a surrogate pair or is out of the document")
+			return
+		}
+	}
+	if from >= to || to > document.Len() {
+		p.DeltaMutex.Unlock()
+		c.SendError(ERROR_INVALID_REQUEST, "range is empty or out of the document")
+		return
+	}
+	lock := &PLock{uint32(len(p.LockArray)) + 1, c.User, message.Revision, from, to, false}
+	p.LockArray = append(p.LockArray, lock)
+	p.lockAnchor(lock)
+	copied := *lock
+	p.CacherChannel <- &copied
+	p.DeltaMutex.Unlock()
+	p.broadcastLock(&copied)
+}
+
+// RemoveLock removes a lock, this is allowed to the user who set it and to
+// moderators.
+func (p *Pad) RemoveLock(c *Client, message *CLockRemove) {
+	padLogger.Log(LOG_INFO, p.Id, c.UserId, "process remove lock message", message.LockId)
+	isMod := c.PadPerms()&PERM_MOD != 0
+	p.DeltaMutex.Lock()
+	if message.LockId == 0 || message.LockId > uint32(len(p.LockArray)) || p.LockArray[message.LockId-1].Removed {
+		p.DeltaMutex.Unlock()
+		c.SendError(ERROR_NOT_FOUND, "no such lock")
+		return
+	}
+	lock := p.LockArray[message.LockId-1]
+	if !isMod && lock.User != c.User {
+		p.DeltaMutex.Unlock()
+		c.SendError(ERROR_PERMISSION_DENIED, "only the owner of a lock may remove it")
+		return
+	}
+	lock.Removed = true
+	p.lockAnchor(lock)
+	copied := *lock
+	p.CacherChannel <- &copied
+	p.DeltaMutex.Unlock()
+	p.broadcastLock(&copied)
+}
+
+// lockClip drops the parts of opsList based on the last revision which edit
+// sections locked by other users. DeltaMutex should be locked.
+func (p *Pad) lockClip(c *Client, opsList []POp) ([]POp, bool) {
+	locked := false
+	for _, lock := range p.LockArray {
+		if lock.Removed || lock.User == c.User {
+			continue
+		}
+		p.lockAnchor(lock)
+		clipped := false
+		opsList, clipped = DeltaClip(opsList, lock.From, lock.To)
+		locked = locked || clipped
+	}
+	return opsList, locked
+}
+
+func (p *Pad) broadcastLock(lock *PLock) {
+	p.ClientsMutex.RLock()
+	for clientIter := p.Clients.Front(); clientIter != nil; clientIter = clientIter.Next() {
+		neighbor := clientIter.Value.(*Client)
+		select {
+		case neighbor.Messages <- lock:
+		default:
+		}
+	}
+	p.ClientsMutex.RUnlock()
+}
+
+// CopyLocks returns copies of active locks anchored to the last revision.
+func (p *Pad) CopyLocks() []*PLock {
+	ret := []*PLock{}
+	p.DeltaMutex.Lock()
+	for _, lock := range p.LockArray {
+		if !lock.Removed {
+			p.lockAnchor(lock)
+			copied := *lock
+			ret = append(ret, &copied)
+		}
+	}
+	p.DeltaMutex.Unlock()
+	return ret
+}
+
+func (c *Client) AddLock(buffer []*SMessage, lock *PLock) []*SMessage {
+	smessage := &SLock{lock.Id, 0, lock.Revision, lock.From, lock.To, lock.Removed}
+	if c.pc.OffsetUnit == OFFSET_UNIT_UTF16 {
+		if document := c.Pad.CopyDocumentRevision(lock.Revision); document != nil {
+			smessage.From = DeltaOffsetToUtf16(lock.From, document.Rope)
+			smessage.To = DeltaOffsetToUtf16(lock.To, document.Rope)
+		}
+	}
+	if lock.User != nil {
+		buffer = c.AddUserInfo(buffer, lock.User)
+		smessage.UserId = lock.User.Id
+	}
+	clientLogger.Log(LOG_INFO, c.UserId, "send lock message", smessage.Id, smessage.Revision)
+	SMessageOneOf := &SMessage_Lock{smessage}
+	return append(buffer, &SMessage{SMessageOneOf})
+}
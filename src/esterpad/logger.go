@@ -32,23 +32,39 @@ const LOG_ERROR = 3
 const LOG_FATAL = 4
 
 type Log struct {
+	name     string
 	logFile  *os.File
 	logLevel int
 }
 
-func LogInit(name string) Log {
+// Loggers created before the config is read, LogOpen opens their files.
+var logPending = []*Log{}
+
+func LogInit(name string) *Log {
+	l := &Log{name: name, logLevel: LOG_WARNING}
 	if Config == nil {
-		ConfigRead("config.json")
+		logPending = append(logPending, l)
+	} else {
+		l.open()
 	}
-	l := Log{}
+	return l
+}
 
-	logFile_local, err := os.OpenFile(Config["log"]["directory"].(string)+"/"+name+".log", os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0660)
+func (l *Log) open() {
+	logFile_local, err := os.OpenFile(Config["log"]["directory"].(string)+"/"+l.name+".log", os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0660)
 	if err != nil {
 		log.Fatal("log file open", err)
 	}
 	l.logLevel = int(Config["log"]["level"].(float64))
 	l.logFile = logFile_local
-	return l
+}
+
+// LogOpen opens files of loggers created before the config was read.
+func LogOpen() {
+	for _, l := range logPending {
+		l.open()
+	}
+	logPending = nil
 }
 
 func (l Log) Logf(level int, format string, v ...interface{}) {
@@ -57,9 +73,10 @@ func (l Log) Logf(level int, format string, v ...interface{}) {
 		str := t.Format("2006/01/02 15:04:05") + " " + fmt.Sprintf(format, v...) + "\n"
 
 		os.Stderr.WriteString(str)
-		_, err := l.logFile.WriteString(str)
-		if err != nil {
-			log.Fatal("Log file write", err)
+		if l.logFile != nil {
+			if _, err := l.logFile.WriteString(str); err != nil {
+				log.Fatal("Log file write", err)
+			}
 		}
 	}
 	if level == LOG_FATAL {
@@ -73,9 +90,10 @@ func (l Log) Log(level int, v ...interface{}) {
 		str := t.Format("2006/01/02 15:04:05") + " " + fmt.Sprintln(v...)
 		os.Stderr.WriteString(str)
 
-		_, err := l.logFile.WriteString(str)
-		if err != nil {
-			log.Fatal("Log file write", err)
+		if l.logFile != nil {
+			if _, err := l.logFile.WriteString(str); err != nil {
+				log.Fatal("Log file write", err)
+			}
 		}
 	}
 	if level == LOG_FATAL {
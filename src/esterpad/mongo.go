@@ -22,13 +22,17 @@ import (
 	"golang.org/x/crypto/bcrypt"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
+	"time"
 )
 
 var (
-	mongoLogger     = LogInit("mongo")
-	MongoConnection *mgo.Session
-	UserCollection  *mgo.Collection
-	PadCollection   *mgo.Collection
+	mongoLogger      = LogInit("mongo")
+	MongoConnection  *mgo.Session
+	UserCollection   *mgo.Collection
+	PadCollection    *mgo.Collection
+	FolderCollection *mgo.Collection
+	ShareCollection  *mgo.Collection
+	BanCollection    *mgo.Collection
 )
 
 type MongoChat struct {
@@ -41,6 +45,8 @@ type MongoDelta struct {
 	Id     uint32 `bson:"_id,omitempty"`
 	UserId uint32
 	Ops    []*MongoDeltaOp
+	Time   time.Time `bson:",omitempty"`
+	Undo   uint8     `bson:",omitempty"`
 }
 
 type MongoDeltaOp struct {
@@ -48,29 +54,91 @@ type MongoDeltaOp struct {
 	Delete *uint32     `bson:",omitempty"`
 	Retain *uint32     `bson:",omitempty"`
 	Meta   *PMeta      `bson:",omitempty"`
+	Embed  *PEmbed     `bson:",omitempty"`
+}
+
+type MongoThread struct {
+	Id       uint32 `bson:"_id"`
+	Revision uint32
+	From     uint32
+	To       uint32
+	Resolved bool
+	Comments []*MongoComment
+}
+
+type MongoLock struct {
+	Id       uint32 `bson:"_id"`
+	UserId   uint32
+	Revision uint32
+	From     uint32
+	To       uint32
+	Removed  bool
+}
+
+type MongoComment struct {
+	Id     uint32
+	UserId uint32
+	Text   string
+	Time   time.Time
 }
 
 type MongoOpMeta struct {
-	Bold      interface{} `bson:",omitempty"`
-	Italic    interface{} `bson:",omitempty"`
-	Underline interface{} `bson:",omitempty"`
-	Strike    interface{} `bson:",omitempty"`
-	FontSize  interface{} `bson:",omitempty"`
-	UserId    interface{} `bson:",omitempty"`
+	Bold          interface{} `bson:",omitempty"`
+	Italic        interface{} `bson:",omitempty"`
+	Underline     interface{} `bson:",omitempty"`
+	Strike        interface{} `bson:",omitempty"`
+	FontSize      interface{} `bson:",omitempty"`
+	UserId        interface{} `bson:",omitempty"`
+	Link          interface{} `bson:",omitempty"`
+	Color         interface{} `bson:",omitempty"`
+	Highlight     interface{} `bson:",omitempty"`
+	Code          interface{} `bson:",omitempty"`
+	Heading       interface{} `bson:",omitempty"`
+	List          interface{} `bson:",omitempty"`
+	Quote         interface{} `bson:",omitempty"`
+	CodeBlock     interface{} `bson:",omitempty"`
+	SuggestInsert interface{} `bson:",omitempty"`
+	SuggestDelete interface{} `bson:",omitempty"`
 }
 
 type MongoPad struct {
-	Id   uint32 `bson:"_id,omitempty"`
-	Name string
+	Id         uint32 `bson:"_id,omitempty"`
+	Name       string
+	CreateTime time.Time `bson:",omitempty"`
+	DeleteTime time.Time `bson:",omitempty"`
+	ReadOnly   bool      `bson:",omitempty"`
+	Private    bool      `bson:",omitempty"`
+}
+
+type MongoShare struct {
+	Token string `bson:"_id"`
+	PadId uint32
+	Write bool
+}
+
+type MongoBan struct {
+	Id         uint32    `bson:"_id"`
+	UserId     uint32    `bson:",omitempty"`
+	Ip         string    `bson:",omitempty"`
+	ExpireTime time.Time `bson:",omitempty"`
+	Reason     string    `bson:",omitempty"`
+	ModId      uint32
+}
+
+type MongoFolder struct {
+	Path  string `bson:"_id"`
+	Perms uint32
 }
 
 type MongoUser struct {
-	UserId   uint32
-	Email    string `bson:",omitempty"`
-	Passhash []byte `bson:",omitempty"`
-	Nickname string
-	Color    uint32
-	Perms    uint32
+	UserId    uint32
+	Email     string `bson:",omitempty"`
+	Passhash  []byte `bson:",omitempty"`
+	Nickname  string
+	Color     uint32
+	Perms     uint32
+	Recent    []uint32 `bson:",omitempty"`
+	Favorites []uint32 `bson:",omitempty"`
 }
 
 func (meta *PMeta) GetBSON() (interface{}, error) {
@@ -100,6 +168,44 @@ func (meta *PMeta) GetBSON() (interface{}, error) {
 			ret.UserId = 0
 		}
 	}
+	if meta.Changemask&64 != 0 {
+		ret.Link = meta.Link
+	}
+	if meta.Changemask&128 != 0 {
+		ret.Color = meta.Color
+	}
+	if meta.Changemask&256 != 0 {
+		ret.Highlight = meta.Highlight
+	}
+	if meta.Changemask&512 != 0 {
+		ret.Code = meta.Code
+	}
+	if meta.Changemask&1024 != 0 {
+		ret.Heading = meta.Heading
+	}
+	if meta.Changemask&2048 != 0 {
+		ret.List = meta.List
+	}
+	if meta.Changemask&4096 != 0 {
+		ret.Quote = meta.Quote
+	}
+	if meta.Changemask&8192 != 0 {
+		ret.CodeBlock = meta.CodeBlock
+	}
+	if meta.Changemask&32768 != 0 {
+		if meta.SuggestInsert != nil {
+			ret.SuggestInsert = meta.SuggestInsert.Id
+		} else {
+			ret.SuggestInsert = 0
+		}
+	}
+	if meta.Changemask&65536 != 0 {
+		if meta.SuggestDelete != nil {
+			ret.SuggestDelete = meta.SuggestDelete.Id
+		} else {
+			ret.SuggestDelete = 0
+		}
+	}
 	return ret, nil
 }
 
@@ -136,6 +242,50 @@ func (meta *PMeta) SetBSON(raw bson.Raw) error {
 			meta.User = CacherGetUser(userId)
 		}
 	}
+	if decoded.Link != nil {
+		changemask |= 64
+		meta.Link = decoded.Link.(string)
+	}
+	if decoded.Color != nil {
+		changemask |= 128
+		meta.Color = uint32(decoded.Color.(int))
+	}
+	if decoded.Highlight != nil {
+		changemask |= 256
+		meta.Highlight = uint32(decoded.Highlight.(int))
+	}
+	if decoded.Code != nil {
+		changemask |= 512
+		meta.Code = decoded.Code.(bool)
+	}
+	if decoded.Heading != nil {
+		changemask |= 1024
+		meta.Heading = uint32(decoded.Heading.(int))
+	}
+	if decoded.List != nil {
+		changemask |= 2048
+		meta.List = uint32(decoded.List.(int))
+	}
+	if decoded.Quote != nil {
+		changemask |= 4096
+		meta.Quote = decoded.Quote.(bool)
+	}
+	if decoded.CodeBlock != nil {
+		changemask |= 8192
+		meta.CodeBlock = decoded.CodeBlock.(bool)
+	}
+	if decoded.SuggestInsert != nil {
+		changemask |= 32768
+		if userId := uint32(decoded.SuggestInsert.(int)); userId != 0 {
+			meta.SuggestInsert = CacherGetUser(userId)
+		}
+	}
+	if decoded.SuggestDelete != nil {
+		changemask |= 65536
+		if userId := uint32(decoded.SuggestDelete.(int)); userId != 0 {
+			meta.SuggestDelete = CacherGetUser(userId)
+		}
+	}
 	meta.Changemask = changemask
 	return nil
 }
@@ -166,6 +316,9 @@ func MongoInit() {
 		mongoLogger.Log(LOG_FATAL, "mongo set scheme err", err)
 	}
 	PadCollection = db.DB("").C("pad")
+	FolderCollection = db.DB("").C("folder")
+	ShareCollection = db.DB("").C("share")
+	BanCollection = db.DB("").C("ban")
 }
 
 func MongoLoginUser(email string, password string) interface{} {
@@ -274,9 +427,108 @@ func MongoChangePerms(userId uint32, perms uint32) {
 	}
 }
 
-func MongoInsertPad(id uint32, name string) {
-	change := MongoPad{Id: id, Name: name}
+func MongoChangeRecent(userId uint32, recent []uint32) {
+	query := bson.M{"userid": userId}
+	change := bson.M{"$set": bson.M{"recent": recent}}
+	err := UserCollection.Update(query, change)
+	if err != nil {
+		mongoLogger.Log(LOG_ERROR, "mongo change recent err", userId, err)
+	}
+}
+
+func MongoChangeFavorites(userId uint32, favorites []uint32) {
+	query := bson.M{"userid": userId}
+	change := bson.M{"$set": bson.M{"favorites": favorites}}
+	err := UserCollection.Update(query, change)
+	if err != nil {
+		mongoLogger.Log(LOG_ERROR, "mongo change favorites err", userId, err)
+	}
+}
+
+func MongoInsertPad(id uint32, name string, createTime time.Time) {
+	change := MongoPad{Id: id, Name: name, CreateTime: createTime}
 	if err := PadCollection.Insert(change); err != nil {
 		mongoLogger.Log(LOG_ERROR, "mongo insert err", err)
 	}
 }
+
+func MongoRenamePad(id uint32, name string) {
+	query := bson.M{"_id": id}
+	change := bson.M{"$set": bson.M{"name": name}}
+	if err := PadCollection.Update(query, change); err != nil {
+		mongoLogger.Log(LOG_ERROR, "mongo rename pad err", id, err)
+	}
+}
+
+func MongoDeletePad(id uint32, deleteTime time.Time) {
+	query := bson.M{"_id": id}
+	change := bson.M{"$set": bson.M{"deletetime": deleteTime}}
+	if err := PadCollection.Update(query, change); err != nil {
+		mongoLogger.Log(LOG_ERROR, "mongo delete pad err", id, err)
+	}
+}
+
+func MongoRestorePad(id uint32) {
+	query := bson.M{"_id": id}
+	change := bson.M{"$unset": bson.M{"deletetime": ""}}
+	if err := PadCollection.Update(query, change); err != nil {
+		mongoLogger.Log(LOG_ERROR, "mongo restore pad err", id, err)
+	}
+}
+
+func MongoSetPadFlags(id uint32, readOnly bool, private bool) {
+	query := bson.M{"_id": id}
+	change := bson.M{"$set": bson.M{"readonly": readOnly, "private": private}}
+	if err := PadCollection.Update(query, change); err != nil {
+		mongoLogger.Log(LOG_ERROR, "mongo set pad flags err", id, err)
+	}
+}
+
+func MongoPurgePad(id uint32) {
+	if err := PadCollection.RemoveId(id); err != nil {
+		mongoLogger.Log(LOG_ERROR, "mongo purge pad err", id, err)
+	}
+	if _, err := ShareCollection.RemoveAll(bson.M{"padid": id}); err != nil {
+		mongoLogger.Log(LOG_ERROR, "mongo purge pad shares err", id, err)
+	}
+}
+
+func MongoInsertShare(share *PShare) {
+	if err := ShareCollection.Insert(MongoShare{share.Token, share.PadId, share.Write}); err != nil {
+		mongoLogger.Log(LOG_ERROR, "mongo insert err", err)
+	}
+}
+
+func MongoRemoveShare(token string) {
+	if err := ShareCollection.RemoveId(token); err != nil {
+		mongoLogger.Log(LOG_ERROR, "mongo remove share err", err)
+	}
+}
+
+func MongoInsertBan(ban *PBan) {
+	insert := MongoBan{ban.Id, ban.UserId, "", ban.ExpireTime, ban.Reason, ban.ModId}
+	if ban.Net != nil {
+		insert.Ip = ban.Net.String()
+	}
+	if err := BanCollection.Insert(insert); err != nil {
+		mongoLogger.Log(LOG_ERROR, "mongo insert ban err", err)
+	}
+}
+
+func MongoRemoveBan(id uint32) {
+	if err := BanCollection.RemoveId(id); err != nil {
+		mongoLogger.Log(LOG_ERROR, "mongo remove ban err", id, err)
+	}
+}
+
+func MongoSetFolderPerms(path string, perms uint32) {
+	if _, err := FolderCollection.UpsertId(path, MongoFolder{path, perms}); err != nil {
+		mongoLogger.Log(LOG_ERROR, "mongo set folder perms err", path, err)
+	}
+}
+
+func MongoResetFolderPerms(path string) {
+	if err := FolderCollection.RemoveId(path); err != nil {
+		mongoLogger.Log(LOG_ERROR, "mongo reset folder perms err", path, err)
+	}
+}
@@ -21,15 +21,25 @@ package esterpad
 import (
 	"container/list"
 	. "esterpad_utils"
+	"fmt"
 	"gopkg.in/mgo.v2"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	deltaRejectedReason = "no permission to delete or format text of other users"
+	deltaSuggestReason  = "delta is stored as a suggestion"
+	padReadOnlyReason   = "pad is read-only"
+	undoStackSize       = 100
 )
 
 var (
 	padLogger       = LogInit("pad")
-	DefaultDocument = list.New()
+	DefaultDocument = &Rope{}
 )
 
 type PChat struct {
@@ -38,32 +48,57 @@ type PChat struct {
 	Text string
 }
 
+type PPurge struct {
+}
+
+// PPadState asks clients to resend flags and perms of the pad.
+type PPadState struct {
+}
+
 type PDelta struct {
 	Id     uint32
 	UserId uint32
-	Ops    *list.List
+	Ops    []POp
+	Undo   uint8
+}
+
+const (
+	DELTA_EDIT = 0
+	DELTA_UNDO = 1
+	DELTA_REDO = 2
+)
+
+// PUndoStack holds revisions of a user which can be undone, and revisions
+// of undos which can be redone.
+type PUndoStack struct {
+	Undo []uint32
+	Redo []uint32
 }
 
 type PDocument struct {
 	Revision uint32
-	Ops      *list.List
+	Rope     *Rope
 }
 
-type POpInsert struct {
+const (
+	OP_INSERT = 0
+	OP_DELETE = 1
+	OP_RETAIN = 2
+)
+
+// POp is a single delta operation. Text is set for inserts only, Meta for
+// inserts and retains. TextRO marks text shared with other ops or documents.
+type POp struct {
+	Type   uint8
+	TextRO bool
+	Len    uint32
 	Text   []rune
 	Meta   *PMeta
-	TextRO bool
-}
-
-type POpDelete struct {
-	Len uint32
-}
-
-type POpRetain struct {
-	Len  uint32
-	Meta *PMeta
 }
 
+// PMeta holds text attributes, Changemask tells which of them are set. Line
+// attributes (Heading, List, Quote, CodeBlock) are carried by the newline
+// ending the line.
 type PMeta struct {
 	Changemask uint32
 	Bold       bool
@@ -73,31 +108,72 @@ type PMeta struct {
 	FontSize   uint32
 	UserId     uint32
 	User       *User
+	Link       string
+	Color      uint32
+	Highlight  uint32
+	Code       bool
+	Heading    uint32
+	List       uint32
+	Quote      bool
+	CodeBlock  bool
+	Embed      *PEmbed
+	// SuggestInsert and SuggestDelete are users who suggested to insert or
+	// to delete the text, it stays in the document until resolved.
+	SuggestInsert *User
+	SuggestDelete *User
+}
+
+const (
+	EMBED_IMAGE    = 1
+	EMBED_FILE     = 2
+	EMBED_CHECKBOX = 3
+)
+
+// PEmbed is an object taking a single EmbedRune in the document, its meta
+// has META_EMBED set.
+type PEmbed struct {
+	Type    uint32
+	Ref     string `bson:",omitempty"`
+	Name    string `bson:",omitempty"`
+	Checked bool   `bson:",omitempty"`
 }
 
 type Pad struct {
-	Id              uint32
-	Name            string
-	CacherChannel   chan interface{}
-	Clients         *list.List
-	ClientsMutex    sync.RWMutex
-	ChatCounter     uint32
-	ChatArray       []*PChat
-	ChatMutex       sync.RWMutex
-	DeltaArray      []*PDelta
-	DocumentArray   []*PDocument
-	DeltaCounter    uint32
-	DeltaMutex      sync.RWMutex
-	ChatCollection  *mgo.Collection
-	DeltaCollection *mgo.Collection
+	Id               uint32
+	Name             string
+	CacherChannel    chan interface{}
+	Clients          *list.List
+	ClientsMutex     sync.RWMutex
+	ChatCounter      uint32
+	ChatArray        []*PChat
+	ChatMutex        sync.RWMutex
+	DeltaArray       []*PDelta
+	DocumentArray    []*PDocument
+	DeltaCounter     uint32
+	UndoStacks       map[uint32]*PUndoStack
+	DeltaMutex       sync.RWMutex
+	LockArray        []*PLock
+	ThreadArray      []*PThread
+	ThreadMutex      sync.Mutex
+	ChatCollection   *mgo.Collection
+	DeltaCollection  *mgo.Collection
+	ThreadCollection *mgo.Collection
+	LockCollection   *mgo.Collection
+	CreateTime       time.Time
+	EditTime         time.Time
+	DeleteTime       time.Time
+	ReadOnly         bool
+	Private          bool
 }
 
 func PadLoad(id uint32, name string) *Pad {
 	p := Pad{Id: id, Name: name, CacherChannel: make(chan interface{}, 200), Clients: list.New(),
 		ClientsMutex: sync.RWMutex{}, ChatMutex: sync.RWMutex{}, DeltaMutex: sync.RWMutex{},
-		DocumentArray: []*PDocument{&PDocument{Ops: DefaultDocument}}}
+		DocumentArray: []*PDocument{&PDocument{Rope: DefaultDocument}}, UndoStacks: map[uint32]*PUndoStack{}}
 	p.ChatCollection = MongoConnection.DB("").C("chat" + strconv.FormatInt(int64(p.Id), 10))
 	p.DeltaCollection = MongoConnection.DB("").C("delta" + strconv.FormatInt(int64(p.Id), 10))
+	p.ThreadCollection = MongoConnection.DB("").C("thread" + strconv.FormatInt(int64(p.Id), 10))
+	p.LockCollection = MongoConnection.DB("").C("lock" + strconv.FormatInt(int64(p.Id), 10))
 	chatIter := p.ChatCollection.Find(nil).Sort("_id").Iter()
 	chat := MongoChat{}
 	for chatIter.Next(&chat) {
@@ -116,28 +192,42 @@ func PadLoad(id uint32, name string) *Pad {
 	oldDocument := DefaultDocument
 	for deltaIter.Next(&delta) {
 		for i := p.DeltaCounter + 1; i < delta.Id; i++ {
-			p.DeltaArray = append(p.DeltaArray, &PDelta{i, 0, list.New()})
+			p.DeltaArray = append(p.DeltaArray, &PDelta{i, 0, []POp{}, DELTA_EDIT})
 			p.DocumentArray = append(p.DocumentArray, &PDocument{i, oldDocument})
 		}
 		p.DeltaCounter = delta.Id
-		newOps := list.New()
+		if !delta.Time.IsZero() {
+			p.EditTime = delta.Time
+		}
+		newOps := make([]POp, 0, len(delta.Ops))
 		for _, op := range delta.Ops {
 			if op.Insert != nil {
-				newOps.PushBack(&POpInsert{[]rune(op.Insert.(string)), (*PMeta)(op.Meta), false})
+				meta := (*PMeta)(op.Meta)
+				if op.Embed != nil {
+					embedMeta := PMeta{}
+					if meta != nil {
+						embedMeta = *meta
+					}
+					embedMeta.Changemask |= META_EMBED
+					embedMeta.Embed = op.Embed
+					meta = &embedMeta
+				}
+				newOps = DeltaAddInsert(newOps, []rune(op.Insert.(string)), meta, false)
 			} else if op.Delete != nil {
-				newOps.PushBack(&POpDelete{*op.Delete})
+				newOps = DeltaAddDelete(newOps, *op.Delete)
 			} else if op.Retain != nil {
-				newOps.PushBack(&POpRetain{*op.Retain, (*PMeta)(op.Meta)})
+				newOps = DeltaAddRetain(newOps, *op.Retain, (*PMeta)(op.Meta))
 			}
 		}
-		newDocument := DeltaComposeOld(newOps, oldDocument)
+		newDocument := DeltaApply(newOps, oldDocument)
 		if newDocument == nil {
-			padLogger.Log(LOG_ERROR, p.Id, "can't compose delta on load", DeltaToString(newOps), DeltaToString(oldDocument))
-			p.DeltaArray = append(p.DeltaArray, &PDelta{delta.Id, 0, list.New()})
+			padLogger.Log(LOG_ERROR, p.Id, "can't compose delta on load", DeltaToString(newOps), DeltaToString(oldDocument.Ops()))
+			p.DeltaArray = append(p.DeltaArray, &PDelta{delta.Id, 0, []POp{}, DELTA_EDIT})
 			p.DocumentArray = append(p.DocumentArray, &PDocument{delta.Id, oldDocument})
 		} else {
-			pdelta := PDelta{delta.Id, delta.UserId, newOps}
+			pdelta := PDelta{delta.Id, delta.UserId, newOps, delta.Undo}
 			p.DeltaArray = append(p.DeltaArray, &pdelta)
+			p.UndoRecord(&pdelta)
 			p.DocumentArray = append(p.DocumentArray, &PDocument{delta.Id, newDocument})
 			oldDocument = newDocument
 		}
@@ -145,18 +235,25 @@ func PadLoad(id uint32, name string) *Pad {
 	if err := deltaIter.Close(); err != nil {
 		padLogger.Log(LOG_ERROR, p.Id, "mongo find err", err)
 	}
+	p.ThreadLoad()
+	p.LockLoad()
 
 	go p.CacherHandler()
 	return &p
 }
 
 func (p *Pad) CacherHandler() {
+	purged := false
 	for {
 		select {
 		case pmessage, ok := <-p.CacherChannel:
 			if !ok {
 				return
 			}
+			if purged {
+				// keep draining so late senders don't block on a full channel
+				continue
+			}
 			switch pmessage := pmessage.(type) {
 			case *PChat:
 				mongoMessage := &MongoChat{pmessage.Id, pmessage.User.Id, pmessage.Text}
@@ -166,37 +263,81 @@ func (p *Pad) CacherHandler() {
 			case *PDelta:
 				mongoMessage := &MongoDelta{
 					pmessage.Id, pmessage.UserId,
-					make([]*MongoDeltaOp, pmessage.Ops.Len())}
-				count := 0
-				for op := pmessage.Ops.Front(); op != nil; op = op.Next() {
+					make([]*MongoDeltaOp, len(pmessage.Ops)), time.Now(), pmessage.Undo}
+				for i, op := range pmessage.Ops {
 					mongoOp := MongoDeltaOp{}
-					switch op := op.Value.(type) {
-					case *POpInsert:
+					length := op.Len
+					switch op.Type {
+					case OP_INSERT:
 						mongoOp.Insert = string(op.Text)
 						mongoOp.Meta = op.Meta
-					case *POpDelete:
-						mongoOp.Delete = &op.Len
-					case *POpRetain:
-						mongoOp.Retain = &op.Len
+						mongoOp.Embed = op.Meta.Embed
+					case OP_DELETE:
+						mongoOp.Delete = &length
+					case OP_RETAIN:
+						mongoOp.Retain = &length
 						mongoOp.Meta = op.Meta
 					}
-					mongoMessage.Ops[count] = &mongoOp
-					count++
+					mongoMessage.Ops[i] = &mongoOp
 				}
 				if err := p.DeltaCollection.Insert(mongoMessage); err != nil {
 					padLogger.Log(LOG_ERROR, p.Id, "mongo insert err", err)
 				}
+			case *PThread:
+				mongoMessage := &MongoThread{pmessage.Id, pmessage.Revision, pmessage.From, pmessage.To,
+					pmessage.Resolved, make([]*MongoComment, len(pmessage.Comments))}
+				for i, comment := range pmessage.Comments {
+					mongoMessage.Comments[i] = &MongoComment{comment.Id, 0, comment.Text, comment.Time}
+					if comment.User != nil {
+						mongoMessage.Comments[i].UserId = comment.User.Id
+					}
+				}
+				if _, err := p.ThreadCollection.UpsertId(pmessage.Id, mongoMessage); err != nil {
+					padLogger.Log(LOG_ERROR, p.Id, "mongo upsert err", err)
+				}
+			case *PLock:
+				mongoMessage := &MongoLock{pmessage.Id, 0, pmessage.Revision, pmessage.From, pmessage.To, pmessage.Removed}
+				if pmessage.User != nil {
+					mongoMessage.UserId = pmessage.User.Id
+				}
+				if _, err := p.LockCollection.UpsertId(pmessage.Id, mongoMessage); err != nil {
+					padLogger.Log(LOG_ERROR, p.Id, "mongo upsert err", err)
+				}
+			case PPurge:
+				if err := p.ChatCollection.DropCollection(); err != nil {
+					padLogger.Log(LOG_ERROR, p.Id, "mongo drop err", err)
+				}
+				if err := p.DeltaCollection.DropCollection(); err != nil {
+					padLogger.Log(LOG_ERROR, p.Id, "mongo drop err", err)
+				}
+				if err := p.ThreadCollection.DropCollection(); err != nil {
+					padLogger.Log(LOG_ERROR, p.Id, "mongo drop err", err)
+				}
+				if err := p.LockCollection.DropCollection(); err != nil {
+					padLogger.Log(LOG_ERROR, p.Id, "mongo drop err", err)
+				}
+				purged = true
 			}
 		}
 	}
 }
 
 func (p *Pad) SendChat(c *Client, clientChat *CChat) {
+	if c.PadPerms()&PERM_CHAT == 0 {
+		padLogger.Log(LOG_WARNING, p.Id, c.UserId, "chat without permission", p.IsReadOnly())
+		return
+	}
 	text := c.User.Nickname
 	if c.User.Perms&PERM_NOTGUEST == 0 {
 		text += " (guest)"
 	}
-	text += ": " + strings.TrimSpace(clientChat.Text)
+	message := strings.TrimSpace(clientChat.Text)
+	if utf8.RuneCountInString(message) > limitChatLength {
+		padLogger.Log(LOG_WARNING, p.Id, c.UserId, "chat message length limit exceeded")
+		c.SendError(ERROR_TOO_LARGE, fmt.Sprintf("chat message can't be longer than %d characters", limitChatLength))
+		return
+	}
+	text += ": " + message
 	pmessage := PChat{User: c.User, Text: text}
 	padLogger.Log(LOG_INFO, p.Id, c.UserId, "broadcast chat message", text)
 	p.ChatMutex.Lock()
@@ -205,6 +346,7 @@ func (p *Pad) SendChat(c *Client, clientChat *CChat) {
 	p.ChatArray = append(p.ChatArray, &pmessage)
 	p.ChatMutex.Unlock()
 	p.CacherChannel <- &pmessage
+	SearchUpdateChat(p)
 
 	p.ClientsMutex.RLock()
 	for clientIter := p.Clients.Front(); clientIter != nil; clientIter = clientIter.Next() {
@@ -221,39 +363,108 @@ func (p *Pad) SendChat(c *Client, clientChat *CChat) {
 
 func (p *Pad) SendDelta(c *Client, clientDelta *CDelta) {
 	padLogger.Log(LOG_INFO, p.Id, c.UserId, "broadcast delta message", clientDelta)
-	canWriteWash := c.User.Perms&PERM_WHITEWASH != 0
-	//canEdit := c.User.Perms&PERM_EDIT != 0
-	opsList := DeltaValidateFromClient(clientDelta.Ops, canWriteWash, c.UserId)
+	perms := c.PadPerms()
+	if perms&(PERM_WRITE|PERM_SUGGEST) == 0 {
+		reason := "no permission to write"
+		if p.IsReadOnly() {
+			reason = padReadOnlyReason
+		}
+		c.SendDeltaDropped(clientDelta.Revision, reason)
+		return
+	}
+	canWriteWash := perms&PERM_WHITEWASH != 0
+	canEdit := perms&PERM_EDIT != 0
+	suggest := clientDelta.Suggest || perms&PERM_WRITE == 0
+	opsList, reason := DeltaValidateFromClient(clientDelta.Ops, canWriteWash, c.UserId)
+	if opsList == nil {
+		padLogger.Log(LOG_WARNING, p.Id, c.UserId, "delta exceeds limits", reason)
+		c.SendDeltaDropped(clientDelta.Revision, reason)
+		return
+	}
 	p.DeltaMutex.Lock()
+	if clientDelta.Revision > p.DeltaCounter {
+		padLogger.Log(LOG_ERROR, p.Id, c.UserId, "delta for unknown revision", clientDelta.Revision)
+		p.DeltaMutex.Unlock()
+		c.SendDeltaDropped(clientDelta.Revision, "unknown revision")
+		return
+	}
+	if c.OffsetUnit == OFFSET_UNIT_UTF16 {
+		if opsList = DeltaFromUtf16(opsList, p.DocumentArray[clientDelta.Revision].Rope); opsList == nil {
+			padLogger.Log(LOG_ERROR, p.Id, c.UserId, "can't convert delta from UTF-16", clientDelta.Revision)
+			p.DeltaMutex.Unlock()
+			c.SendDeltaDropped(clientDelta.Revision, "delta splits a surrogate pair or doesn't match the document")
+			return
+		}
+	}
 	for rev := clientDelta.Revision; rev < p.DeltaCounter; rev++ {
 		newOpsList := DeltaTransform(opsList, p.DeltaArray[rev].Ops)
 		if newOpsList == nil {
 			padLogger.Log(LOG_ERROR, p.Id, c.UserId, "can't transform delta", rev, DeltaToString(opsList), DeltaToString(p.DeltaArray[rev].Ops))
 			p.DeltaMutex.Unlock()
-			c.Messages <- &SDeltaDropped{clientDelta.Revision}
+			c.SendDeltaDropped(clientDelta.Revision, "can't transform delta")
 			return
 		}
 		opsList = newOpsList
 	}
-	oldDocument := p.DocumentArray[p.DeltaCounter].Ops
-	//newOps := DeltaCompose(opsList, oldDocument, canWriteWash, canEdit, c.User)
-	//if newOps[0] == nil {
-	newOps := DeltaComposeOld(opsList, oldDocument)
-	if newOps == nil {
-		padLogger.Log(LOG_ERROR, p.Id, c.UserId, "can't compose delta", DeltaToString(opsList), DeltaToString(oldDocument))
+	locked := false
+	if perms&PERM_MOD == 0 {
+		opsList, locked = p.lockClip(c, opsList)
+	}
+	oldDocument := p.DocumentArray[p.DeltaCounter].Rope
+	accepted, newDocument, rejected, converted := []POp(nil), (*Rope)(nil), false, false
+	if suggest {
+		if accepted, converted = DeltaSuggest(opsList, oldDocument, c.User); accepted != nil {
+			newDocument = DeltaApply(accepted, oldDocument)
+		}
+	} else {
+		accepted, newDocument, rejected = DeltaCompose(opsList, oldDocument, canWriteWash, canEdit, c.User)
+	}
+	if accepted != nil && newDocument != nil && newDocument.Len() > uint32(limitDocumentLength) && newDocument.Len() > oldDocument.Len() {
+		padLogger.Log(LOG_WARNING, p.Id, c.UserId, "document length limit exceeded", newDocument.Len())
+		p.DeltaMutex.Unlock()
+		c.SendDeltaDropped(clientDelta.Revision, fmt.Sprintf("document can't be longer than %d characters", limitDocumentLength))
+		return
+	}
+	if accepted == nil || newDocument == nil {
+		padLogger.Log(LOG_ERROR, p.Id, c.UserId, "can't compose delta", DeltaToString(opsList), DeltaToString(oldDocument.Ops()))
+		p.DeltaMutex.Unlock()
+		c.SendDeltaDropped(clientDelta.Revision, "can't compose delta")
+		return
+	}
+	reason = ""
+	if converted && !c.HasCapability(CAP_ACKS) {
+		// without acks the author takes the stored delta for its own one
+		// and doesn't apply it
+		reason = deltaSuggestReason
+	}
+	if rejected {
+		padLogger.Log(LOG_WARNING, p.Id, c.UserId, "delta edits text of other users without edit permission", DeltaToString(opsList))
+		reason = deltaRejectedReason
+	}
+	if locked {
+		padLogger.Log(LOG_WARNING, p.Id, c.UserId, "delta edits locked sections", DeltaToString(opsList))
+		reason = deltaLockedReason
+	}
+	if reason != "" && DeltaIsNoop(accepted) {
 		p.DeltaMutex.Unlock()
-		c.Messages <- &SDeltaDropped{clientDelta.Revision}
+		c.SendDeltaDropped(clientDelta.Revision, reason)
 		return
 	}
 	p.DeltaCounter++
-	//delta := PDelta{p.DeltaCounter, c.UserId, newOps[0]}
-	delta := PDelta{p.DeltaCounter, c.UserId, opsList}
+	p.EditTime = time.Now()
+	delta := PDelta{p.DeltaCounter, c.UserId, accepted, DELTA_EDIT}
 	p.DeltaArray = append(p.DeltaArray, &delta)
-	//p.DocumentArray = append(p.DocumentArray, &PDocument{p.DeltaCounter, newOps[1]})
-	p.DocumentArray = append(p.DocumentArray, &PDocument{p.DeltaCounter, newOps})
+	p.UndoRecord(&delta)
+	p.DocumentArray = append(p.DocumentArray, &PDocument{p.DeltaCounter, newDocument})
 	p.DeltaMutex.Unlock()
 
 	p.CacherChannel <- &delta
+	SearchUpdatePad(p)
+
+	// the author takes the delta following the ack as its own
+	if c.HasCapability(CAP_ACKS) {
+		c.SendAck(delta.Id)
+	}
 
 	p.ClientsMutex.RLock()
 	for clientIter := p.Clients.Front(); clientIter != nil; clientIter = clientIter.Next() {
@@ -264,48 +475,63 @@ func (p *Pad) SendDelta(c *Client, clientDelta *CDelta) {
 		}
 	}
 	p.ClientsMutex.RUnlock()
-}
 
-func (p *Pad) InvertDelta(c *Client, id uint32) {
-	padLogger.Log(LOG_INFO, p.Id, c.UserId, "process invert delta message", id)
-	p.DeltaMutex.Lock()
-	if p.DeltaCounter <= id {
-		p.DeltaMutex.Unlock()
-		c.Messages <- &SDeltaDropped{0}
-		return
+	if reason != "" {
+		c.SendDeltaDropped(clientDelta.Revision, reason)
 	}
-	opsList := DeltaInvert(p.DeltaArray[id].Ops, p.DocumentArray[id].Ops)
+}
+
+// invertRevision inverts delta at index i of DeltaArray and transforms the
+// inverse through later revisions. DeltaMutex should be locked.
+func (p *Pad) invertRevision(c *Client, i uint32) ([]POp, string) {
+	opsList := DeltaInvert(p.DeltaArray[i].Ops, p.DocumentArray[i].Rope)
 	if opsList == nil {
-		padLogger.Log(LOG_ERROR, p.Id, c.UserId, "can't invert delta", id, DeltaToString(p.DeltaArray[id].Ops), DeltaToString(p.DocumentArray[id].Ops))
-		p.DeltaMutex.Unlock()
-		c.Messages <- &SDeltaDropped{0}
-		return
+		padLogger.Log(LOG_ERROR, p.Id, c.UserId, "can't invert delta", i, DeltaToString(p.DeltaArray[i].Ops), DeltaToString(p.DocumentArray[i].Rope.Ops()))
+		return nil, "can't invert delta"
 	}
-	for rev := id + 1; rev < p.DeltaCounter; rev++ {
+	for rev := i + 1; rev < p.DeltaCounter; rev++ {
 		newOpsList := DeltaTransform(opsList, p.DeltaArray[rev].Ops)
 		if newOpsList == nil {
 			padLogger.Log(LOG_ERROR, p.Id, c.UserId, "can't transform inverted delta", rev, DeltaToString(opsList), DeltaToString(p.DeltaArray[rev].Ops))
-			p.DeltaMutex.Unlock()
-			c.Messages <- &SDeltaDropped{0}
-			return
+			return nil, "can't transform inverted delta"
 		}
 		opsList = newOpsList
 	}
-	oldDocument := p.DocumentArray[p.DeltaCounter].Ops
-	newOps := DeltaComposeOld(opsList, oldDocument)
-	if newOps == nil {
-		padLogger.Log(LOG_ERROR, p.Id, c.UserId, "can't compose inverted delta", DeltaToString(opsList), DeltaToString(oldDocument))
+	return opsList, ""
+}
+
+// appendServerDelta applies opsList generated by the server on behalf of c
+// to the last revision, appends it and sends it to the clients of the pad.
+// Like deltas of c, it doesn't edit sections locked by other users.
+// DeltaMutex should be locked, it is unlocked on return.
+func (p *Pad) appendServerDelta(c *Client, opsList []POp, kind uint8, what string) {
+	locked := false
+	if c.User.Perms&PERM_MOD == 0 {
+		opsList, locked = p.lockClip(c, opsList)
+	}
+	if locked && DeltaIsNoop(opsList) {
 		p.DeltaMutex.Unlock()
-		c.Messages <- &SDeltaDropped{0}
+		c.SendError(ERROR_PERMISSION_DENIED, deltaLockedReason)
+		return
+	}
+	oldDocument := p.DocumentArray[p.DeltaCounter].Rope
+	newDocument := DeltaApply(opsList, oldDocument)
+	if newDocument == nil {
+		padLogger.Log(LOG_ERROR, p.Id, c.UserId, "can't compose "+what, DeltaToString(opsList), DeltaToString(oldDocument.Ops()))
+		p.DeltaMutex.Unlock()
+		c.SendError(ERROR_INTERNAL, "can't compose "+what)
 		return
 	}
 	p.DeltaCounter++
-	delta := PDelta{p.DeltaCounter, c.UserId, opsList}
+	p.EditTime = time.Now()
+	delta := PDelta{p.DeltaCounter, c.UserId, opsList, kind}
 	p.DeltaArray = append(p.DeltaArray, &delta)
-	p.DocumentArray = append(p.DocumentArray, &PDocument{p.DeltaCounter, newOps})
+	p.DocumentArray = append(p.DocumentArray, &PDocument{p.DeltaCounter, newDocument})
+	p.UndoRecord(&delta)
 	p.DeltaMutex.Unlock()
 
 	p.CacherChannel <- &delta
+	SearchUpdatePad(p)
 
 	p.ClientsMutex.RLock()
 	for clientIter := p.Clients.Front(); clientIter != nil; clientIter = clientIter.Next() {
@@ -316,19 +542,79 @@ func (p *Pad) InvertDelta(c *Client, id uint32) {
 		}
 	}
 	p.ClientsMutex.RUnlock()
+
+	if locked {
+		c.SendError(ERROR_PERMISSION_DENIED, deltaLockedReason)
+	}
+}
+
+// clientRange converts range from..to of the last revision sent by c, an
+// empty range means the whole document. DeltaMutex should be locked.
+func (p *Pad) clientRange(c *Client, from uint32, to uint32) (uint32, uint32, string) {
+	document := p.DocumentArray[p.DeltaCounter].Rope
+	if from == 0 && to == 0 {
+		return 0, document.Len(), ""
+	}
+	if c.OffsetUnit == OFFSET_UNIT_UTF16 {
+		var okFrom, okTo bool
+		from, okFrom = DeltaOffsetFromUtf16(from, document)
+		to, okTo = DeltaOffsetFromUtf16(to, document)
+		if !okFrom || !okTo {
+			return 0, 0, "range splits a surrogate pair or is out of the document"
+		}
+	}
+	if from > to || to > document.Len() {
+		return 0, 0, "range is out of the document"
+	}
+	return from, to, ""
 }
 
-func (p *Pad) InvertUserDelta(c *Client, userId uint32) {
-	padLogger.Log(LOG_INFO, p.Id, c.UserId, "process invert user delta message", userId)
-	opsList := (*list.List)(nil)
+// restrictRange limits opsList to range from..to of the last revision, an
+// empty range means the whole document. It returns nil if nothing is changed
+// inside the range. DeltaMutex should be locked.
+func (p *Pad) restrictRange(c *Client, opsList []POp, from uint32, to uint32) ([]POp, string) {
+	if from == 0 && to == 0 {
+		return opsList, ""
+	}
+	from, to, reason := p.clientRange(c, from, to)
+	if reason != "" {
+		return nil, reason
+	}
+	opsList = DeltaRestrict(opsList, from, to)
+	if DeltaIsNoop(opsList) {
+		return nil, ""
+	}
+	return opsList, ""
+}
+
+func (p *Pad) InvertDelta(c *Client, id uint32) {
+	padLogger.Log(LOG_INFO, p.Id, c.UserId, "process invert delta message", id)
+	p.DeltaMutex.Lock()
+	if p.DeltaCounter <= id {
+		p.DeltaMutex.Unlock()
+		c.SendError(ERROR_NOT_FOUND, "no such revision")
+		return
+	}
+	opsList, reason := p.invertRevision(c, id)
+	if opsList == nil {
+		p.DeltaMutex.Unlock()
+		c.SendError(ERROR_INTERNAL, reason)
+		return
+	}
+	p.appendServerDelta(c, opsList, DELTA_EDIT, "inverted delta")
+}
+
+func (p *Pad) InvertUserDelta(c *Client, userId uint32, from uint32, to uint32) {
+	padLogger.Log(LOG_INFO, p.Id, c.UserId, "process invert user delta message", userId, from, to)
+	opsList := []POp(nil)
 	p.DeltaMutex.Lock()
 	for rev := uint32(0); rev < p.DeltaCounter; rev++ {
 		if p.DeltaArray[rev].UserId == userId {
-			invertedOpsList := DeltaInvert(p.DeltaArray[rev].Ops, p.DocumentArray[rev].Ops)
+			invertedOpsList := DeltaInvert(p.DeltaArray[rev].Ops, p.DocumentArray[rev].Rope)
 			if invertedOpsList == nil {
-				padLogger.Log(LOG_ERROR, p.Id, c.UserId, "can't invert user delta", rev, DeltaToString(p.DeltaArray[rev].Ops), DeltaToString(p.DocumentArray[rev].Ops))
+				padLogger.Log(LOG_ERROR, p.Id, c.UserId, "can't invert user delta", rev, DeltaToString(p.DeltaArray[rev].Ops), DeltaToString(p.DocumentArray[rev].Rope.Ops()))
 				p.DeltaMutex.Unlock()
-				c.Messages <- &SDeltaDropped{0}
+				c.SendError(ERROR_INTERNAL, "can't invert user delta")
 				return
 			}
 			if opsList != nil {
@@ -336,7 +622,7 @@ func (p *Pad) InvertUserDelta(c *Client, userId uint32) {
 				if newOpsList == nil {
 					padLogger.Log(LOG_ERROR, p.Id, c.UserId, "can't compose inverted user delta", rev, DeltaToString(invertedOpsList), DeltaToString(opsList))
 					p.DeltaMutex.Unlock()
-					c.Messages <- &SDeltaDropped{0}
+					c.SendError(ERROR_INTERNAL, "can't compose inverted user delta")
 					return
 				}
 				opsList = newOpsList
@@ -348,56 +634,38 @@ func (p *Pad) InvertUserDelta(c *Client, userId uint32) {
 			if newOpsList == nil {
 				padLogger.Log(LOG_ERROR, p.Id, c.UserId, "can't transform inverted user delta", rev, DeltaToString(opsList), DeltaToString(p.DeltaArray[rev].Ops))
 				p.DeltaMutex.Unlock()
-				c.Messages <- &SDeltaDropped{0}
+				c.SendError(ERROR_INTERNAL, "can't transform inverted user delta")
 				return
 			}
 			opsList = newOpsList
 		}
 	}
-	oldDocument := p.DocumentArray[p.DeltaCounter].Ops
-	newOps := (*list.List)(nil)
 	if opsList != nil {
-		newOps = DeltaComposeOld(opsList, oldDocument)
-		if newOps == nil {
-			padLogger.Log(LOG_ERROR, p.Id, c.UserId, "can't compose inverted user delta", DeltaToString(opsList), DeltaToString(oldDocument))
+		var reason string
+		if opsList, reason = p.restrictRange(c, opsList, from, to); reason != "" {
 			p.DeltaMutex.Unlock()
-			c.Messages <- &SDeltaDropped{0}
+			c.SendError(ERROR_INVALID_REQUEST, reason)
 			return
 		}
-	} else {
+	}
+	if opsList == nil {
 		p.DeltaMutex.Unlock()
-		c.Messages <- &SDeltaDropped{0}
+		c.SendError(ERROR_NOTHING_TO_DO, "nothing to invert")
 		return
 	}
-	p.DeltaCounter++
-	delta := PDelta{p.DeltaCounter, c.UserId, opsList}
-	p.DeltaArray = append(p.DeltaArray, &delta)
-	p.DocumentArray = append(p.DocumentArray, &PDocument{p.DeltaCounter, newOps})
-	p.DeltaMutex.Unlock()
-
-	p.CacherChannel <- &delta
-
-	p.ClientsMutex.RLock()
-	for clientIter := p.Clients.Front(); clientIter != nil; clientIter = clientIter.Next() {
-		neighbor := clientIter.Value.(*Client)
-		select {
-		case neighbor.Messages <- &delta:
-		default:
-		}
-	}
-	p.ClientsMutex.RUnlock()
+	p.appendServerDelta(c, opsList, DELTA_EDIT, "inverted user delta")
 }
 
-func (p *Pad) RestoreRevision(c *Client, rev uint32) {
-	padLogger.Log(LOG_INFO, p.Id, c.UserId, "process restore revision", rev)
-	opsList := (*list.List)(nil)
+func (p *Pad) RestoreRevision(c *Client, rev uint32, from uint32, to uint32) {
+	padLogger.Log(LOG_INFO, p.Id, c.UserId, "process restore revision", rev, from, to)
+	opsList := []POp(nil)
 	p.DeltaMutex.Lock()
 	for ; rev < p.DeltaCounter; rev++ {
-		invertedOpsList := DeltaInvert(p.DeltaArray[rev].Ops, p.DocumentArray[rev].Ops)
+		invertedOpsList := DeltaInvert(p.DeltaArray[rev].Ops, p.DocumentArray[rev].Rope)
 		if invertedOpsList == nil {
-			padLogger.Log(LOG_ERROR, p.Id, c.UserId, "can't invert delta", rev, DeltaToString(p.DeltaArray[rev].Ops), DeltaToString(p.DocumentArray[rev].Ops))
+			padLogger.Log(LOG_ERROR, p.Id, c.UserId, "can't invert delta", rev, DeltaToString(p.DeltaArray[rev].Ops), DeltaToString(p.DocumentArray[rev].Rope.Ops()))
 			p.DeltaMutex.Unlock()
-			c.Messages <- &SDeltaDropped{0}
+			c.SendError(ERROR_INTERNAL, "can't invert delta")
 			return
 		}
 		if opsList != nil {
@@ -405,7 +673,7 @@ func (p *Pad) RestoreRevision(c *Client, rev uint32) {
 			if newOpsList == nil {
 				padLogger.Log(LOG_ERROR, p.Id, c.UserId, "can't compose inverted delta", rev, DeltaToString(invertedOpsList), DeltaToString(opsList))
 				p.DeltaMutex.Unlock()
-				c.Messages <- &SDeltaDropped{0}
+				c.SendError(ERROR_INTERNAL, "can't compose inverted delta")
 				return
 			}
 			opsList = newOpsList
@@ -413,38 +681,179 @@ func (p *Pad) RestoreRevision(c *Client, rev uint32) {
 			opsList = invertedOpsList
 		}
 	}
-	oldDocument := p.DocumentArray[p.DeltaCounter].Ops
-	newOps := (*list.List)(nil)
 	if opsList != nil {
-		newOps = DeltaComposeOld(opsList, oldDocument)
-		if newOps == nil {
-			padLogger.Log(LOG_ERROR, p.Id, c.UserId, "can't compose inverted delta", DeltaToString(opsList), DeltaToString(oldDocument))
+		var reason string
+		if opsList, reason = p.restrictRange(c, opsList, from, to); reason != "" {
 			p.DeltaMutex.Unlock()
-			c.Messages <- &SDeltaDropped{0}
+			c.SendError(ERROR_INVALID_REQUEST, reason)
 			return
 		}
-	} else {
+	}
+	if opsList == nil {
 		p.DeltaMutex.Unlock()
-		c.Messages <- &SDeltaDropped{0}
+		c.SendError(ERROR_NOTHING_TO_DO, "nothing to restore")
 		return
 	}
-	p.DeltaCounter++
-	delta := PDelta{p.DeltaCounter, c.UserId, opsList}
-	p.DeltaArray = append(p.DeltaArray, &delta)
-	p.DocumentArray = append(p.DocumentArray, &PDocument{p.DeltaCounter, newOps})
-	p.DeltaMutex.Unlock()
+	p.appendServerDelta(c, opsList, DELTA_EDIT, "inverted delta")
+}
 
-	p.CacherChannel <- &delta
+// UndoRecord updates the undo stack of the delta author. DeltaMutex should
+// be locked.
+func (p *Pad) UndoRecord(delta *PDelta) {
+	if delta.UserId == 0 {
+		return
+	}
+	stack := p.UndoStacks[delta.UserId]
+	if stack == nil {
+		stack = &PUndoStack{}
+		p.UndoStacks[delta.UserId] = stack
+	}
+	switch delta.Undo {
+	case DELTA_UNDO:
+		if len(stack.Undo) > 0 {
+			stack.Undo = stack.Undo[:len(stack.Undo)-1]
+		}
+		stack.Redo = append(stack.Redo, delta.Id)
+	case DELTA_REDO:
+		if len(stack.Redo) > 0 {
+			stack.Redo = stack.Redo[:len(stack.Redo)-1]
+		}
+		stack.Undo = append(stack.Undo, delta.Id)
+	default:
+		stack.Undo = append(stack.Undo, delta.Id)
+		stack.Redo = nil
+	}
+	if len(stack.Undo) > undoStackSize {
+		stack.Undo = stack.Undo[len(stack.Undo)-undoStackSize:]
+	}
+}
 
-	p.ClientsMutex.RLock()
-	for clientIter := p.Clients.Front(); clientIter != nil; clientIter = clientIter.Next() {
+func (p *Pad) Undo(c *Client) {
+	p.undoRedo(c, DELTA_UNDO)
+}
+
+func (p *Pad) Redo(c *Client) {
+	p.undoRedo(c, DELTA_REDO)
+}
+
+// undoRedo inverts the last delta of the client user, redo inverts the last
+// undo.
+func (p *Pad) undoRedo(c *Client, kind uint8) {
+	padLogger.Log(LOG_INFO, p.Id, c.UserId, "process undo message", kind)
+	p.DeltaMutex.Lock()
+	revs := []uint32(nil)
+	if stack := p.UndoStacks[c.UserId]; stack != nil {
+		if kind == DELTA_UNDO {
+			revs = stack.Undo
+		} else {
+			revs = stack.Redo
+		}
+	}
+	if len(revs) == 0 {
+		p.DeltaMutex.Unlock()
+		if kind == DELTA_UNDO {
+			c.SendError(ERROR_NOTHING_TO_DO, "nothing to undo")
+		} else {
+			c.SendError(ERROR_NOTHING_TO_DO, "nothing to redo")
+		}
+		return
+	}
+	opsList, reason := p.invertRevision(c, revs[len(revs)-1]-1)
+	if opsList == nil {
+		p.DeltaMutex.Unlock()
+		c.SendError(ERROR_INTERNAL, reason)
+		return
+	}
+	p.appendServerDelta(c, opsList, kind, "inverted delta")
+}
+
+// ResolveSuggestions accepts or rejects suggestions of user message.UserId,
+// or of everyone if it is 0, in a range of the last revision. Users who may
+// edit text of others resolve any suggestions, others may reject own ones.
+func (p *Pad) ResolveSuggestions(c *Client, message *CSuggestionResolve) {
+	padLogger.Log(LOG_INFO, p.Id, c.UserId, "process resolve suggestion message", message.From, message.To, message.UserId, message.Accept)
+	if c.PadPerms()&(PERM_EDIT|PERM_MOD) == 0 && (message.Accept || message.UserId != c.UserId) {
+		c.SendError(ERROR_PERMISSION_DENIED, "resolving suggestions of other users needs edit permission")
+		return
+	}
+	p.DeltaMutex.Lock()
+	from, to, reason := p.clientRange(c, message.From, message.To)
+	if reason != "" {
+		p.DeltaMutex.Unlock()
+		c.SendError(ERROR_INVALID_REQUEST, reason)
+		return
+	}
+	oldDocument := p.DocumentArray[p.DeltaCounter].Rope
+	opsList := DeltaResolveSuggestions(oldDocument, from, to, message.UserId, message.Accept)
+	if opsList == nil || DeltaIsNoop(opsList) {
+		p.DeltaMutex.Unlock()
+		c.SendError(ERROR_NOTHING_TO_DO, "nothing to resolve")
+		return
+	}
+	p.appendServerDelta(c, opsList, DELTA_EDIT, "resolve delta")
+}
+
+func (p *Pad) IsDeleted() bool {
+	PadMutex.RLock()
+	ret := !p.DeleteTime.IsZero()
+	PadMutex.RUnlock()
+	return ret
+}
+
+func (p *Pad) IsReadOnly() bool {
+	PadMutex.RLock()
+	ret := p.ReadOnly
+	PadMutex.RUnlock()
+	return ret
+}
+
+func (p *Pad) GetName() string {
+	PadMutex.RLock()
+	ret := p.Name
+	PadMutex.RUnlock()
+	return ret
+}
+
+func (p *Pad) KickAll() {
+	padLogger.Log(LOG_INFO, p.Id, "kick all clients")
+	p.kickClients(SPadKick{p.GetName()}, func(c *Client) bool { return true })
+}
+
+// KickDenied kicks clients who may not enter the pad anymore.
+func (p *Pad) KickDenied() {
+	denied := map[*Client]bool{}
+	for _, client := range p.CopyOnlineUsers() {
+		if user := client.User; user != nil && !CacherCanEnterPad(user, p, client.ShareToken) {
+			denied[client] = true
+		}
+	}
+	if len(denied) > 0 {
+		padLogger.Log(LOG_INFO, p.Id, "kick denied clients", len(denied))
+		p.kickClients(SPadKick{p.GetName()}, func(c *Client) bool { return denied[c] })
+	}
+}
+
+func (p *Pad) kickClients(message SPadKick, kick func(c *Client) bool) {
+	p.ClientsMutex.Lock()
+	for clientIter := p.Clients.Front(); clientIter != nil; {
 		neighbor := clientIter.Value.(*Client)
+		if !kick(neighbor) {
+			clientIter = clientIter.Next()
+			continue
+		}
 		select {
-		case neighbor.Messages <- &delta:
+		case neighbor.Messages <- ClientLeavePad{}:
+		default:
+		}
+		select {
+		case neighbor.Messages <- &message:
 		default:
 		}
+		next := clientIter.Next()
+		p.Clients.Remove(clientIter)
+		clientIter = next
 	}
-	p.ClientsMutex.RUnlock()
+	p.ClientsMutex.Unlock()
 }
 
 func (p *Pad) SendUserInfo(c *Client) {
@@ -456,7 +865,7 @@ func (p *Pad) SendUserInfo(c *Client) {
 	p.ClientsMutex.RLock()
 	for clientIter := p.Clients.Front(); clientIter != nil; clientIter = clientIter.Next() {
 		neighbor := clientIter.Value.(*Client)
-		if neighbor != c {
+		if neighbor != c && neighbor.HasCapability(CAP_PRESENCE) {
 			if neighbor.User.Perms&PERM_MOD != 0 {
 				select {
 				case neighbor.Messages <- &messageMod:
@@ -480,7 +889,7 @@ func (p *Pad) SendUserLeave(c *Client) {
 	p.ClientsMutex.RLock()
 	for clientIter := p.Clients.Front(); clientIter != nil; clientIter = clientIter.Next() {
 		neighbor := clientIter.Value.(*Client)
-		if neighbor != c {
+		if neighbor != c && neighbor.HasCapability(CAP_PRESENCE) {
 			select {
 			case neighbor.Messages <- &message:
 			default:
@@ -490,6 +899,18 @@ func (p *Pad) SendUserLeave(c *Client) {
 	p.ClientsMutex.RUnlock()
 }
 
+func (p *Pad) SendPadState() {
+	p.ClientsMutex.RLock()
+	for clientIter := p.Clients.Front(); clientIter != nil; clientIter = clientIter.Next() {
+		neighbor := clientIter.Value.(*Client)
+		select {
+		case neighbor.Messages <- PPadState{}:
+		default:
+		}
+	}
+	p.ClientsMutex.RUnlock()
+}
+
 func (p *Pad) CopyOnlineUsers() []*Client {
 	p.ClientsMutex.RLock()
 	count := 0
@@ -0,0 +1,412 @@
+/*
+Esterpad online collaborative editor
+Copyright (C) 2017 Anon2Anon
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package esterpad
+
+import (
+	"container/list"
+	. "esterpad_utils"
+	"testing"
+	"time"
+)
+
+func testPad() *Pad {
+	return &Pad{DocumentArray: []*PDocument{&PDocument{Rope: DefaultDocument}}, UndoStacks: map[uint32]*PUndoStack{}}
+}
+
+// testPadAppend stores delta like undoRedo does without broadcasting it.
+func testPadAppend(t *testing.T, p *Pad, userId uint32, ops []POp, kind uint8) {
+	document := DeltaApply(ops, p.DocumentArray[p.DeltaCounter].Rope)
+	if document == nil {
+		t.Fatalf("can't apply %v", DeltaToString(ops))
+	}
+	p.DeltaCounter++
+	delta := &PDelta{p.DeltaCounter, userId, ops, kind}
+	p.DeltaArray = append(p.DeltaArray, delta)
+	p.DocumentArray = append(p.DocumentArray, &PDocument{p.DeltaCounter, document})
+	p.UndoRecord(delta)
+}
+
+func testPadUndo(t *testing.T, p *Pad, userId uint32, kind uint8) {
+	stack := p.UndoStacks[userId]
+	revs := stack.Undo
+	if kind == DELTA_REDO {
+		revs = stack.Redo
+	}
+	ops, reason := p.invertRevision(&Client{UserId: userId}, revs[len(revs)-1]-1)
+	if ops == nil {
+		t.Fatal(reason)
+	}
+	testPadAppend(t, p, userId, ops, kind)
+}
+
+func testPadText(p *Pad) string {
+	return string(p.DocumentArray[p.DeltaCounter].Rope.Text())
+}
+
+func TestPadUndoRedo(t *testing.T) {
+	p := testPad()
+	one := &PMeta{Changemask: 32, User: testUsers[0]}
+	two := &PMeta{Changemask: 32, User: testUsers[1]}
+	retain := &PMeta{}
+	testPadAppend(t, p, 1, DeltaAddInsert(nil, []rune("hello"), one, false), DELTA_EDIT)
+	testPadAppend(t, p, 2, DeltaAddInsert(DeltaAddRetain(nil, 5, retain), []rune(" world"), two, false), DELTA_EDIT)
+	testPadAppend(t, p, 1, DeltaAddRetain(DeltaAddInsert(nil, []rune(">"), one, false), 11, retain), DELTA_EDIT)
+	testPadAppend(t, p, 2, DeltaAddDelete(DeltaAddRetain(nil, 6, retain), 6), DELTA_EDIT)
+	if text := testPadText(p); text != ">hello" {
+		t.Fatalf("text %q", text)
+	}
+	testPadUndo(t, p, 2, DELTA_UNDO)
+	if text := testPadText(p); text != ">hello world" {
+		t.Fatalf("after undo of other user text %q", text)
+	}
+	testPadUndo(t, p, 1, DELTA_UNDO)
+	if text := testPadText(p); text != "hello world" {
+		t.Fatalf("after first undo text %q", text)
+	}
+	testPadUndo(t, p, 1, DELTA_UNDO)
+	if text := testPadText(p); text != " world" {
+		t.Fatalf("after second undo text %q", text)
+	}
+	if stack := p.UndoStacks[1]; len(stack.Undo) != 0 || len(stack.Redo) != 2 {
+		t.Fatalf("stack after undo %+v", stack)
+	}
+	testPadUndo(t, p, 1, DELTA_REDO)
+	if text := testPadText(p); text != "hello world" {
+		t.Fatalf("after redo text %q", text)
+	}
+	testPadAppend(t, p, 1, DeltaAddInsert(DeltaAddRetain(nil, 11, retain), []rune("!"), one, false), DELTA_EDIT)
+	if stack := p.UndoStacks[1]; len(stack.Undo) != 2 || len(stack.Redo) != 0 {
+		t.Fatalf("new edit didn't clear redo stack %+v", stack)
+	}
+}
+
+func TestPadUndoRecordLimit(t *testing.T) {
+	p := testPad()
+	for i := uint32(1); i <= undoStackSize+10; i++ {
+		p.UndoRecord(&PDelta{i, 1, nil, DELTA_EDIT})
+	}
+	stack := p.UndoStacks[1]
+	if len(stack.Undo) != undoStackSize || stack.Undo[0] != 11 {
+		t.Fatalf("undo stack %v", stack.Undo)
+	}
+}
+
+func TestPadThreadAnchor(t *testing.T) {
+	p := testPad()
+	one := &PMeta{Changemask: 32, User: testUsers[0]}
+	retain := &PMeta{}
+	testPadAppend(t, p, 1, DeltaAddInsert(nil, []rune("hello world"), one, false), DELTA_EDIT)
+	thread := &PThread{Revision: 1, From: 6, To: 11}
+	testPadAppend(t, p, 1, DeltaAddRetain(DeltaAddInsert(nil, []rune(">> "), one, false), 11, retain), DELTA_EDIT)
+	testPadAppend(t, p, 1, DeltaAddInsert(DeltaAddRetain(nil, 14, retain), []rune("!"), one, false), DELTA_EDIT)
+	testPadAppend(t, p, 1, DeltaAddRetain(DeltaAddInsert(DeltaAddRetain(nil, 9, retain), []rune("wide "), one, false), 6, retain), DELTA_EDIT)
+	p.threadAnchor(thread)
+	text := []rune(testPadText(p))
+	if thread.Revision != 4 || string(text[thread.From:thread.To]) != "world" {
+		t.Fatalf("anchor %d..%d of %q at revision %d", thread.From, thread.To, string(text), thread.Revision)
+	}
+	testPadAppend(t, p, 1, DeltaAddRetain(DeltaAddDelete(DeltaAddRetain(nil, 3, retain), 16), 1, retain), DELTA_EDIT)
+	p.threadAnchor(thread)
+	if thread.From != 3 || thread.To != 3 {
+		t.Fatalf("anchor of deleted text %d..%d", thread.From, thread.To)
+	}
+}
+
+func TestPadLockClip(t *testing.T) {
+	p := testPad()
+	one := &PMeta{Changemask: 32, User: testUsers[0]}
+	two := &PMeta{Changemask: 32, User: testUsers[1]}
+	retain := &PMeta{}
+	testPadAppend(t, p, 1, DeltaAddInsert(nil, []rune("# Header\nbody"), one, false), DELTA_EDIT)
+	p.LockArray = []*PLock{&PLock{1, testUsers[0], 1, 0, 9, false}}
+	testPadAppend(t, p, 2, DeltaAddRetain(DeltaAddInsert(nil, []rune(">"), two, false), 13, retain), DELTA_EDIT)
+
+	// Insert at the lock bound is kept, deleting the header is dropped.
+	delta := DeltaAddInsert(nil, []rune("x"), two, false)
+	delta = DeltaAddDelete(delta, 10)
+	delta = DeltaAddRetain(delta, 4, retain)
+	clipped, locked := p.lockClip(&Client{UserId: 2, User: testUsers[1]}, delta)
+	if !locked {
+		t.Fatal("locked section edit isn't reported")
+	}
+	testPadAppend(t, p, 2, clipped, DELTA_EDIT)
+	if text := testPadText(p); text != "x# Header\nbody" {
+		t.Fatalf("text %q", text)
+	}
+	p.lockAnchor(p.LockArray[0])
+	if lock := p.LockArray[0]; lock.Revision != 3 || lock.From != 1 || lock.To != 10 {
+		t.Fatalf("lock %+v", lock)
+	}
+
+	delta = DeltaAddRetain(DeltaAddDelete(DeltaAddRetain(nil, 3, retain), 6), 5, retain)
+	if _, locked := p.lockClip(&Client{UserId: 1, User: testUsers[0]}, delta); locked {
+		t.Fatal("lock owner was clipped")
+	}
+	p.LockArray[0].Removed = true
+	if _, locked := p.lockClip(&Client{UserId: 2, User: testUsers[1]}, delta); locked {
+		t.Fatal("removed lock was applied")
+	}
+
+	// Undo of a delta in a section locked later is dropped.
+	p = testPad()
+	p.CacherChannel, p.Clients = make(chan interface{}, 10), list.New()
+	testPadAppend(t, p, 1, DeltaAddInsert(nil, []rune("# Header\nbody"), one, false), DELTA_EDIT)
+	testPadAppend(t, p, 2, DeltaAddRetain(DeltaAddInsert(DeltaAddRetain(nil, 3, retain), []rune("!"), two, false), 10, retain), DELTA_EDIT)
+	p.LockArray = []*PLock{&PLock{1, testUsers[0], 2, 0, 10, false}}
+	c := &Client{UserId: 2, User: testUsers[1], Messages: make(chan interface{}, 10)}
+	p.Undo(c)
+	err := (*SError)(nil)
+	if len(c.Messages) > 0 {
+		err, _ = (<-c.Messages).(*SError)
+	}
+	if err == nil || err.Code != ERROR_PERMISSION_DENIED || testPadText(p) != "# H!eader\nbody" {
+		t.Fatalf("undo in locked section gives %+v, text %q", err, testPadText(p))
+	}
+}
+
+func TestPadSharePerms(t *testing.T) {
+	guest := &User{Id: 10, Perms: PERM_CHAT | PERM_WRITE | PERM_EDIT | PERM_SUGGEST}
+	mod := &User{Id: 11, Perms: PERM_NOTGUEST | PERM_CHAT | PERM_WRITE | PERM_MOD}
+	p := testPad()
+	p.Id, p.Name = 100, "share/test"
+	PadMutex.Lock()
+	PadMap[p.Name] = p
+	ShareMap["read"] = &PShare{"read", p.Id, false}
+	ShareMap["write"] = &PShare{"write", p.Id, true}
+	ShareMap["other"] = &PShare{"other", p.Id + 1, true}
+	PadMutex.Unlock()
+	defer func() {
+		PadMutex.Lock()
+		delete(PadMap, p.Name)
+		ShareMap = map[string]*PShare{}
+		PadMutex.Unlock()
+	}()
+
+	for _, test := range []struct {
+		readOnly bool
+		private  bool
+		token    string
+		enter    bool
+		perms    uint32
+	}{
+		{false, false, "", true, guest.Perms},
+		{false, false, "read", true, 0},
+		{false, false, "write", true, PERM_CHAT | PERM_WRITE},
+		{true, false, "", true, 0},
+		{true, false, "write", true, 0},
+		{false, true, "", false, 0},
+		{false, true, "other", false, 0},
+		{false, true, "write", true, PERM_CHAT | PERM_WRITE},
+	} {
+		PadMutex.Lock()
+		p.ReadOnly, p.Private = test.readOnly, test.private
+		PadMutex.Unlock()
+		if enter := CacherCanEnterPad(guest, p, test.token); enter != test.enter {
+			t.Fatalf("%+v: enter %v", test, enter)
+		}
+		if perms := CacherUserPadPerms(guest, p.Name, test.token); perms != test.perms {
+			t.Fatalf("%+v: perms %b", test, perms)
+		}
+		if !CacherCanEnterPad(mod, p, "") || CacherUserPadPerms(mod, p.Name, "") != mod.Perms {
+			t.Fatalf("%+v: moderator is limited", test)
+		}
+	}
+}
+
+func TestPadTreePerms(t *testing.T) {
+	guest := &User{Id: 10, Perms: PERM_CHAT | PERM_WRITE}
+	mod := &User{Id: 11, Perms: PERM_NOTGUEST | PERM_CHAT | PERM_WRITE | PERM_MOD}
+	names := []string{"tree/open/a", "tree/closed/b", "tree/c"}
+	PadMutex.Lock()
+	for i, name := range names {
+		p := testPad()
+		p.Id, p.Name = uint32(200+i), name
+		PadMap[name] = p
+	}
+	FolderMap["tree/closed"] = PERM_NOTGUEST
+	PadMutex.Unlock()
+	defer func() {
+		PadMutex.Lock()
+		for _, name := range names {
+			delete(PadMap, name)
+		}
+		delete(FolderMap, "tree/closed")
+		PadMutex.Unlock()
+	}()
+
+	if tree := CacherPadTree(guest, "tree"); len(tree.Folders) != 1 || tree.Folders[0] != "open" ||
+		len(tree.Pads) != 1 || tree.Pads[0] != "c" {
+		t.Fatalf("guest tree %+v", tree)
+	}
+	if tree := CacherPadTree(guest, "tree/closed"); len(tree.Pads) != 0 {
+		t.Fatalf("guest sees closed folder %+v", tree)
+	}
+	if tree := CacherPadTree(mod, "tree"); len(tree.Folders) != 2 {
+		t.Fatalf("moderator tree %+v", tree)
+	}
+
+	guest.Recent = []uint32{200, 201, 202}
+	for _, filter := range []uint32{PADLIST_FILTER_ALL, PADLIST_FILTER_RECENT} {
+		request := &CPadListRequest{Count: 10, Search: "tree/", Prefix: true, Filter: filter}
+		if page := CacherPadPage(guest, request); len(page.Pads) != 2 || page.Pads[0].Name == names[1] || page.Pads[1].Name == names[1] {
+			t.Fatalf("guest page of filter %d %+v", filter, page.Pads)
+		}
+		if page := CacherPadPage(mod, request); filter == PADLIST_FILTER_ALL && len(page.Pads) != 3 {
+			t.Fatalf("moderator page %+v", page.Pads)
+		}
+	}
+
+	c := &Client{User: guest, PadListSubscribed: true, Messages: make(chan interface{}, 1)}
+	GlobalClientsMutex.Lock()
+	clientIter := GlobalClients.PushBack(c)
+	GlobalClientsMutex.Unlock()
+	defer func() {
+		GlobalClientsMutex.Lock()
+		GlobalClients.Remove(clientIter)
+		GlobalClientsMutex.Unlock()
+	}()
+	CacherSendPadList(&SPadList{Pads: names}, nil)
+	if list := (<-c.Messages).(*SPadList); len(list.Pads) != 2 || list.Pads[1] != names[2] {
+		t.Fatalf("guest is told about %v", list.Pads)
+	}
+	CacherSendPadList(&SPadList{Removed: names[1:2]}, nil)
+	if len(c.Messages) != 0 {
+		t.Fatal("guest is told about removal of a closed pad")
+	}
+}
+
+func TestClientCheckErrors(t *testing.T) {
+	c := &Client{Messages: make(chan interface{}, 10)}
+	m := &CMessage{&CMessage_Undo{&CUndo{}}}
+	c.requestSeq, c.request = 3, requestName(m)
+	expect := func(ok bool, code uint32) {
+		if ok != (code == 0) {
+			t.Fatal("check returned", ok, "for code", code)
+		}
+		if code == 0 {
+			if len(c.Messages) != 0 {
+				t.Fatal("unexpected error", <-c.Messages)
+			}
+			return
+		}
+		err := (<-c.Messages).(*SError)
+		if err.Code != code || err.Message != errorMessages[code] || err.RequestSeq != 3 || err.Request != "Undo" {
+			t.Fatalf("got %+v want code %d", err, code)
+		}
+	}
+	expect(c.CheckPad(0), ERROR_NOT_LOGGED_IN)
+	c.User = &User{Id: 1, Perms: PERM_CHAT}
+	expect(c.CheckUser(0), 0)
+	expect(c.CheckUser(PERM_MOD), ERROR_PERMISSION_DENIED)
+	expect(c.CheckPad(0), ERROR_NOT_IN_PAD)
+	p := testPad()
+	p.Name = "error/test"
+	c.Pad = p
+	expect(c.CheckPad(PERM_WRITE|PERM_CHAT), 0)
+	expect(c.CheckPad(PERM_WRITE), ERROR_PERMISSION_DENIED)
+}
+
+func TestClientHello(t *testing.T) {
+	c := &Client{Messages: make(chan interface{}, 10)}
+	if reason := c.Hello(&CHello{PROTOCOL_VERSION + 1, 0, ""}); reason == "" || c.Version != 0 {
+		t.Fatal("newer protocol version accepted")
+	}
+	if reason := c.Hello(&CHello{PROTOCOL_VERSION, CAP_PRESENCE | CAP_COMPRESSION | 1024, ""}); reason != "" {
+		t.Fatal(reason)
+	}
+	hello := (<-c.Messages).(*SHello)
+	if c.Version != PROTOCOL_VERSION || hello.Capabilities != c.Capabilities ||
+		!c.HasCapability(CAP_PRESENCE) || c.HasCapability(CAP_ACKS) || c.Capabilities&^serverCapabilities != 0 {
+		t.Fatalf("negotiated %+v, capabilities %b", hello, c.Capabilities)
+	}
+	c = &Client{Messages: make(chan interface{}, 10)}
+	if reason := c.Hello(&CHello{PROTOCOL_VERSION, 0, ""}); reason != "" || !c.HasCapability(CAP_PRESENCE) {
+		t.Fatal("client without capabilities has no presence", reason)
+	}
+}
+
+func TestClientCoalesceDeltas(t *testing.T) {
+	p := testPad()
+	retain := &PMeta{}
+	testPadAppend(t, p, 2, DeltaAddInsert(nil, []rune("hello"), retain, false), DELTA_EDIT)
+	testPadAppend(t, p, 2, DeltaAddInsert(DeltaAddRetain(nil, 5, retain), []rune(" world"), retain, false), DELTA_EDIT)
+	testPadAppend(t, p, 3, DeltaAddInsert(DeltaAddRetain(nil, 11, retain), []rune("!"), retain, false), DELTA_EDIT)
+	c := &Client{UserId: 1, Pad: p, Capabilities: CAP_COALESCE, pc: &ClientPadContext{SentUsers: map[uint32]bool{}}}
+	buffer := []*SMessage{}
+	buffer = c.WritePumpProcessChan(p.DeltaArray[0], buffer)
+	buffer = c.WritePumpProcessChan(p.DeltaArray[1], buffer)
+	if len(buffer) != 1 || buffer[0].GetDelta().Id != 2 || buffer[0].GetDelta().Count != 2 {
+		t.Fatalf("deltas of one author not coalesced %v", buffer)
+	}
+	if text := string(DeltaApply(c.pc.coalesceDelta.Ops, p.DocumentArray[0].Rope).Text()); text != "hello world" {
+		t.Fatalf("coalesced delta gives %q", text)
+	}
+	buffer = c.WritePumpProcessChan(p.DeltaArray[2], buffer)
+	if len(buffer) != 2 || buffer[1].GetDelta().Id != 3 || buffer[1].GetDelta().Count != 1 {
+		t.Fatalf("deltas of another author coalesced %v", buffer)
+	}
+	c.Capabilities = 0
+	c.pc = &ClientPadContext{SentUsers: map[uint32]bool{}}
+	buffer = c.WritePumpProcessChan(p.DeltaArray[0], []*SMessage{})
+	buffer = c.WritePumpProcessChan(p.DeltaArray[1], buffer)
+	if len(buffer) != 2 {
+		t.Fatalf("deltas coalesced without capability %v", buffer)
+	}
+}
+
+func TestPadPurgeRestore(t *testing.T) {
+	one := &PMeta{Changemask: 32, User: testUsers[0]}
+	p := testPad()
+	p.Id, p.Name = 300, "purge/test"
+	testPadAppend(t, p, 1, DeltaAddInsert(nil, []rune("hello"), one, false), DELTA_EDIT)
+	PadMutex.Lock()
+	PadMap[p.Name] = p
+	ShareMap["purge"] = &PShare{"purge", p.Id, false}
+	PadMutex.Unlock()
+	defer func() {
+		PadMutex.Lock()
+		delete(PadMap, p.Name)
+		ShareMap = map[string]*PShare{}
+		PadMutex.Unlock()
+	}()
+
+	if pad, _ := cacherRestorePad(p.Name); pad != nil {
+		t.Fatal("pad restored without being deleted")
+	}
+	p.DeleteTime = time.Unix(1000, 0)
+	if pad, _ := cacherRestorePad(p.Name); pad != p || !p.DeleteTime.IsZero() {
+		t.Fatalf("deleted pad not restored %v", p.DeleteTime)
+	}
+
+	if cacherPurgePad(p.Name) != p || PadMap[p.Name] != nil || ShareMap["purge"] != nil || p.DeleteTime.IsZero() {
+		t.Fatal("purged pad left in maps")
+	}
+	if cacherPurgePad(p.Name) != nil {
+		t.Fatal("pad purged twice")
+	}
+	p.purgeHistory()
+	if p.DeltaCounter != 0 || len(p.DeltaArray) != 0 || testPadText(p) != "" {
+		t.Fatalf("purged pad keeps revision %d %q", p.DeltaCounter, testPadText(p))
+	}
+	// a delta racing with the purge still applies to revision 0
+	testPadAppend(t, p, 1, DeltaAddInsert(nil, []rune("late"), one, false), DELTA_EDIT)
+	if testPadText(p) != "late" {
+		t.Fatalf("delta after purge gives %q", testPadText(p))
+	}
+}
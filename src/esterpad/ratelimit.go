@@ -0,0 +1,204 @@
+/*
+Esterpad online collaborative editor
+Copyright (C) 2017 Anon2Anon
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package esterpad
+
+import (
+	. "esterpad_utils"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	RATE_CHAT       = 0
+	RATE_DELTA      = 1
+	RATE_AUTH       = 2
+	RATE_PAD_CREATE = 3
+	RATE_WARNING    = 4
+	rateKinds       = 5
+)
+
+// RateLimit allows Burst actions at once refilled with Rate per second.
+type RateLimit struct {
+	Rate  float64
+	Burst float64
+}
+
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type rateKey struct {
+	kind  int
+	scope string
+}
+
+var (
+	rateLogger = LogInit("rate")
+	rateLimits = [rateKinds]RateLimit{
+		RATE_CHAT:       {1, 10},
+		RATE_DELTA:      {30, 300},
+		RATE_AUTH:       {0.1, 5},
+		RATE_PAD_CREATE: {0.05, 10},
+		RATE_WARNING:    {1.0 / 60, 5},
+	}
+	rateNames = [rateKinds]string{
+		RATE_CHAT:       "chat",
+		RATE_DELTA:      "delta",
+		RATE_AUTH:       "auth",
+		RATE_PAD_CREATE: "pad-create",
+		RATE_WARNING:    "warning",
+	}
+	// rateIpFactor scales limits of an IP which may be shared by many users.
+	rateIpFactor float64 = 4
+	rateBuckets          = map[rateKey]*rateBucket{}
+	rateMutex            = &sync.Mutex{}
+)
+
+// take takes a token from bucket refilled by limit, a zero bucket is full.
+func (b *rateBucket) take(limit RateLimit, now time.Time) bool {
+	if b.last.IsZero() {
+		b.tokens = limit.Burst
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * limit.Rate
+		if b.tokens > limit.Burst {
+			b.tokens = limit.Burst
+		}
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// RateTake takes a token of kind from the shared bucket of scope.
+func RateTake(kind int, scope string, factor float64) bool {
+	limit := rateLimits[kind]
+	limit.Rate *= factor
+	limit.Burst *= factor
+	key := rateKey{kind, scope}
+	rateMutex.Lock()
+	bucket := rateBuckets[key]
+	if bucket == nil {
+		bucket = &rateBucket{}
+		rateBuckets[key] = bucket
+	}
+	ok := bucket.take(limit, time.Now())
+	rateMutex.Unlock()
+	return ok
+}
+
+// RateAllow takes a token of kind for the connection, its user and its IP.
+func (c *Client) RateAllow(kind int) bool {
+	ok := c.rateBuckets[kind].take(rateLimits[kind], time.Now())
+	if c.UserId != 0 {
+		ok = RateTake(kind, "user:"+strconv.FormatUint(uint64(c.UserId), 10), 1) && ok
+	}
+	if len(c.Ip) > 0 {
+		ok = RateTake(kind, "ip:"+c.Ip, rateIpFactor) && ok
+	}
+	return ok
+}
+
+// RateWarn counts a throttled action of kind, it returns false when the
+// client ran out of warnings and should be dropped.
+func (c *Client) RateWarn(kind int) bool {
+	rateLogger.Log(LOG_WARNING, c.UserId, c.Ip, "rate limit exceeded", rateNames[kind])
+	if !c.RateAllow(RATE_WARNING) {
+		rateLogger.Log(LOG_WARNING, c.UserId, c.Ip, "disconnect flooding client")
+		return false
+	}
+	return true
+}
+
+// SendRateLimited fails the throttled request m of kind, m is the CMessage
+// field like *CMessage_Chat. A dropped delta is reported with SDeltaDropped
+// so the client reverts it.
+func (c *Client) SendRateLimited(m interface{}, kind int) {
+	reason := "too many " + rateNames[kind] + " requests"
+	if delta, ok := m.(*CMessage_Delta); ok {
+		c.SendDeltaDropped(delta.Delta.Revision, reason)
+	} else {
+		c.SendError(ERROR_RATE_LIMITED, reason)
+	}
+}
+
+// RateLoginAllow throttles login attempts to one account from any address.
+func RateLoginAllow(email string) bool {
+	return RateTake(RATE_AUTH, "login:"+strings.ToLower(strings.TrimSpace(email)), 1)
+}
+
+// rateKind returns the rate limit kind of a client message or -1.
+func rateKind(m *CMessage) int {
+	switch m.CMessage.(type) {
+	case *CMessage_Chat:
+		return RATE_CHAT
+	case *CMessage_Delta:
+		return RATE_DELTA
+	case *CMessage_Login, *CMessage_Register, *CMessage_GuestLogin:
+		return RATE_AUTH
+	}
+	return -1
+}
+
+func rateCleanup() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		rateMutex.Lock()
+		for key, bucket := range rateBuckets {
+			limit := rateLimits[key.kind]
+			if now.Sub(bucket.last).Seconds()*limit.Rate >= limit.Burst*rateIpFactor {
+				delete(rateBuckets, key)
+			}
+		}
+		rateMutex.Unlock()
+	}
+}
+
+func RateInit() {
+	for kind, name := range rateNames {
+		value, ok := Config["rate"][name].(string)
+		if !ok {
+			continue
+		}
+		parts := strings.Split(value, "/")
+		if len(parts) == 2 {
+			rate, err1 := strconv.ParseFloat(parts[0], 64)
+			burst, err2 := strconv.ParseFloat(parts[1], 64)
+			if err1 == nil && err2 == nil && rate > 0 && burst >= 1 {
+				rateLimits[kind] = RateLimit{rate, burst}
+				continue
+			}
+		}
+		rateLogger.Log(LOG_ERROR, "invalid rate limit", name, value)
+	}
+	if value, ok := Config["rate"]["ip-factor"].(string); ok {
+		if factor, err := strconv.ParseFloat(value, 64); err == nil && factor >= 1 {
+			rateIpFactor = factor
+		} else {
+			rateLogger.Log(LOG_ERROR, "invalid rate ip factor", value)
+		}
+	}
+	go rateCleanup()
+}
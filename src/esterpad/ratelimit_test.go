@@ -0,0 +1,68 @@
+/*
+Esterpad online collaborative editor
+Copyright (C) 2017 Anon2Anon
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package esterpad
+
+import (
+	. "esterpad_utils"
+	"testing"
+	"time"
+)
+
+func TestRateBucket(t *testing.T) {
+	limit := RateLimit{2, 3}
+	bucket := rateBucket{}
+	now := time.Unix(1000, 0)
+	for i := 0; i < 3; i++ {
+		if !bucket.take(limit, now) {
+			t.Fatal("burst token", i, "not taken")
+		}
+	}
+	if bucket.take(limit, now) {
+		t.Fatal("token taken over burst")
+	}
+	now = now.Add(500 * time.Millisecond)
+	if !bucket.take(limit, now) {
+		t.Fatal("refilled token not taken")
+	}
+	if bucket.take(limit, now) {
+		t.Fatal("token taken before refill")
+	}
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		if !bucket.take(limit, now) {
+			t.Fatal("token", i, "not taken after long idle")
+		}
+	}
+	if bucket.take(limit, now) {
+		t.Fatal("refill exceeded burst")
+	}
+}
+
+func TestSendRateLimited(t *testing.T) {
+	c := &Client{Messages: make(chan interface{}, 10)}
+	c.SendRateLimited(&CMessage_Chat{&CChat{}}, RATE_CHAT)
+	if err := (<-c.Messages).(*SError); err.Code != ERROR_RATE_LIMITED || !c.requestAnswered {
+		t.Fatalf("throttled chat got %+v", err)
+	}
+	c.requestAnswered = false
+	c.SendRateLimited(&CMessage_Delta{&CDelta{Revision: 7}}, RATE_DELTA)
+	if dropped := (<-c.Messages).(*SDeltaDropped); dropped.Revision != 7 || !c.requestAnswered {
+		t.Fatalf("throttled delta got %+v", dropped)
+	}
+}
@@ -0,0 +1,205 @@
+/*
+Esterpad online collaborative editor
+Copyright (C) 2017 Anon2Anon
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package esterpad
+
+// Small leaves with equal meta are merged on append, larger ones are only
+// resliced so every revision shares their text with the previous one.
+const ropeLeafSize = 512
+
+// Rope is an immutable document: a height balanced tree whose leaves are
+// runs of text with the same meta. Revisions share untouched subtrees.
+type Rope struct {
+	root *ropeNode
+}
+
+type ropeNode struct {
+	left   *ropeNode
+	right  *ropeNode
+	text   []rune
+	meta   *PMeta
+	length uint32
+	height int
+}
+
+func ropeHeight(n *ropeNode) int {
+	if n == nil {
+		return 0
+	}
+	return n.height
+}
+
+func ropeLength(n *ropeNode) uint32 {
+	if n == nil {
+		return 0
+	}
+	return n.length
+}
+
+func ropeLeaf(text []rune, meta *PMeta) *ropeNode {
+	if len(text) == 0 {
+		return nil
+	}
+	return &ropeNode{text: text, meta: meta, length: uint32(len(text)), height: 1}
+}
+
+func ropeNew(left *ropeNode, right *ropeNode) *ropeNode {
+	height := left.height
+	if right.height > height {
+		height = right.height
+	}
+	return &ropeNode{left: left, right: right, length: left.length + right.length, height: height + 1}
+}
+
+func ropeBalance(left *ropeNode, right *ropeNode) *ropeNode {
+	hl := ropeHeight(left)
+	hr := ropeHeight(right)
+	if hl > hr+1 {
+		if ropeHeight(left.left) >= ropeHeight(left.right) {
+			return ropeNew(left.left, ropeNew(left.right, right))
+		}
+		return ropeNew(ropeNew(left.left, left.right.left), ropeNew(left.right.right, right))
+	}
+	if hr > hl+1 {
+		if ropeHeight(right.right) >= ropeHeight(right.left) {
+			return ropeNew(ropeNew(left, right.left), right.right)
+		}
+		return ropeNew(ropeNew(left, right.left.left), ropeNew(right.left.right, right.right))
+	}
+	return ropeNew(left, right)
+}
+
+func ropeJoin(left *ropeNode, right *ropeNode) *ropeNode {
+	if left == nil {
+		return right
+	}
+	if right == nil {
+		return left
+	}
+	if left.height > right.height+1 {
+		return ropeBalance(left.left, ropeJoin(left.right, right))
+	}
+	if right.height > left.height+1 {
+		return ropeBalance(ropeJoin(left, right.left), right.right)
+	}
+	return ropeNew(left, right)
+}
+
+func ropeSplit(n *ropeNode, pos uint32) (*ropeNode, *ropeNode) {
+	if n == nil || pos == 0 {
+		return nil, n
+	}
+	if pos >= n.length {
+		return n, nil
+	}
+	if n.left == nil {
+		return ropeLeaf(n.text[:pos], n.meta), ropeLeaf(n.text[pos:], n.meta)
+	}
+	if pos == n.left.length {
+		return n.left, n.right
+	}
+	if pos < n.left.length {
+		left, right := ropeSplit(n.left, pos)
+		return left, ropeJoin(right, n.right)
+	}
+	left, right := ropeSplit(n.right, pos-n.left.length)
+	return ropeJoin(n.left, left), right
+}
+
+func ropeLast(n *ropeNode) *ropeNode {
+	for n != nil && n.right != nil {
+		n = n.right
+	}
+	return n
+}
+
+func ropeAppend(n *ropeNode, text []rune, meta *PMeta) *ropeNode {
+	if len(text) == 0 {
+		return n
+	}
+	if last := ropeLast(n); last != nil && *last.meta == *meta && len(last.text)+len(text) <= ropeLeafSize {
+		merged := make([]rune, len(last.text)+len(text))
+		copy(merged, last.text)
+		copy(merged[len(last.text):], text)
+		left, _ := ropeSplit(n, n.length-last.length)
+		return ropeJoin(left, ropeLeaf(merged, last.meta))
+	}
+	return ropeJoin(n, ropeLeaf(text, meta))
+}
+
+func ropeEach(n *ropeNode, from uint32, to uint32, f func(text []rune, meta *PMeta)) {
+	if n == nil || from >= to {
+		return
+	}
+	if n.left == nil {
+		f(n.text[from:to], n.meta)
+		return
+	}
+	if from < n.left.length {
+		end := to
+		if end > n.left.length {
+			end = n.left.length
+		}
+		ropeEach(n.left, from, end, f)
+	}
+	if to > n.left.length {
+		start := uint32(0)
+		if from > n.left.length {
+			start = from - n.left.length
+		}
+		ropeEach(n.right, start, to-n.left.length, f)
+	}
+}
+
+func RopeFromOps(ops []POp) *Rope {
+	root := (*ropeNode)(nil)
+	for _, op := range ops {
+		if op.Type == OP_INSERT {
+			root = ropeAppend(root, op.Text, op.Meta)
+		}
+	}
+	return &Rope{root}
+}
+
+func (r *Rope) Len() uint32 {
+	return ropeLength(r.root)
+}
+
+// Each calls f for every run of text between from and to.
+func (r *Rope) Each(from uint32, to uint32, f func(text []rune, meta *PMeta)) {
+	if to > r.Len() {
+		to = r.Len()
+	}
+	ropeEach(r.root, from, to, f)
+}
+
+func (r *Rope) Text() []rune {
+	ret := make([]rune, 0, r.Len())
+	r.Each(0, r.Len(), func(text []rune, meta *PMeta) {
+		ret = append(ret, text...)
+	})
+	return ret
+}
+
+func (r *Rope) Ops() []POp {
+	ret := []POp{}
+	r.Each(0, r.Len(), func(text []rune, meta *PMeta) {
+		ret = DeltaAddInsert(ret, text, meta, true)
+	})
+	return ret
+}
@@ -0,0 +1,88 @@
+/*
+Esterpad online collaborative editor
+Copyright (C) 2017 Anon2Anon
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package esterpad
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func testRopeCheck(t *testing.T, n *ropeNode) {
+	if n == nil || n.left == nil {
+		return
+	}
+	if n.right == nil {
+		t.Fatal("node with one child")
+	}
+	hl, hr := n.left.height, n.right.height
+	if hl > hr+1 || hr > hl+1 {
+		t.Fatalf("unbalanced node %d/%d", hl, hr)
+	}
+	if n.length != n.left.length+n.right.length {
+		t.Fatal("wrong node length")
+	}
+	testRopeCheck(t, n.left)
+	testRopeCheck(t, n.right)
+}
+
+func TestRope(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	metas := []*PMeta{{}, {Changemask: 1, Bold: true}}
+	document := &Rope{}
+	text := []rune{}
+	revisions := []*Rope{}
+	texts := []string{}
+	for i := 0; i < 3000; i++ {
+		pos := uint32(r.Intn(int(document.Len()) + 1))
+		switch r.Intn(3) {
+		case 0:
+			n := uint32(r.Intn(int(document.Len()-pos) + 1))
+			delta := DeltaAddRetain(nil, pos, &PMeta{})
+			delta = DeltaAddDelete(delta, n)
+			document = DeltaApply(DeltaAddRetain(delta, document.Len()-pos-n, &PMeta{}), document)
+			text = append(text[:pos:pos], text[pos+n:]...)
+		default:
+			insert := testRandomText(r)
+			delta := DeltaAddRetain(nil, pos, &PMeta{})
+			delta = DeltaAddInsert(delta, insert, metas[r.Intn(len(metas))], false)
+			document = DeltaApply(DeltaAddRetain(delta, document.Len()-pos, &PMeta{}), document)
+			text = append(text[:pos:pos], append(insert, text[pos:]...)...)
+		}
+		testRopeCheck(t, document.root)
+		if string(document.Text()) != string(text) {
+			t.Fatalf("step %d: got %q, want %q", i, string(document.Text()), string(text))
+		}
+		revisions = append(revisions, document)
+		texts = append(texts, string(text))
+	}
+	for i, revision := range revisions {
+		if string(revision.Text()) != texts[i] {
+			t.Fatalf("revision %d was modified", i)
+		}
+	}
+	from := document.Len() / 3
+	to := from * 2
+	part := []rune{}
+	document.Each(from, to, func(text []rune, meta *PMeta) {
+		part = append(part, text...)
+	})
+	if string(part) != string(text[from:to]) {
+		t.Fatal("wrong range iteration")
+	}
+}
@@ -0,0 +1,144 @@
+/*
+Esterpad online collaborative editor
+Copyright (C) 2017 Anon2Anon
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package esterpad
+
+import (
+	"esterpad_client"
+	. "esterpad_utils"
+	"math/rand"
+	"testing"
+)
+
+type testSdkClient struct {
+	userId    uint32
+	document  *esterpad_client.Document
+	delivered int
+}
+
+type testSdkSent struct {
+	client *testSdkClient
+	delta  *CDelta
+}
+
+func testSdkOps(r *rand.Rand, length uint32) []*Op {
+	ops := []*Op{}
+	for length > 0 {
+		n := 1 + uint32(r.Intn(4))
+		if n > length {
+			n = length
+		}
+		switch r.Intn(4) {
+		case 0:
+			ops = esterpad_client.AddInsert(ops, string(testRandomText(r)), nil)
+		case 1:
+			ops = esterpad_client.AddDelete(ops, n)
+			length -= n
+		default:
+			ops = esterpad_client.AddRetain(ops, n, nil)
+			length -= n
+		}
+	}
+	if r.Intn(2) == 0 {
+		ops = esterpad_client.AddInsert(ops, string(testRandomText(r)), nil)
+	}
+	return ops
+}
+
+// TestSdkDocumentConverges runs documents of esterpad_client against the
+// server rebasing client deltas with DeltaTransform, in random order of
+// local edits, server processing and delivery.
+func TestSdkDocumentConverges(t *testing.T) {
+	for seed := 0; seed < testIterations; seed++ {
+		r := rand.New(rand.NewSource(int64(seed)))
+		document := RopeFromOps(DeltaAddInsert(nil, []rune("hello world"), &PMeta{}, false))
+		history := [][]POp{}
+		sdeltas := []*SDelta{}
+		clients := []*testSdkClient{}
+		for _, user := range testUsers {
+			d := esterpad_client.NewDocument()
+			if err := d.Reset(&SDocument{0, DeltaToProtobuf(document.Ops()), 0}); err != nil {
+				t.Fatal(err)
+			}
+			clients = append(clients, &testSdkClient{user.Id, d, 0})
+		}
+		queue := []testSdkSent{}
+		edits := 8
+		pending := func() bool {
+			for _, c := range clients {
+				if c.delivered < len(sdeltas) {
+					return true
+				}
+			}
+			return edits > 0 || len(queue) > 0
+		}
+		for pending() {
+			c := clients[r.Intn(len(clients))]
+			switch r.Intn(3) {
+			case 0:
+				if edits == 0 {
+					continue
+				}
+				edits--
+				cdelta, err := c.document.ApplyLocal(testSdkOps(r, uint32(c.document.Len())))
+				if err != nil {
+					t.Fatalf("seed %d: local delta: %v", seed, err)
+				}
+				if cdelta != nil {
+					queue = append(queue, testSdkSent{c, cdelta})
+				}
+			case 1:
+				if len(queue) == 0 {
+					continue
+				}
+				sent := queue[0]
+				queue = queue[1:]
+				ops, reason := DeltaValidateFromClient(sent.delta.Ops, false, sent.client.userId)
+				if ops == nil {
+					t.Fatalf("seed %d: invalid client delta: %s", seed, reason)
+				}
+				for _, concurrent := range history[sent.delta.Revision:] {
+					ops = DeltaTransform(ops, concurrent)
+				}
+				if document = DeltaApply(ops, document); document == nil {
+					t.Fatalf("seed %d: rebased delta %v doesn't apply", seed, DeltaToString(ops))
+				}
+				history = append(history, ops)
+				sdeltas = append(sdeltas, &SDelta{uint32(len(history)), sent.client.userId, DeltaToProtobuf(ops), 1})
+			case 2:
+				if c.delivered == len(sdeltas) {
+					continue
+				}
+				sdelta := sdeltas[c.delivered]
+				c.delivered++
+				_, cdelta, err := c.document.ApplyRemote(sdelta, sdelta.UserId == c.userId)
+				if err != nil {
+					t.Fatalf("seed %d: remote delta: %v", seed, err)
+				}
+				if cdelta != nil {
+					queue = append(queue, testSdkSent{c, cdelta})
+				}
+			}
+		}
+		for _, c := range clients {
+			if text := c.document.String(); text != string(document.Text()) {
+				t.Fatalf("seed %d: user %d has %q, server has %q", seed, c.userId, text, string(document.Text()))
+			}
+		}
+	}
+}
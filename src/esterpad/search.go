@@ -0,0 +1,484 @@
+/*
+Esterpad online collaborative editor
+Copyright (C) 2017 Anon2Anon
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package esterpad
+
+import (
+	. "esterpad_utils"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+const (
+	searchSnippetRadius = 40
+	searchMaxResults    = 100
+)
+
+type searchKey struct {
+	PadId uint32
+	Chat  bool
+}
+
+type searchPadState struct {
+	Pad           *Pad
+	Words         map[string]uint32
+	Revision      uint32
+	ChatWords     map[string]uint32
+	ChatIndexed   uint32
+	DocumentDirty bool
+	ChatDirty     bool
+}
+
+// searchSpan is a range changed by a delta in the old and the new document.
+type searchSpan struct {
+	OldStart uint32
+	OldEnd   uint32
+	NewStart uint32
+	NewEnd   uint32
+}
+
+var (
+	searchLogger      = LogInit("search")
+	searchIndex       = map[string]map[searchKey]uint32{}
+	searchPads        = map[uint32]*searchPadState{}
+	searchMutex       = &sync.RWMutex{}
+	searchPending     = map[uint32]*searchPadState{}
+	searchPendingLock = &sync.Mutex{}
+	searchSignal      = make(chan bool, 1)
+	searchChat        = false
+)
+
+func searchWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+func SearchTokenize(text []rune) []string {
+	ret := []string{}
+	start := -1
+	for i, r := range text {
+		if searchWordRune(r) {
+			if start < 0 {
+				start = i
+			}
+		} else if start >= 0 {
+			ret = append(ret, strings.ToLower(string(text[start:i])))
+			start = -1
+		}
+	}
+	if start >= 0 {
+		ret = append(ret, strings.ToLower(string(text[start:])))
+	}
+	return ret
+}
+
+func searchMarkDirty(p *Pad, chat bool) {
+	searchPendingLock.Lock()
+	state := searchPending[p.Id]
+	if state == nil {
+		state = &searchPadState{Pad: p}
+		searchPending[p.Id] = state
+	}
+	if chat {
+		state.ChatDirty = true
+	} else {
+		state.DocumentDirty = true
+	}
+	searchPendingLock.Unlock()
+	select {
+	case searchSignal <- true:
+	default:
+	}
+}
+
+func SearchUpdatePad(p *Pad) {
+	searchMarkDirty(p, false)
+}
+
+func SearchUpdateChat(p *Pad) {
+	if searchChat {
+		searchMarkDirty(p, true)
+	}
+}
+
+func SearchRemovePad(padId uint32) {
+	searchPendingLock.Lock()
+	delete(searchPending, padId)
+	searchPendingLock.Unlock()
+	searchMutex.Lock()
+	if state := searchPads[padId]; state != nil {
+		searchApplyWords(searchKey{padId, false}, state.Words, nil)
+		searchApplyWords(searchKey{padId, true}, state.ChatWords, nil)
+		delete(searchPads, padId)
+	}
+	searchMutex.Unlock()
+}
+
+func searchApplyWords(key searchKey, oldWords map[string]uint32, newWords map[string]uint32) {
+	for word := range oldWords {
+		if _, exist := newWords[word]; !exist {
+			searchSetCount(key, word, 0)
+		}
+	}
+	for word, count := range newWords {
+		searchSetCount(key, word, count)
+	}
+}
+
+func searchCountWords(words []string, to map[string]uint32) map[string]uint32 {
+	if to == nil {
+		to = map[string]uint32{}
+	}
+	for _, word := range words {
+		to[word]++
+	}
+	return to
+}
+
+// searchSetCount sets count of word in key, zero count removes it.
+func searchSetCount(key searchKey, word string, count uint32) {
+	postings := searchIndex[word]
+	if count == 0 {
+		delete(postings, key)
+		if len(postings) == 0 {
+			delete(searchIndex, word)
+		}
+		return
+	}
+	if postings == nil {
+		postings = map[searchKey]uint32{}
+		searchIndex[word] = postings
+	}
+	postings[key] = count
+}
+
+func searchRuneAt(r *Rope, pos uint32) rune {
+	ret := rune(0)
+	r.Each(pos, pos+1, func(text []rune, meta *PMeta) {
+		ret = text[0]
+	})
+	return ret
+}
+
+func searchRopeText(r *Rope, from uint32, to uint32) []rune {
+	ret := make([]rune, 0, to-from)
+	r.Each(from, to, func(text []rune, meta *PMeta) {
+		ret = append(ret, text...)
+	})
+	return ret
+}
+
+// searchDeltaSpans returns ranges of document old changed by ops, they are
+// widened to word boundaries so no word crosses their ends.
+func searchDeltaSpans(ops []POp, old *Rope) []searchSpan {
+	spans := []searchSpan{}
+	oldPos, newPos := uint32(0), uint32(0)
+	open := false
+	for _, op := range ops {
+		if op.Type == OP_RETAIN {
+			oldPos += op.Len
+			newPos += op.Len
+			open = false
+			continue
+		}
+		if !open {
+			spans = append(spans, searchSpan{oldPos, oldPos, newPos, newPos})
+			open = true
+		}
+		if op.Type == OP_INSERT {
+			newPos += op.Len
+		} else {
+			oldPos += op.Len
+		}
+		spans[len(spans)-1].OldEnd, spans[len(spans)-1].NewEnd = oldPos, newPos
+	}
+	ret := []searchSpan{}
+	for _, span := range spans {
+		for span.OldStart > 0 && searchWordRune(searchRuneAt(old, span.OldStart-1)) {
+			span.OldStart--
+			span.NewStart--
+		}
+		for span.OldEnd < old.Len() && searchWordRune(searchRuneAt(old, span.OldEnd)) {
+			span.OldEnd++
+			span.NewEnd++
+		}
+		if n := len(ret); n > 0 && span.OldStart <= ret[n-1].OldEnd {
+			ret[n-1].OldEnd, ret[n-1].NewEnd = span.OldEnd, span.NewEnd
+		} else {
+			ret = append(ret, span)
+		}
+	}
+	return ret
+}
+
+// searchDeltaWords adds changes of word counts made by ops to diff, only
+// the changed ranges of the documents are tokenized.
+func searchDeltaWords(ops []POp, oldDocument *Rope, newDocument *Rope, diff map[string]int64) {
+	for _, span := range searchDeltaSpans(ops, oldDocument) {
+		for _, word := range SearchTokenize(searchRopeText(oldDocument, span.OldStart, span.OldEnd)) {
+			diff[word]--
+		}
+		for _, word := range SearchTokenize(searchRopeText(newDocument, span.NewStart, span.NewEnd)) {
+			diff[word]++
+		}
+	}
+}
+
+// searchIndexDocument indexes revisions of p since the last indexed one,
+// the whole document is tokenized only when the pad is indexed first.
+func searchIndexDocument(p *Pad, state *searchPadState) {
+	p.DeltaMutex.RLock()
+	revision := p.DeltaCounter
+	documents := p.DocumentArray
+	deltas := p.DeltaArray
+	p.DeltaMutex.RUnlock()
+	searchMutex.RLock()
+	from := state.Revision
+	searchMutex.RUnlock()
+	if uint32(len(documents)) <= revision || from == revision {
+		return
+	}
+
+	key := searchKey{p.Id, false}
+	if from == 0 || from > revision {
+		newWords := searchCountWords(SearchTokenize(documents[revision].Rope.Text()), nil)
+		searchMutex.Lock()
+		searchApplyWords(key, state.Words, newWords)
+		state.Words = newWords
+		state.Revision = revision
+		searchMutex.Unlock()
+		return
+	}
+	diff := map[string]int64{}
+	for rev := from; rev < revision; rev++ {
+		searchDeltaWords(deltas[rev].Ops, documents[rev].Rope, documents[rev+1].Rope, diff)
+	}
+	searchMutex.Lock()
+	for word, change := range diff {
+		if change == 0 {
+			continue
+		}
+		count := int64(state.Words[word]) + change
+		if count <= 0 {
+			delete(state.Words, word)
+			count = 0
+		} else {
+			state.Words[word] = uint32(count)
+		}
+		searchSetCount(key, word, uint32(count))
+	}
+	state.Revision = revision
+	searchMutex.Unlock()
+}
+
+func searchIndexPad(pending *searchPadState) {
+	p := pending.Pad
+	searchMutex.Lock()
+	state := searchPads[p.Id]
+	if state == nil {
+		state = &searchPadState{Pad: p, Words: map[string]uint32{}, ChatWords: map[string]uint32{}}
+		searchPads[p.Id] = state
+	}
+	chatFrom := state.ChatIndexed
+	searchMutex.Unlock()
+	if pending.DocumentDirty {
+		searchIndexDocument(p, state)
+	}
+
+	chatWords := map[string]uint32(nil)
+	chatIndexed := chatFrom
+	if pending.ChatDirty {
+		chatWords = map[string]uint32{}
+		for _, pchat := range p.CopyChat(^uint32(0)) {
+			if pchat != nil && pchat.Id > chatIndexed {
+				searchCountWords(SearchTokenize([]rune(pchat.Text)), chatWords)
+				chatIndexed = pchat.Id
+			}
+		}
+	}
+
+	searchMutex.Lock()
+	for word, count := range chatWords {
+		state.ChatWords[word] += count
+		searchSetCount(searchKey{p.Id, true}, word, state.ChatWords[word])
+	}
+	state.ChatIndexed = chatIndexed
+	searchMutex.Unlock()
+}
+
+func SearchHandler() {
+	for range searchSignal {
+		searchPendingLock.Lock()
+		pending := searchPending
+		searchPending = map[uint32]*searchPadState{}
+		searchPendingLock.Unlock()
+		for _, state := range pending {
+			searchIndexPad(state)
+		}
+	}
+}
+
+func SearchInit() {
+	if chat, ok := Config["search"]["chat"].(string); ok {
+		searchChat, _ = strconv.ParseBool(chat)
+	}
+	PadMutex.RLock()
+	for _, p := range PadMap {
+		searchMarkDirty(p, false)
+		if searchChat {
+			searchMarkDirty(p, true)
+		}
+	}
+	PadMutex.RUnlock()
+	go SearchHandler()
+}
+
+func searchSnippet(text []rune, words []string) (string, []uint32) {
+	lower := []rune(strings.ToLower(string(text)))
+	if len(lower) != len(text) {
+		lower = text
+	}
+	first := -1
+	for _, word := range words {
+		if i := runeIndex(lower, []rune(word), 0); i >= 0 && (first < 0 || i < first) {
+			first = i
+		}
+	}
+	if first < 0 {
+		first = 0
+	}
+	start := first - searchSnippetRadius
+	if start < 0 {
+		start = 0
+	}
+	end := first + searchSnippetRadius
+	if end > len(text) {
+		end = len(text)
+	}
+	highlights := []uint32{}
+	window := lower[start:end]
+	for _, word := range words {
+		wordRunes := []rune(word)
+		for i := runeIndex(window, wordRunes, 0); i >= 0; i = runeIndex(window, wordRunes, i+len(wordRunes)) {
+			highlights = append(highlights, uint32(i), uint32(i+len(wordRunes)))
+		}
+	}
+	return string(text[start:end]), highlights
+}
+
+func runeIndex(text []rune, word []rune, from int) int {
+	for i := from; i+len(word) <= len(text); i++ {
+		match := true
+		for j, r := range word {
+			if text[i+j] != r {
+				match = false
+				break
+			}
+		}
+		if match {
+			return i
+		}
+	}
+	return -1
+}
+
+func Search(user *User, query string, count uint32, chat bool) *SSearchResults {
+	ret := &SSearchResults{Query: query, Results: []*SSearchResult{}}
+	words := SearchTokenize([]rune(query))
+	if len(words) == 0 {
+		return ret
+	}
+	if count == 0 || count > searchMaxResults {
+		count = searchMaxResults
+	}
+	scores := map[searchKey]uint32{}
+	searchMutex.RLock()
+	for i, word := range words {
+		postings := searchIndex[word]
+		for key, hits := range postings {
+			if key.Chat && !chat {
+				continue
+			}
+			if i == 0 {
+				scores[key] = hits
+			} else if score, exist := scores[key]; exist {
+				scores[key] = score + hits
+			}
+		}
+		for key := range scores {
+			if _, exist := postings[key]; !exist {
+				delete(scores, key)
+			}
+		}
+	}
+	pads := map[uint32]*Pad{}
+	for key := range scores {
+		if state := searchPads[key.PadId]; state != nil {
+			pads[key.PadId] = state.Pad
+		}
+	}
+	searchMutex.RUnlock()
+
+	keys := []searchKey{}
+	names := map[uint32]string{}
+	PadMutex.RLock()
+	for key := range scores {
+		p := pads[key.PadId]
+		if p == nil || PadMap[p.Name] != p || !cacherPadVisible(user, p.Name, p) {
+			continue
+		}
+		names[p.Id] = p.Name
+		keys = append(keys, key)
+	}
+	PadMutex.RUnlock()
+	sort.Slice(keys, func(i, j int) bool {
+		if scores[keys[i]] != scores[keys[j]] {
+			return scores[keys[i]] > scores[keys[j]]
+		}
+		return names[keys[i].PadId] < names[keys[j].PadId]
+	})
+	if uint32(len(keys)) > count {
+		keys = keys[:count]
+	}
+
+	for _, key := range keys {
+		p := pads[key.PadId]
+		result := &SSearchResult{Pad: names[key.PadId], Chat: key.Chat}
+		if key.Chat {
+			for _, pchat := range p.CopyChat(^uint32(0)) {
+				if pchat == nil {
+					continue
+				}
+				snippet, highlights := searchSnippet([]rune(pchat.Text), words)
+				if len(highlights) > 0 {
+					result.ChatId = pchat.Id
+					result.Snippet = snippet
+					result.Highlights = highlights
+				}
+			}
+		} else if document := p.CopyDocument(); document != nil {
+			result.Revision = document.Revision
+			result.Snippet, result.Highlights = searchSnippet(document.Rope.Text(), words)
+		}
+		ret.Results = append(ret.Results, result)
+	}
+	searchLogger.Log(LOG_INFO, user.Id, "search", query, len(ret.Results))
+	return ret
+}
@@ -0,0 +1,48 @@
+/*
+Esterpad online collaborative editor
+Copyright (C) 2017 Anon2Anon
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package esterpad
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestSearchIndexIncremental(t *testing.T) {
+	for seed := 0; seed < testIterations; seed++ {
+		r := rand.New(rand.NewSource(int64(seed)))
+		p := testPad()
+		p.Id = 300
+		state := &searchPadState{Pad: p, Words: map[string]uint32{}}
+		for i := 0; i < 4; i++ {
+			for j := r.Intn(4); j >= 0; j-- {
+				length := p.DocumentArray[p.DeltaCounter].Rope.Len()
+				testPadAppend(t, p, 1, testRandomDelta(r, length), DELTA_EDIT)
+			}
+			searchIndexDocument(p, state)
+			want := searchCountWords(SearchTokenize(p.DocumentArray[p.DeltaCounter].Rope.Text()), nil)
+			if !reflect.DeepEqual(state.Words, want) {
+				t.Fatalf("seed %d: indexed %v want %v", seed, state.Words, want)
+			}
+		}
+		searchMutex.Lock()
+		searchApplyWords(searchKey{p.Id, false}, state.Words, nil)
+		searchMutex.Unlock()
+	}
+}
@@ -0,0 +1,157 @@
+/*
+Esterpad online collaborative editor
+Copyright (C) 2017 Anon2Anon
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package esterpad
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	. "esterpad_utils"
+	"sort"
+)
+
+// PShare is a share link token giving access to one pad, write links also
+// allow to edit it and to chat. Shares are guarded by PadMutex.
+type PShare struct {
+	Token string
+	PadId uint32
+	Write bool
+}
+
+var ShareMap = map[string]*PShare{}
+
+func sharePerms(share *PShare) uint32 {
+	if share.Write {
+		return PERM_CHAT | PERM_WRITE
+	}
+	return 0
+}
+
+// CacherCanEnterPad returns whether user may open pad with share token,
+// private pads are open only to moderators and with their share links.
+func CacherCanEnterPad(user *User, pad *Pad, token string) bool {
+	if user.Perms&(PERM_MOD|PERM_ADMIN) != 0 {
+		return true
+	}
+	PadMutex.RLock()
+	defer PadMutex.RUnlock()
+	if share := ShareMap[token]; share != nil && share.PadId == pad.Id {
+		return true
+	}
+	return !pad.Private
+}
+
+// CacherGetSharePad returns the pad of share token or nil.
+func CacherGetSharePad(token string) *Pad {
+	PadMutex.RLock()
+	defer PadMutex.RUnlock()
+	share := ShareMap[token]
+	if share == nil {
+		return nil
+	}
+	for _, pad := range PadMap {
+		if pad.Id == share.PadId && pad.DeleteTime.IsZero() {
+			return pad
+		}
+	}
+	return nil
+}
+
+func CacherCreateShare(name string, write bool) bool {
+	tokenBytes := [16]byte{}
+	if _, err := rand.Read(tokenBytes[:]); err != nil {
+		cacherLogger.Log(LOG_ERROR, "share token gen err", err)
+		return false
+	}
+	PadMutex.Lock()
+	pad := PadMap[name]
+	if pad == nil || !pad.DeleteTime.IsZero() {
+		PadMutex.Unlock()
+		return false
+	}
+	share := &PShare{hex.EncodeToString(tokenBytes[:]), pad.Id, write}
+	ShareMap[share.Token] = share
+	PadMutex.Unlock()
+	cacherLogger.Log(LOG_INFO, "create share", pad.Id, name, write)
+	MongoInsertShare(share)
+	return true
+}
+
+// CacherRevokeShare removes share token of pad name and kicks clients who
+// can't stay in the pad without it.
+func CacherRevokeShare(name string, token string) bool {
+	PadMutex.Lock()
+	pad := PadMap[name]
+	share := ShareMap[token]
+	if pad == nil || share == nil || share.PadId != pad.Id {
+		PadMutex.Unlock()
+		return false
+	}
+	delete(ShareMap, token)
+	PadMutex.Unlock()
+	cacherLogger.Log(LOG_INFO, "revoke share", pad.Id, name)
+	MongoRemoveShare(token)
+	pad.KickDenied()
+	return true
+}
+
+func CacherPadShares(name string) *SShareList {
+	ret := &SShareList{Name: name, Shares: []*SShare{}}
+	PadMutex.RLock()
+	if pad := PadMap[name]; pad != nil {
+		for _, share := range ShareMap {
+			if share.PadId == pad.Id {
+				ret.Shares = append(ret.Shares, &SShare{share.Token, share.Write})
+			}
+		}
+	}
+	PadMutex.RUnlock()
+	sort.Slice(ret.Shares, func(i, j int) bool {
+		return ret.Shares[i].Token < ret.Shares[j].Token
+	})
+	return ret
+}
+
+// CacherSetPadFlags makes pad name read-only or private for everyone but
+// moderators.
+func CacherSetPadFlags(name string, readOnly bool, private bool) bool {
+	PadMutex.Lock()
+	pad := PadMap[name]
+	if pad == nil || !pad.DeleteTime.IsZero() {
+		PadMutex.Unlock()
+		return false
+	}
+	pad.ReadOnly = readOnly
+	pad.Private = private
+	PadMutex.Unlock()
+	cacherLogger.Log(LOG_INFO, "set pad flags", pad.Id, name, readOnly, private)
+	MongoSetPadFlags(pad.Id, readOnly, private)
+	pad.KickDenied()
+	pad.SendPadState()
+	return true
+}
+
+func (c *Client) AddPadState(buffer []*SMessage) []*SMessage {
+	PadMutex.RLock()
+	smessage := &SPadState{c.Pad.Name, c.Pad.ReadOnly, c.Pad.Private, 0}
+	PadMutex.RUnlock()
+	smessage.Perms = c.PadPerms()
+	clientLogger.Log(LOG_INFO, c.UserId, "send pad state", smessage)
+	SMessageOneOf := &SMessage_PadState{smessage}
+	return append(buffer, &SMessage{SMessageOneOf})
+}
@@ -0,0 +1,252 @@
+/*
+Esterpad online collaborative editor
+Copyright (C) 2017 Anon2Anon
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package esterpad
+
+import (
+	. "esterpad_utils"
+	"strings"
+	"time"
+)
+
+const commentMaxLen = 10000
+
+type PComment struct {
+	Id   uint32
+	User *User
+	Text string
+	Time time.Time
+}
+
+// PThread is a discussion anchored to range From..To of document Revision.
+// Threads broadcast to clients are copies, the pad ones are guarded by
+// ThreadMutex.
+type PThread struct {
+	Id       uint32
+	Revision uint32
+	From     uint32
+	To       uint32
+	Resolved bool
+	Comments []*PComment
+}
+
+func (p *Pad) ThreadLoad() {
+	threadIter := p.ThreadCollection.Find(nil).Sort("_id").Iter()
+	thread := MongoThread{}
+	for threadIter.Next(&thread) {
+		for i := uint32(len(p.ThreadArray)) + 1; i < thread.Id; i++ {
+			p.ThreadArray = append(p.ThreadArray, nil)
+		}
+		pthread := &PThread{thread.Id, thread.Revision, thread.From, thread.To, thread.Resolved, []*PComment{}}
+		for _, comment := range thread.Comments {
+			pthread.Comments = append(pthread.Comments, &PComment{comment.Id, CacherGetUser(comment.UserId), comment.Text, comment.Time})
+		}
+		if pthread.Revision > p.DeltaCounter {
+			pthread.Revision, pthread.From, pthread.To = p.DeltaCounter, 0, 0
+		}
+		p.ThreadArray = append(p.ThreadArray, pthread)
+	}
+	if err := threadIter.Close(); err != nil {
+		padLogger.Log(LOG_ERROR, p.Id, "mongo find err", err)
+	}
+}
+
+// threadAnchor transforms the anchor of thread through revisions made since
+// it was set. ThreadMutex should be locked.
+func (p *Pad) threadAnchor(thread *PThread) {
+	p.DeltaMutex.RLock()
+	thread.Revision, thread.From, thread.To = p.transformRange(thread.Revision, thread.From, thread.To)
+	p.DeltaMutex.RUnlock()
+}
+
+// transformRange transforms range from..to of document rev to the last
+// revision, text inserted at the bounds stays outside of the range.
+// DeltaMutex should be locked.
+func (p *Pad) transformRange(rev uint32, from uint32, to uint32) (uint32, uint32, uint32) {
+	for ; rev < p.DeltaCounter; rev++ {
+		ops := p.DeltaArray[rev].Ops
+		from = DeltaTransformPosition(ops, from, false)
+		to = DeltaTransformPosition(ops, to, true)
+		if to < from {
+			to = from
+		}
+	}
+	return rev, from, to
+}
+
+func (thread *PThread) Copy() *PThread {
+	ret := *thread
+	ret.Comments = append([]*PComment{}, thread.Comments...)
+	return &ret
+}
+
+func commentText(text string) string {
+	text = strings.TrimSpace(text)
+	if runes := []rune(text); len(runes) > commentMaxLen {
+		text = string(runes[:commentMaxLen])
+	}
+	return text
+}
+
+func (p *Pad) CreateThread(c *Client, message *CThreadCreate) {
+	padLogger.Log(LOG_INFO, p.Id, c.UserId, "process create thread message", message.Revision, message.From, message.To)
+	text := commentText(message.Text)
+	if len(text) == 0 {
+		c.SendError(ERROR_INVALID_REQUEST, "comment is empty")
+		return
+	}
+	from, to := message.From, message.To
+	p.DeltaMutex.RLock()
+	if message.Revision > p.DeltaCounter {
+		p.DeltaMutex.RUnlock()
+		c.SendError(ERROR_NOT_FOUND, "no such revision")
+		return
+	}
+	document := p.DocumentArray[message.Revision].Rope
+	p.DeltaMutex.RUnlock()
+	if c.OffsetUnit == OFFSET_UNIT_UTF16 {
+		var okFrom, okTo bool
+		from, okFrom = DeltaOffsetFromUtf16(from, document)
+		to, okTo = DeltaOffsetFromUtf16(to, document)
+		if !okFrom || !okTo {
+			c.SendError(ERROR_INVALID_REQUEST, "range splits a surrogate pair or is out of the document")
+			return
+		}
+	}
+	if from > to || to > document.Len() {
+		c.SendError(ERROR_INVALID_REQUEST, "range is out of the document")
+		return
+	}
+	thread := &PThread{Revision: message.Revision, From: from, To: to,
+		Comments: []*PComment{&PComment{1, c.User, text, time.Now()}}}
+	p.ThreadMutex.Lock()
+	thread.Id = uint32(len(p.ThreadArray)) + 1
+	p.ThreadArray = append(p.ThreadArray, thread)
+	p.threadAnchor(thread)
+	thread = thread.Copy()
+	p.CacherChannel <- thread
+	p.ThreadMutex.Unlock()
+	p.broadcastThread(thread)
+}
+
+func (p *Pad) ReplyThread(c *Client, message *CThreadReply) {
+	padLogger.Log(LOG_INFO, p.Id, c.UserId, "process reply thread message", message.ThreadId)
+	text := commentText(message.Text)
+	if len(text) == 0 {
+		c.SendError(ERROR_INVALID_REQUEST, "comment is empty")
+		return
+	}
+	p.ThreadMutex.Lock()
+	thread := p.threadById(message.ThreadId)
+	if thread == nil {
+		p.ThreadMutex.Unlock()
+		c.SendError(ERROR_NOT_FOUND, "no such thread")
+		return
+	}
+	thread.Comments = append(thread.Comments, &PComment{uint32(len(thread.Comments)) + 1, c.User, text, time.Now()})
+	p.threadAnchor(thread)
+	thread = thread.Copy()
+	p.CacherChannel <- thread
+	p.ThreadMutex.Unlock()
+	p.broadcastThread(thread)
+}
+
+// ResolveThread resolves or reopens a thread, this is allowed to the user
+// who started it and to users who may edit text of others.
+func (p *Pad) ResolveThread(c *Client, message *CThreadResolve) {
+	padLogger.Log(LOG_INFO, p.Id, c.UserId, "process resolve thread message", message.ThreadId, message.Resolved)
+	canEdit := c.PadPerms()&PERM_EDIT != 0
+	p.ThreadMutex.Lock()
+	thread := p.threadById(message.ThreadId)
+	if thread == nil {
+		p.ThreadMutex.Unlock()
+		c.SendError(ERROR_NOT_FOUND, "no such thread")
+		return
+	}
+	if !canEdit && thread.Comments[0].User != c.User {
+		p.ThreadMutex.Unlock()
+		c.SendError(ERROR_PERMISSION_DENIED, "only the author of a thread may resolve it")
+		return
+	}
+	if thread.Resolved == message.Resolved {
+		p.ThreadMutex.Unlock()
+		c.SendError(ERROR_NOTHING_TO_DO, "")
+		return
+	}
+	thread.Resolved = message.Resolved
+	p.threadAnchor(thread)
+	thread = thread.Copy()
+	p.CacherChannel <- thread
+	p.ThreadMutex.Unlock()
+	p.broadcastThread(thread)
+}
+
+// threadById returns thread by id or nil. ThreadMutex should be locked.
+func (p *Pad) threadById(id uint32) *PThread {
+	if id == 0 || id > uint32(len(p.ThreadArray)) {
+		return nil
+	}
+	return p.ThreadArray[id-1]
+}
+
+func (p *Pad) broadcastThread(thread *PThread) {
+	p.ClientsMutex.RLock()
+	for clientIter := p.Clients.Front(); clientIter != nil; clientIter = clientIter.Next() {
+		neighbor := clientIter.Value.(*Client)
+		select {
+		case neighbor.Messages <- thread:
+		default:
+		}
+	}
+	p.ClientsMutex.RUnlock()
+}
+
+// CopyThreads returns copies of all threads anchored to the last revision.
+func (p *Pad) CopyThreads() []*PThread {
+	ret := []*PThread{}
+	p.ThreadMutex.Lock()
+	for _, thread := range p.ThreadArray {
+		if thread != nil {
+			p.threadAnchor(thread)
+			ret = append(ret, thread.Copy())
+		}
+	}
+	p.ThreadMutex.Unlock()
+	return ret
+}
+
+func (c *Client) AddThread(buffer []*SMessage, thread *PThread) []*SMessage {
+	smessage := &SThread{thread.Id, thread.Revision, thread.From, thread.To, thread.Resolved, []*SComment{}}
+	if c.pc.OffsetUnit == OFFSET_UNIT_UTF16 {
+		if document := c.Pad.CopyDocumentRevision(thread.Revision); document != nil {
+			smessage.From = DeltaOffsetToUtf16(thread.From, document.Rope)
+			smessage.To = DeltaOffsetToUtf16(thread.To, document.Rope)
+		}
+	}
+	for _, comment := range thread.Comments {
+		scomment := &SComment{comment.Id, 0, comment.Text, comment.Time.Unix()}
+		if comment.User != nil {
+			buffer = c.AddUserInfo(buffer, comment.User)
+			scomment.UserId = comment.User.Id
+		}
+		smessage.Comments = append(smessage.Comments, scomment)
+	}
+	clientLogger.Log(LOG_INFO, c.UserId, "send thread message", smessage.Id, smessage.Revision)
+	SMessageOneOf := &SMessage_Thread{smessage}
+	return append(buffer, &SMessage{SMessageOneOf})
+}
@@ -0,0 +1,223 @@
+/*
+Esterpad online collaborative editor
+Copyright (C) 2017 Anon2Anon
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package esterpad
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const uploadPrefix = "/.upload/"
+
+var (
+	uploadLogger    = LogInit("upload")
+	uploadDirectory = "upload"
+	uploadMaxSize   = int64(10 * 1024 * 1024)
+	uploadInline    = map[string]bool{"image/png": true, "image/jpeg": true, "image/gif": true, "image/webp": true}
+)
+
+type UploadResult struct {
+	Ref  string `json:"ref"`
+	Name string `json:"name"`
+}
+
+func UploadInit() {
+	if directory, ok := Config["upload"]["directory"].(string); ok {
+		uploadDirectory = directory
+	}
+	if size, ok := Config["upload"]["max-size"].(string); ok {
+		if maxSize, err := strconv.ParseInt(size, 10, 64); err == nil {
+			uploadMaxSize = maxSize
+		} else {
+			uploadLogger.Log(LOG_ERROR, "invalid upload max size", size, err)
+		}
+	}
+}
+
+// UploadRefValid tells if ref points to a blob stored by the upload handler.
+func UploadRefValid(ref string) bool {
+	parts := strings.Split(strings.TrimPrefix(ref, uploadPrefix), "/")
+	if !strings.HasPrefix(ref, uploadPrefix) || len(parts) != 2 || len(parts[1]) != sha256.Size*2 {
+		return false
+	}
+	if _, err := strconv.ParseUint(parts[0], 10, 32); err != nil {
+		return false
+	}
+	_, err := hex.DecodeString(parts[1])
+	return err == nil
+}
+
+func uploadPadDirectory(padId uint32) string {
+	return filepath.Join(uploadDirectory, strconv.FormatUint(uint64(padId), 10))
+}
+
+func UploadPurgePad(padId uint32) {
+	if err := os.RemoveAll(uploadPadDirectory(padId)); err != nil {
+		uploadLogger.Log(LOG_ERROR, "remove pad uploads err", padId, err)
+	}
+}
+
+func uploadPadById(padId uint32) *Pad {
+	PadMutex.RLock()
+	defer PadMutex.RUnlock()
+	for _, pad := range PadMap {
+		if pad.Id == padId {
+			return pad
+		}
+	}
+	return nil
+}
+
+// HttpUpload stores a file sent as multipart form field "file" for the pad
+// named by "pad", the user needs write permission in that pad or a write
+// share token in "share".
+func HttpUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "405 Method not allowed", 405)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, uploadMaxSize+1024*1024)
+	sessInfo := httpSession(r)
+	if sessInfo == nil {
+		http.Error(w, "403 Forbidden", http.StatusForbidden)
+		return
+	}
+	name := CacherCheckPadName(r.FormValue("pad"))
+	PadMutex.RLock()
+	pad := PadMap[name]
+	deleted := pad == nil || !pad.DeleteTime.IsZero()
+	PadMutex.RUnlock()
+	if deleted || CacherUserPadPerms(sessInfo.User, name, r.FormValue("share"))&PERM_WRITE == 0 {
+		http.Error(w, "403 Forbidden", http.StatusForbidden)
+		return
+	}
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "400 Bad Request", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	directory := uploadPadDirectory(pad.Id)
+	if err := os.MkdirAll(directory, 0750); err != nil {
+		uploadLogger.Log(LOG_ERROR, "mkdir err", directory, err)
+		http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	tmp, err := ioutil.TempFile(directory, ".tmp")
+	if err != nil {
+		uploadLogger.Log(LOG_ERROR, "create temp file err", directory, err)
+		http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), io.LimitReader(file, uploadMaxSize+1))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		uploadLogger.Log(LOG_ERROR, "write upload err", tmp.Name(), err)
+		http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if size > uploadMaxSize {
+		http.Error(w, "413 Request Entity Too Large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if err := os.Rename(tmp.Name(), filepath.Join(directory, sum)); err != nil {
+		uploadLogger.Log(LOG_ERROR, "rename upload err", tmp.Name(), err)
+		http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	uploadLogger.Log(LOG_INFO, "stored upload", pad.Id, sessInfo.User.Id, sum, size)
+	result := UploadResult{uploadPrefix + strconv.FormatUint(uint64(pad.Id), 10) + "/" + sum, filepath.Base(header.Filename)}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		uploadLogger.Log(LOG_ERROR, "json encode err", err)
+	}
+}
+
+// uploadCanRead returns whether user may read files of pad, that is enter
+// it with share token, files of deleted pads are for moderators only.
+func uploadCanRead(user *User, pad *Pad, token string) bool {
+	if pad.IsDeleted() && user.Perms&PERM_MOD == 0 {
+		return false
+	}
+	return CacherCanEnterPad(user, pad, token)
+}
+
+// HttpUploaded serves a stored blob to users who may enter its pad, a share
+// token of a private pad is taken from "share".
+func HttpUploaded(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "405 Method not allowed", 405)
+		return
+	}
+	if !UploadRefValid(r.URL.Path) {
+		http.Error(w, "404 Page not found", http.StatusNotFound)
+		return
+	}
+	sessInfo := httpSession(r)
+	if sessInfo == nil {
+		http.Error(w, "403 Forbidden", http.StatusForbidden)
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, uploadPrefix), "/")
+	padId, _ := strconv.ParseUint(parts[0], 10, 32)
+	pad := uploadPadById(uint32(padId))
+	if pad == nil || !uploadCanRead(sessInfo.User, pad, r.FormValue("share")) {
+		http.Error(w, "404 Page not found", http.StatusNotFound)
+		return
+	}
+	f, err := os.Open(filepath.Join(uploadPadDirectory(pad.Id), parts[1]))
+	if err != nil {
+		http.Error(w, "404 Page not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	d, err := f.Stat()
+	if err != nil {
+		http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(f, head)
+	contentType := http.DetectContentType(head[:n])
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if !uploadInline[contentType] {
+		contentType = "application/octet-stream"
+		w.Header().Set("Content-Disposition", "attachment")
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "private, max-age=31536000, immutable")
+	http.ServeContent(w, r, "", d.ModTime(), f)
+}
@@ -0,0 +1,97 @@
+/*
+Esterpad online collaborative editor
+Copyright (C) 2017 Anon2Anon
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package esterpad
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUploadedPerms(t *testing.T) {
+	directory, err := ioutil.TempDir("", "esterpad-upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	uploadDirectory = directory
+	p := testPad()
+	p.Id, p.Name, p.Private = 200, "upload/test", true
+	sum := strings.Repeat("ab", 32)
+	if err := os.MkdirAll(uploadPadDirectory(p.Id), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(uploadPadDirectory(p.Id), sum), []byte("secret"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	guest := [16]byte{1}
+	mod := [16]byte{2}
+	PadMutex.Lock()
+	PadMap[p.Name] = p
+	ShareMap["read"] = &PShare{"read", p.Id, false}
+	PadMutex.Unlock()
+	ClientSessionsMutex.Lock()
+	ClientSessions[guest] = &SessionInfo{User: &User{Id: 20, Perms: PERM_CHAT}}
+	ClientSessions[mod] = &SessionInfo{User: &User{Id: 21, Perms: PERM_NOTGUEST | PERM_MOD}}
+	ClientSessionsMutex.Unlock()
+	defer func() {
+		PadMutex.Lock()
+		delete(PadMap, p.Name)
+		ShareMap = map[string]*PShare{}
+		PadMutex.Unlock()
+		ClientSessionsMutex.Lock()
+		delete(ClientSessions, guest)
+		delete(ClientSessions, mod)
+		ClientSessionsMutex.Unlock()
+	}()
+
+	get := func(session [16]byte, query string) int {
+		r := httptest.NewRequest("GET", "/.upload/200/"+sum+query, nil)
+		r.Header.Set(httpSessionHeader, hex.EncodeToString(session[:]))
+		w := httptest.NewRecorder()
+		HttpUploaded(w, r)
+		return w.Code
+	}
+	for _, test := range []struct {
+		session [16]byte
+		query   string
+		code    int
+	}{
+		{guest, "", http.StatusNotFound},
+		{guest, "?share=other", http.StatusNotFound},
+		{guest, "?share=read", http.StatusOK},
+		{mod, "", http.StatusOK},
+	} {
+		if code := get(test.session, test.query); code != test.code {
+			t.Fatalf("session %d, query %q: code %d, want %d", test.session[0], test.query, code, test.code)
+		}
+	}
+	PadMutex.Lock()
+	p.DeleteTime = time.Now()
+	PadMutex.Unlock()
+	if get(guest, "?share=read") != http.StatusNotFound || get(mod, "") != http.StatusOK {
+		t.Fatal("files of a deleted pad are not for moderators only")
+	}
+}
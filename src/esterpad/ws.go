@@ -19,36 +19,75 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 package esterpad
 
 import (
+	"bytes"
+	. "esterpad_utils"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
 	"github.com/gorilla/websocket"
 	"net/http"
 	"strconv"
 	"strings"
 )
 
+// Websocket subprotocols select the wire format, binary protobuf is used if
+// the client asks for none.
+const (
+	WS_PROTOCOL_PROTOBUF = "esterpad.protobuf"
+	WS_PROTOCOL_JSON     = "esterpad.json"
+)
+
 var (
 	wsLogger = LogInit("ws")
 	upgrader = websocket.Upgrader{
-		ReadBufferSize:  1024,
-		WriteBufferSize: 1024,
+		ReadBufferSize:    1024,
+		WriteBufferSize:   1024,
+		EnableCompression: true,
+		Subprotocols:      []string{WS_PROTOCOL_PROTOBUF, WS_PROTOCOL_JSON},
 		CheckOrigin: func(r *http.Request) bool {
 			return true
 		}, //TODO fix
 	}
+	wsJsonMarshaler   = &jsonpb.Marshaler{}
+	wsJsonUnmarshaler = &jsonpb.Unmarshaler{AllowUnknownFields: true}
 )
 
-func WsHandler(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		wsLogger.Log(LOG_ERROR, "upgrader.Upgrade", err)
-		return
+// WsMarshal encodes messages in the wire format of the client, JSON goes in
+// text frames and protobuf in binary ones.
+func (c *Client) WsMarshal(messages *SMessages) (int, []byte, error) {
+	if c.Json {
+		buffer := &bytes.Buffer{}
+		err := wsJsonMarshaler.Marshal(buffer, messages)
+		return websocket.TextMessage, buffer.Bytes(), err
 	}
-	defer conn.Close()
+	data, err := proto.Marshal(messages)
+	return websocket.BinaryMessage, data, err
+}
+
+func (c *Client) WsUnmarshal(data []byte, messages *CMessages) error {
+	if c.Json {
+		return wsJsonUnmarshaler.Unmarshal(bytes.NewReader(data), messages)
+	}
+	return proto.Unmarshal(data, messages)
+}
+
+func WsHandler(w http.ResponseWriter, r *http.Request) {
 	ip := ""
 	if b, _ := strconv.ParseBool(Config["http"]["use-x-forwarded-for"].(string)); b {
 		ip = r.Header.Get("x-forwarded-for")
 	} else {
 		ip = r.RemoteAddr[:strings.IndexByte(r.RemoteAddr, ':')]
 	}
-	client := Client{Ip: ip, UserAgent: r.Header.Get("user-agent")}
+	if ban := BanFind(0, ip); ban != nil {
+		wsLogger.Log(LOG_INFO, "banned ip", ip, ban.Id)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		wsLogger.Log(LOG_ERROR, "upgrader.Upgrade", err)
+		return
+	}
+	defer conn.Close()
+	client := Client{Ip: ip, UserAgent: r.Header.Get("user-agent"), Json: conn.Subprotocol() == WS_PROTOCOL_JSON}
 	client.Process(conn)
 }
@@ -0,0 +1,470 @@
+/*
+Esterpad online collaborative editor
+Copyright (C) 2017 Anon2Anon
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package esterpad_client
+
+import (
+	"errors"
+	. "esterpad_utils"
+	"github.com/golang/protobuf/proto"
+	"github.com/gorilla/websocket"
+	"strings"
+	"sync"
+)
+
+// ProtocolVersion is the protocol version the client speaks.
+const ProtocolVersion = 1
+
+// Capabilities requested from the server in the hello.
+const (
+	CapPresence    = 1
+	CapAcks        = 2
+	CapCompression = 4
+	CapCoalesce    = 8
+)
+
+var (
+	ErrNotInPad   = errors.New("not in pad")
+	ErrOutOfRange = errors.New("position out of range")
+	ErrPending    = errors.New("local changes are not acknowledged yet")
+)
+
+type Callbacks struct {
+	OnAuth         func(auth *SAuth)
+	OnError        func(err *SError)
+	OnHello        func(hello *SHello)
+	OnAck          func(requestSeq uint32)
+	OnChat         func(chat *SChat)
+	OnDelta        func(delta *SDelta)
+	OnDocument     func(document *Document)
+	OnDeltaDropped func(dropped *SDeltaDropped)
+	OnUserInfo     func(info *SUserInfo)
+	OnUserLeave    func(userId uint32)
+	OnPadList      func(list *SPadList)
+	OnThread       func(thread *SThread)
+	OnLock         func(lock *SLock)
+	OnPadState     func(state *SPadState)
+	OnShareList    func(list *SShareList)
+	OnBanList      func(list *SBanList)
+	OnMessage      func(message *SMessage)
+}
+
+type Client struct {
+	Callbacks
+	UserId     uint32
+	Nickname   string
+	Perms      uint32
+	SessId     string
+	Document   *Document
+	Users      map[uint32]*SUserInfo
+	UsersMutex sync.RWMutex
+	// Capabilities are enabled by the server for the connection.
+	Capabilities uint32
+	conn         *websocket.Conn
+	writeMutex   sync.Mutex
+	// pad and share are set by both Run and callers, padMutex guards them.
+	pad      string
+	share    string
+	padMutex sync.Mutex
+}
+
+func Dial(serverUrl string) (*Client, error) {
+	if strings.HasPrefix(serverUrl, "http://") {
+		serverUrl = "ws://" + serverUrl[7:]
+	} else if strings.HasPrefix(serverUrl, "https://") {
+		serverUrl = "wss://" + serverUrl[8:]
+	} else if !strings.HasPrefix(serverUrl, "ws://") && !strings.HasPrefix(serverUrl, "wss://") {
+		serverUrl = "ws://" + serverUrl
+	}
+	if !strings.HasSuffix(serverUrl, "/.ws") {
+		serverUrl = strings.TrimRight(serverUrl, "/") + "/.ws"
+	}
+	dialer := *websocket.DefaultDialer
+	dialer.EnableCompression = true
+	conn, _, err := dialer.Dial(serverUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{conn: conn, Document: NewDocument(), Users: map[uint32]*SUserInfo{}}
+	if err := c.Send(&CMessage{&CMessage_Hello{&CHello{ProtocolVersion, CapPresence | CapAcks | CapCompression | CapCoalesce, "esterpad_client"}}}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+func (c *Client) Send(messages ...*CMessage) error {
+	dataBytes, err := proto.Marshal(&CMessages{Cm: messages})
+	if err != nil {
+		return err
+	}
+	c.writeMutex.Lock()
+	err = c.conn.WriteMessage(websocket.BinaryMessage, dataBytes)
+	c.writeMutex.Unlock()
+	return err
+}
+
+func (c *Client) Session(sessId string) error {
+	return c.Send(&CMessage{&CMessage_Session{&CSession{sessId}}})
+}
+
+func (c *Client) Login(email string, password string) error {
+	return c.Send(&CMessage{&CMessage_Login{&CLogin{email, password}}})
+}
+
+func (c *Client) Register(email string, password string, nickname string) error {
+	return c.Send(&CMessage{&CMessage_Register{&CRegister{email, password, nickname}}})
+}
+
+func (c *Client) GuestLogin() error {
+	return c.Send(&CMessage{&CMessage_GuestLogin{&CGuestLogin{}}})
+}
+
+func (c *Client) Logout() error {
+	return c.Send(&CMessage{&CMessage_Logout{&CLogout{}}})
+}
+
+// PadName returns the name of the entered pad or an empty string.
+func (c *Client) PadName() string {
+	c.padMutex.Lock()
+	defer c.padMutex.Unlock()
+	return c.pad
+}
+
+// ShareToken returns the share link token the pad was entered with.
+func (c *Client) ShareToken() string {
+	c.padMutex.Lock()
+	defer c.padMutex.Unlock()
+	return c.share
+}
+
+func (c *Client) setPad(name string, token string) {
+	c.padMutex.Lock()
+	c.pad, c.share = name, token
+	c.padMutex.Unlock()
+}
+
+func (c *Client) EnterPad(name string) error {
+	c.setPad(name, "")
+	c.Document.Reset(&SDocument{})
+	return c.Send(&CMessage{&CMessage_EnterPad{&CEnterPad{name, 0, ""}}})
+}
+
+// EnterShare enters the pad of a share link token, the pad name is set when
+// the server sends the pad state.
+func (c *Client) EnterShare(token string) error {
+	c.setPad("", token)
+	c.Document.Reset(&SDocument{})
+	return c.Send(&CMessage{&CMessage_EnterPad{&CEnterPad{"", 0, token}}})
+}
+
+func (c *Client) SetPadFlags(name string, readOnly bool, private bool) error {
+	return c.Send(&CMessage{&CMessage_PadFlags{&CPadFlags{name, readOnly, private}}})
+}
+
+func (c *Client) CreateShare(name string, write bool) error {
+	return c.Send(&CMessage{&CMessage_ShareCreate{&CShareCreate{name, write}}})
+}
+
+func (c *Client) RevokeShare(name string, token string) error {
+	return c.Send(&CMessage{&CMessage_ShareRevoke{&CShareRevoke{name, token}}})
+}
+
+func (c *Client) RequestShares(name string) error {
+	return c.Send(&CMessage{&CMessage_ShareListRequest{&CShareListRequest{name}}})
+}
+
+// Ban bans userId or, if ip is set, an IP or a CIDR range for duration
+// seconds, zero duration bans forever.
+func (c *Client) Ban(userId uint32, ip string, duration uint32, reason string) error {
+	return c.Send(&CMessage{&CMessage_Ban{&CBan{userId, ip, duration, reason}}})
+}
+
+func (c *Client) Unban(banId uint32) error {
+	return c.Send(&CMessage{&CMessage_Unban{&CUnban{banId}}})
+}
+
+func (c *Client) RequestBans() error {
+	return c.Send(&CMessage{&CMessage_BanListRequest{&CBanListRequest{}}})
+}
+
+func (c *Client) Kick(userId uint32, ip string) error {
+	return c.Send(&CMessage{&CMessage_Kick{&CKick{userId, ip}}})
+}
+
+func (c *Client) LeavePad() error {
+	c.setPad("", "")
+	c.Document.Reset(&SDocument{})
+	return c.Send(&CMessage{&CMessage_LeavePad{&CLeavePad{}}})
+}
+
+func (c *Client) Chat(text string) error {
+	return c.Send(&CMessage{&CMessage_Chat{&CChat{text}}})
+}
+
+func (c *Client) Edit(ops []*Op) error {
+	if len(c.PadName()) == 0 {
+		return ErrNotInPad
+	}
+	delta, err := c.Document.ApplyLocal(ops)
+	if err != nil || delta == nil {
+		return err
+	}
+	return c.Send(&CMessage{&CMessage_Delta{delta}})
+}
+
+func (c *Client) EditFrom(base []rune, ops []*Op) error {
+	if len(c.PadName()) == 0 {
+		return ErrNotInPad
+	}
+	delta, err := c.Document.ApplyLocalFrom(base, ops)
+	if err != nil || delta == nil {
+		return err
+	}
+	return c.Send(&CMessage{&CMessage_Delta{delta}})
+}
+
+func (c *Client) Undo() error {
+	if len(c.PadName()) == 0 {
+		return ErrNotInPad
+	}
+	return c.Send(&CMessage{&CMessage_Undo{&CUndo{}}})
+}
+
+func (c *Client) Redo() error {
+	if len(c.PadName()) == 0 {
+		return ErrNotInPad
+	}
+	return c.Send(&CMessage{&CMessage_Redo{&CRedo{}}})
+}
+
+func (c *Client) CreateThread(from int, to int, text string) error {
+	if len(c.PadName()) == 0 {
+		return ErrNotInPad
+	}
+	c.Document.mutex.Lock()
+	revision, length, pending := c.Document.Revision, len(c.Document.Text), c.Document.Pending != nil
+	c.Document.mutex.Unlock()
+	if pending {
+		return ErrPending
+	}
+	if from < 0 || from > to || to > length {
+		return ErrOutOfRange
+	}
+	return c.Send(&CMessage{&CMessage_ThreadCreate{&CThreadCreate{revision, uint32(from), uint32(to), text}}})
+}
+
+func (c *Client) CreateLock(from int, to int) error {
+	if len(c.PadName()) == 0 {
+		return ErrNotInPad
+	}
+	c.Document.mutex.Lock()
+	revision, length, pending := c.Document.Revision, len(c.Document.Text), c.Document.Pending != nil
+	c.Document.mutex.Unlock()
+	if pending {
+		return ErrPending
+	}
+	if from < 0 || from >= to || to > length {
+		return ErrOutOfRange
+	}
+	return c.Send(&CMessage{&CMessage_LockCreate{&CLockCreate{revision, uint32(from), uint32(to)}}})
+}
+
+func (c *Client) RemoveLock(lockId uint32) error {
+	return c.Send(&CMessage{&CMessage_LockRemove{&CLockRemove{lockId}}})
+}
+
+func (c *Client) ReplyThread(threadId uint32, text string) error {
+	return c.Send(&CMessage{&CMessage_ThreadReply{&CThreadReply{threadId, text}}})
+}
+
+func (c *Client) ResolveThread(threadId uint32, resolved bool) error {
+	return c.Send(&CMessage{&CMessage_ThreadResolve{&CThreadResolve{threadId, resolved}}})
+}
+
+// ResolveSuggestions accepts or rejects suggestions of userId, or of everyone
+// if it is 0, in range from..to; an empty range means the whole document.
+func (c *Client) ResolveSuggestions(from uint32, to uint32, userId uint32, accept bool) error {
+	return c.Send(&CMessage{&CMessage_SuggestionResolve{&CSuggestionResolve{from, to, userId, accept}}})
+}
+
+func (c *Client) Insert(pos int, text string) error {
+	length := c.Document.Len()
+	if pos < 0 || pos > length {
+		return ErrOutOfRange
+	}
+	ops := AddRetain(nil, uint32(pos), nil)
+	ops = AddInsert(ops, text, nil)
+	ops = AddRetain(ops, uint32(length-pos), nil)
+	return c.Edit(ops)
+}
+
+func (c *Client) Delete(pos int, count int) error {
+	length := c.Document.Len()
+	if pos < 0 || count < 0 || pos+count > length {
+		return ErrOutOfRange
+	}
+	ops := AddRetain(nil, uint32(pos), nil)
+	ops = AddDelete(ops, uint32(count))
+	ops = AddRetain(ops, uint32(length-pos-count), nil)
+	return c.Edit(ops)
+}
+
+func (c *Client) User(userId uint32) *SUserInfo {
+	c.UsersMutex.RLock()
+	ret := c.Users[userId]
+	c.UsersMutex.RUnlock()
+	return ret
+}
+
+func (c *Client) Run() error {
+	for {
+		_, dataBytes, err := c.conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		messages := &SMessages{}
+		if err := proto.Unmarshal(dataBytes, messages); err != nil {
+			return err
+		}
+		for _, m := range messages.Sm {
+			if err := c.process(m); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (c *Client) process(m *SMessage) error {
+	switch sm := m.SMessage.(type) {
+	case *SMessage_Hello:
+		c.Capabilities = sm.Hello.Capabilities
+		if c.OnHello != nil {
+			c.OnHello(sm.Hello)
+		}
+	case *SMessage_Ack:
+		if sm.Ack.Revision != 0 {
+			c.Document.Ack(sm.Ack.Revision)
+		}
+		if c.OnAck != nil {
+			c.OnAck(sm.Ack.RequestSeq)
+		}
+	case *SMessage_Auth:
+		c.UserId = sm.Auth.UserId
+		c.Nickname = sm.Auth.Nickname
+		c.Perms = sm.Auth.Perms
+		if len(sm.Auth.SessId) > 0 {
+			c.SessId = sm.Auth.SessId
+		}
+		if c.OnAuth != nil {
+			c.OnAuth(sm.Auth)
+		}
+	case *SMessage_Error:
+		if c.OnError != nil {
+			c.OnError(sm.Error)
+		}
+	case *SMessage_Chat:
+		if c.OnChat != nil {
+			c.OnChat(sm.Chat)
+		}
+	case *SMessage_Document:
+		if err := c.Document.Reset(sm.Document); err != nil {
+			return err
+		}
+		if c.OnDocument != nil {
+			c.OnDocument(c.Document)
+		}
+	case *SMessage_Delta:
+		// with acks other connections of the user don't ack the pending delta
+		own := c.Capabilities&CapAcks == 0 && sm.Delta.UserId == c.UserId
+		applied, toSend, err := c.Document.ApplyRemote(sm.Delta, own)
+		if err != nil {
+			return err
+		}
+		if toSend != nil {
+			if err := c.Send(&CMessage{&CMessage_Delta{toSend}}); err != nil {
+				return err
+			}
+		}
+		if c.OnDelta != nil {
+			for _, delta := range applied {
+				c.OnDelta(delta)
+			}
+		}
+	case *SMessage_DeltaDropped:
+		if c.OnDeltaDropped != nil {
+			c.OnDeltaDropped(sm.DeltaDropped)
+		}
+		if share := c.ShareToken(); len(share) > 0 {
+			return c.EnterShare(share)
+		} else if pad := c.PadName(); len(pad) > 0 {
+			return c.EnterPad(pad)
+		}
+	case *SMessage_UserInfo:
+		c.UsersMutex.Lock()
+		c.Users[sm.UserInfo.UserId] = sm.UserInfo
+		c.UsersMutex.Unlock()
+		if c.OnUserInfo != nil {
+			c.OnUserInfo(sm.UserInfo)
+		}
+	case *SMessage_UserLeave:
+		c.UsersMutex.Lock()
+		if info := c.Users[sm.UserLeave.UserId]; info != nil {
+			info.Online = false
+		}
+		c.UsersMutex.Unlock()
+		if c.OnUserLeave != nil {
+			c.OnUserLeave(sm.UserLeave.UserId)
+		}
+	case *SMessage_PadList:
+		if c.OnPadList != nil {
+			c.OnPadList(sm.PadList)
+		}
+	case *SMessage_Thread:
+		if c.OnThread != nil {
+			c.OnThread(sm.Thread)
+		}
+	case *SMessage_PadState:
+		c.padMutex.Lock()
+		c.pad = sm.PadState.Name
+		c.padMutex.Unlock()
+		if c.OnPadState != nil {
+			c.OnPadState(sm.PadState)
+		}
+	case *SMessage_ShareList:
+		if c.OnShareList != nil {
+			c.OnShareList(sm.ShareList)
+		}
+	case *SMessage_BanList:
+		if c.OnBanList != nil {
+			c.OnBanList(sm.BanList)
+		}
+	case *SMessage_Lock:
+		if c.OnLock != nil {
+			c.OnLock(sm.Lock)
+		}
+	}
+	if c.OnMessage != nil {
+		c.OnMessage(m)
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+/*
+Esterpad online collaborative editor
+Copyright (C) 2017 Anon2Anon
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package esterpad_client
+
+import (
+	. "esterpad_utils"
+	"strings"
+)
+
+const (
+	diffEqual  = 0
+	diffDelete = 1
+	diffInsert = 2
+)
+
+func splitLines(text []rune) []string {
+	return strings.SplitAfter(string(text), "\n")
+}
+
+// diffMaxEdits bounds the edit distance diffLines searches for, the trace
+// of the search grows quadratically with it. Lines of files which differ
+// more are replaced whole.
+const diffMaxEdits = 1000
+
+func diffLines(a []string, b []string) []int {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	edits := make([]int, 0, len(a)+len(b))
+	for i := 0; i < prefix; i++ {
+		edits = append(edits, diffEqual)
+	}
+	edits = append(edits, diffMyers(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])...)
+	for i := 0; i < suffix; i++ {
+		edits = append(edits, diffEqual)
+	}
+	return edits
+}
+
+// diffMyers returns the shortest edit script turning a into b. The trace
+// keeps only the diagonals reached at every edit distance d.
+func diffMyers(a []string, b []string) []int {
+	n := len(a)
+	m := len(b)
+	max := n + m
+	offset := max + 1
+	v := make([]int, 2*max+3)
+	trace := [][]int{}
+	x, y := 0, 0
+search:
+	for d := 0; d <= max; d++ {
+		if d > diffMaxEdits {
+			return diffReplace(n, m)
+		}
+		// trace[d][k+d+1] is the furthest x on diagonal k before step d
+		trace = append(trace, append([]int(nil), v[offset-d-1:offset+d+2]...))
+		for k := -d; k <= d; k += 2 {
+			if k == -d || k != d && v[offset+k-1] < v[offset+k+1] {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y = x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				break search
+			}
+		}
+	}
+	edits := []int{}
+	x, y = n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := trace[d]
+		k := x - y
+		prevK := k - 1
+		if k == -d || k != d && v[k-1+d+1] < v[k+1+d+1] {
+			prevK = k + 1
+		}
+		prevX := v[prevK+d+1]
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			edits = append(edits, diffEqual)
+			x--
+			y--
+		}
+		if d > 0 {
+			if x == prevX {
+				edits = append(edits, diffInsert)
+				y--
+			} else {
+				edits = append(edits, diffDelete)
+				x--
+			}
+		}
+	}
+	for i, j := 0, len(edits)-1; i < j; i, j = i+1, j-1 {
+		edits[i], edits[j] = edits[j], edits[i]
+	}
+	return edits
+}
+
+func diffReplace(n int, m int) []int {
+	edits := make([]int, 0, n+m)
+	for i := 0; i < n; i++ {
+		edits = append(edits, diffDelete)
+	}
+	for i := 0; i < m; i++ {
+		edits = append(edits, diffInsert)
+	}
+	return edits
+}
+
+func diffHunk(ops []*Op, deleted []rune, inserted []rune) []*Op {
+	prefix := 0
+	for prefix < len(deleted) && prefix < len(inserted) && deleted[prefix] == inserted[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(deleted)-prefix && suffix < len(inserted)-prefix &&
+		deleted[len(deleted)-1-suffix] == inserted[len(inserted)-1-suffix] {
+		suffix++
+	}
+	ops = AddRetain(ops, uint32(prefix), nil)
+	ops = AddDelete(ops, uint32(len(deleted)-prefix-suffix))
+	ops = AddInsert(ops, string(inserted[prefix:len(inserted)-suffix]), nil)
+	return AddRetain(ops, uint32(suffix), nil)
+}
+
+func Diff(a []rune, b []rune) []*Op {
+	aLines := splitLines(a)
+	bLines := splitLines(b)
+	ops := []*Op{}
+	ai, bi := 0, 0
+	deleted := []rune{}
+	inserted := []rune{}
+	for _, edit := range diffLines(aLines, bLines) {
+		switch edit {
+		case diffEqual:
+			if len(deleted) > 0 || len(inserted) > 0 {
+				ops = diffHunk(ops, deleted, inserted)
+				deleted = deleted[:0]
+				inserted = inserted[:0]
+			}
+			ops = AddRetain(ops, uint32(len([]rune(aLines[ai]))), nil)
+			ai++
+			bi++
+		case diffDelete:
+			deleted = append(deleted, []rune(aLines[ai])...)
+			ai++
+		case diffInsert:
+			inserted = append(inserted, []rune(bLines[bi])...)
+			bi++
+		}
+	}
+	if len(deleted) > 0 || len(inserted) > 0 {
+		ops = diffHunk(ops, deleted, inserted)
+	}
+	return ops
+}
@@ -0,0 +1,58 @@
+/*
+Esterpad online collaborative editor
+Copyright (C) 2017 Anon2Anon
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package esterpad_client
+
+import (
+	"math/rand"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func testRandomLines(r *rand.Rand, n int) []rune {
+	lines := make([]string, n)
+	for i := range lines {
+		lines[i] = testRandomText(r) + "\n"
+	}
+	return []rune(strings.Join(lines, ""))
+}
+
+func TestDiff(t *testing.T) {
+	for seed := 0; seed < testIterations; seed++ {
+		r := rand.New(rand.NewSource(int64(seed)))
+		a := testRandomLines(r, r.Intn(20))
+		b := testRandomLines(r, r.Intn(20))
+		if got := testApply(t, seed, a, Diff(a, b)); string(got) != string(b) {
+			t.Fatalf("seed %d: diff gives %q want %q", seed, string(got), string(b))
+		}
+	}
+	// files differing in more lines than diffMaxEdits are replaced
+	a, b := []string{"same\n"}, []string{"same\n"}
+	for i := 0; i < diffMaxEdits; i++ {
+		a = append(a, "a"+strconv.Itoa(i)+"\n")
+		b = append(b, "b"+strconv.Itoa(i)+"\n")
+	}
+	if edits := diffLines(a, b); len(edits) != 2*diffMaxEdits+1 || edits[0] != diffEqual {
+		t.Fatal("lines are not replaced", len(edits))
+	}
+	aText, bText := []rune(strings.Join(a, "")), []rune(strings.Join(b, ""))
+	if got := testApply(t, 0, aText, Diff(aText, bText)); string(got) != string(bText) {
+		t.Fatal("replacing diff is wrong")
+	}
+}
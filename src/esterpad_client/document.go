@@ -0,0 +1,208 @@
+/*
+Esterpad online collaborative editor
+Copyright (C) 2017 Anon2Anon
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package esterpad_client
+
+import (
+	. "esterpad_utils"
+	"fmt"
+	"sync"
+)
+
+type futureDelta struct {
+	delta *SDelta
+	own   bool
+}
+
+type Document struct {
+	Text     []rune
+	Revision uint32
+	Pending  []*Op
+	Buffer   []*Op
+	server   []rune
+	future   map[uint32]futureDelta
+	acked    uint32
+	mutex    sync.Mutex
+}
+
+func NewDocument() *Document {
+	return &Document{Text: []rune{}, server: []rune{}, future: map[uint32]futureDelta{}}
+}
+
+func (d *Document) Reset(document *SDocument) error {
+	text, err := Apply([]rune{}, document.Ops)
+	if err != nil {
+		return err
+	}
+	d.mutex.Lock()
+	d.Text = text
+	d.server = text
+	d.Revision = document.Revision
+	d.Pending = nil
+	d.Buffer = nil
+	d.future = map[uint32]futureDelta{}
+	d.acked = 0
+	d.mutex.Unlock()
+	return nil
+}
+
+// Ack marks revision as the one the server stored the pending delta as, the
+// server acknowledges a delta before sending it back.
+func (d *Document) Ack(revision uint32) {
+	d.mutex.Lock()
+	if d.Pending != nil && revision > d.Revision {
+		d.acked = revision
+	}
+	d.mutex.Unlock()
+}
+
+func (d *Document) String() string {
+	d.mutex.Lock()
+	ret := string(d.Text)
+	d.mutex.Unlock()
+	return ret
+}
+
+func (d *Document) Len() int {
+	d.mutex.Lock()
+	ret := len(d.Text)
+	d.mutex.Unlock()
+	return ret
+}
+
+func (d *Document) ApplyLocal(ops []*Op) (*CDelta, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.applyLocal(ops)
+}
+
+func (d *Document) applyLocal(ops []*Op) (*CDelta, error) {
+	text, err := Apply(d.Text, ops)
+	if err != nil {
+		return nil, err
+	}
+	d.Text = text
+	if d.Pending == nil {
+		d.Pending = ops
+		return &CDelta{d.Revision, ops, false}, nil
+	}
+	if d.Buffer == nil {
+		d.Buffer = ops
+	} else if d.Buffer, err = Compose(d.Buffer, ops); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+func (d *Document) ApplyLocalFrom(base []rune, ops []*Op) (*CDelta, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if string(base) != string(d.Text) {
+		newOps, _, err := Transform(ops, Diff(base, d.Text))
+		if err != nil {
+			return nil, err
+		}
+		ops = newOps
+	}
+	return d.applyLocal(ops)
+}
+
+// deltaBase returns the revision delta applies to, coalesced deltas span
+// Count revisions.
+func deltaBase(delta *SDelta) uint32 {
+	if delta.Count > 1 {
+		return delta.Id - delta.Count
+	}
+	return delta.Id - 1
+}
+
+// ApplyRemote applies a delta received from the server, own tells that it
+// is the pending delta coming back. Deltas of revision given to Ack are own
+// too, other deltas are rebased over local changes. When the server stored
+// the pending delta changed, e.g. as a suggestion, the difference is applied
+// like a remote delta.
+func (d *Document) ApplyRemote(delta *SDelta, own bool) ([]*SDelta, *CDelta, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if delta.Id <= d.Revision {
+		return nil, nil, nil
+	}
+	if base := deltaBase(delta); base > d.Revision {
+		d.future[base+1] = futureDelta{delta, own}
+		return nil, nil, nil
+	} else if base < d.Revision {
+		return nil, nil, fmt.Errorf("delta %d based on revision %d overlaps revision %d", delta.Id, base, d.Revision)
+	}
+	applied := []*SDelta{}
+	acked := false
+	for delta != nil {
+		server, err := Apply(d.server, delta.Ops)
+		if err != nil {
+			return applied, nil, err
+		}
+		ops := delta.Ops
+		if (own || delta.Id == d.acked) && d.Pending != nil {
+			assumed, err := Apply(d.server, d.Pending)
+			if err != nil {
+				return applied, nil, err
+			}
+			d.Pending = d.Buffer
+			d.Buffer = nil
+			d.acked = 0
+			acked = true
+			ops = nil
+			if string(assumed) != string(server) {
+				ops = Diff(assumed, server)
+			}
+		}
+		if ops != nil {
+			if d.Pending != nil {
+				pending, newOps, err := Transform(d.Pending, ops)
+				if err != nil {
+					return applied, nil, err
+				}
+				d.Pending = pending
+				ops = newOps
+			}
+			if d.Buffer != nil {
+				buffer, newOps, err := Transform(d.Buffer, ops)
+				if err != nil {
+					return applied, nil, err
+				}
+				d.Buffer = buffer
+				ops = newOps
+			}
+			text, err := Apply(d.Text, ops)
+			if err != nil {
+				return applied, nil, err
+			}
+			d.Text = text
+			applied = append(applied, &SDelta{delta.Id, delta.UserId, ops, delta.Count})
+		}
+		d.server = server
+		d.Revision = delta.Id
+		next := d.future[d.Revision+1]
+		delete(d.future, d.Revision+1)
+		delta = next.delta
+		own = next.own
+	}
+	if acked && d.Pending != nil {
+		return applied, &CDelta{d.Revision, d.Pending, false}, nil
+	}
+	return applied, nil, nil
+}
@@ -0,0 +1,140 @@
+/*
+Esterpad online collaborative editor
+Copyright (C) 2017 Anon2Anon
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package esterpad_client
+
+import (
+	. "esterpad_utils"
+	"testing"
+)
+
+func testDocument(t *testing.T, text string, revision uint32) *Document {
+	d := NewDocument()
+	if err := d.Reset(&SDocument{revision, AddInsert(nil, text, nil), 0}); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func testRemote(t *testing.T, d *Document, delta *SDelta, own bool) *CDelta {
+	_, cdelta, err := d.ApplyRemote(delta, own)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cdelta
+}
+
+func TestDocumentPendingAck(t *testing.T) {
+	d := testDocument(t, "hello", 1)
+	cdelta, err := d.ApplyLocal(AddInsert(AddRetain(nil, 5, nil), "!", nil))
+	if err != nil || cdelta == nil || cdelta.Revision != 1 {
+		t.Fatalf("first local delta %v %v", cdelta, err)
+	}
+	for _, ops := range [][]*Op{
+		AddInsert(AddRetain(nil, 6, nil), "?", nil),
+		AddInsert(AddRetain(nil, 7, nil), "?", nil),
+	} {
+		if cdelta, err := d.ApplyLocal(ops); err != nil || cdelta != nil {
+			t.Fatalf("delta sent while one is pending %v %v", cdelta, err)
+		}
+	}
+
+	// a concurrent delta of another user is rebased over pending and buffer
+	testRemote(t, d, &SDelta{2, 2, AddRetain(AddInsert(nil, ">", nil), 5, nil), 1}, false)
+	if text := d.String(); text != ">hello!??" {
+		t.Fatalf("after remote delta %q", text)
+	}
+	// the server rebased the pending delta over the remote one
+	cdelta = testRemote(t, d, &SDelta{3, 1, AddInsert(AddRetain(nil, 6, nil), "!", nil), 1}, true)
+	if cdelta == nil || cdelta.Revision != 3 || d.Buffer != nil {
+		t.Fatalf("buffer not sent after ack %v", cdelta)
+	}
+	if text, err := Apply([]rune(">hello!"), cdelta.Ops); err != nil || string(text) != ">hello!??" {
+		t.Fatalf("buffer gives %q %v", string(text), err)
+	}
+	if cdelta := testRemote(t, d, &SDelta{4, 1, cdelta.Ops, 1}, true); cdelta != nil || d.Pending != nil || d.Revision != 4 {
+		t.Fatalf("second ack %v, pending %v, revision %d", cdelta, d.Pending, d.Revision)
+	}
+}
+
+func TestDocumentFuture(t *testing.T) {
+	d := testDocument(t, "ab", 1)
+	testRemote(t, d, &SDelta{3, 2, AddInsert(AddRetain(nil, 3, nil), "d", nil), 1}, false)
+	if d.Revision != 1 || d.String() != "ab" {
+		t.Fatalf("future delta applied %d %q", d.Revision, d.String())
+	}
+	applied, _, err := d.ApplyRemote(&SDelta{2, 2, AddInsert(AddRetain(nil, 2, nil), "c", nil), 1}, false)
+	if err != nil || len(applied) != 2 || d.Revision != 3 || d.String() != "abcd" {
+		t.Fatalf("queued delta not applied %v %v, revision %d %q", applied, err, d.Revision, d.String())
+	}
+	// a coalesced delta spans revisions 4 and 5
+	testRemote(t, d, &SDelta{5, 2, AddInsert(AddRetain(nil, 4, nil), "ef", nil), 2}, false)
+	if d.Revision != 5 || d.String() != "abcdef" {
+		t.Fatalf("coalesced delta gives %d %q", d.Revision, d.String())
+	}
+	if _, _, err := d.ApplyRemote(&SDelta{7, 2, AddRetain(nil, 6, nil), 3}, false); err == nil {
+		t.Fatal("overlapping delta applied")
+	}
+}
+
+func TestDocumentAckRevision(t *testing.T) {
+	c := &Client{UserId: 1, Capabilities: CapAcks, Document: testDocument(t, "hello", 1)}
+	d := c.Document
+	if cdelta, err := d.ApplyLocal(AddInsert(AddRetain(nil, 5, nil), "!", nil)); err != nil || cdelta == nil {
+		t.Fatalf("local delta %v %v", cdelta, err)
+	}
+	process := func(m *SMessage) {
+		if err := c.process(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// an undo of the same user in another tab doesn't ack the pending delta
+	process(&SMessage{&SMessage_Delta{&SDelta{2, 1, AddRetain(AddInsert(nil, ">", nil), 5, nil), 1}}})
+	if d.Pending == nil || d.Revision != 2 || d.String() != ">hello!" {
+		t.Fatalf("foreign delta of the user taken as ack, pending %v, revision %d %q", d.Pending, d.Revision, d.String())
+	}
+	process(&SMessage{&SMessage_Ack{&SAck{2, 3}}})
+	process(&SMessage{&SMessage_Delta{&SDelta{3, 1, AddInsert(AddRetain(nil, 6, nil), "!", nil), 1}}})
+	if d.Pending != nil || d.Revision != 3 || d.String() != ">hello!" {
+		t.Fatalf("acked delta gives pending %v, revision %d %q", d.Pending, d.Revision, d.String())
+	}
+}
+
+func TestDocumentSuggestion(t *testing.T) {
+	d := testDocument(t, "hello", 1)
+	if cdelta, err := d.ApplyLocal(AddRetain(AddDelete(nil, 2), 3, nil)); err != nil || cdelta == nil {
+		t.Fatalf("local delta %v %v", cdelta, err)
+	}
+	if _, err := d.ApplyLocal(AddInsert(AddRetain(nil, 3, nil), "!", nil)); err != nil {
+		t.Fatal(err)
+	}
+	// the server kept the deleted text, marked for deletion
+	applied, cdelta, err := d.ApplyRemote(&SDelta{2, 1, AddRetain(nil, 5, &OpMeta{Changemask: 1}), 1}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.String() != "hello!" || d.Revision != 2 || len(applied) != 1 {
+		t.Fatalf("stored delta gives %q, revision %d, applied %v", d.String(), d.Revision, applied)
+	}
+	if cdelta == nil || cdelta.Revision != 2 {
+		t.Fatalf("buffer not sent after ack %v", cdelta)
+	}
+	if text, err := Apply([]rune("hello"), cdelta.Ops); err != nil || string(text) != "hello!" {
+		t.Fatalf("buffer gives %q %v", string(text), err)
+	}
+}
@@ -0,0 +1,249 @@
+/*
+Esterpad online collaborative editor
+Copyright (C) 2017 Anon2Anon
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package esterpad_client
+
+import (
+	"errors"
+	. "esterpad_utils"
+)
+
+var ErrOpsLength = errors.New("ops length mismatch")
+
+// EmbedRune stands for an embedded object in document text.
+const EmbedRune = '\uFFFC'
+
+const (
+	opInsert = 0
+	opDelete = 1
+	opRetain = 2
+	opEnd    = -1
+)
+
+type opIter struct {
+	ops   []*Op
+	pos   int
+	typ   int
+	text  []rune
+	len   uint32
+	meta  *OpMeta
+	embed *OpEmbed
+}
+
+func newOpIter(ops []*Op) *opIter {
+	it := &opIter{ops: ops}
+	it.next()
+	return it
+}
+
+func (it *opIter) next() {
+	it.typ = opEnd
+	for it.pos < len(it.ops) {
+		op := it.ops[it.pos]
+		it.pos++
+		it.embed = nil
+		switch op := op.Op.(type) {
+		case *Op_Embed:
+			it.text = []rune{EmbedRune}
+			it.len = 1
+			it.meta = op.Embed.Meta
+			it.embed = op.Embed
+			it.typ = opInsert
+		case *Op_Insert:
+			it.text = []rune(op.Insert.Text)
+			it.len = uint32(len(it.text))
+			it.meta = op.Insert.Meta
+			it.typ = opInsert
+		case *Op_Delete:
+			it.len = op.Delete.Len
+			it.meta = nil
+			it.typ = opDelete
+		case *Op_Retain:
+			it.len = op.Retain.Len
+			it.meta = op.Retain.Meta
+			it.typ = opRetain
+		}
+		if it.typ != opEnd && it.len > 0 {
+			return
+		}
+		it.typ = opEnd
+	}
+}
+
+func (it *opIter) take(n uint32) {
+	if n == it.len {
+		it.next()
+		return
+	}
+	if it.typ == opInsert {
+		it.text = it.text[n:]
+	}
+	it.len -= n
+}
+
+func AddInsert(ops []*Op, text string, meta *OpMeta) []*Op {
+	if len(text) == 0 {
+		return ops
+	}
+	if len(ops) > 0 {
+		if op, ok := ops[len(ops)-1].Op.(*Op_Insert); ok && op.Insert.Meta == meta {
+			op.Insert.Text += text
+			return ops
+		}
+	}
+	return append(ops, &Op{&Op_Insert{&OpInsert{text, meta}}})
+}
+
+func AddEmbed(ops []*Op, embed *OpEmbed) []*Op {
+	return append(ops, &Op{&Op_Embed{embed}})
+}
+
+// addInsertFrom adds text taken from insert iterator it, keeping the embed
+// if it points to one.
+func addInsertFrom(ops []*Op, it *opIter, text []rune, meta *OpMeta) []*Op {
+	if it.embed != nil {
+		return AddEmbed(ops, &OpEmbed{it.embed.Type, it.embed.Ref, it.embed.Name, it.embed.Checked, meta})
+	}
+	return AddInsert(ops, string(text), meta)
+}
+
+func AddDelete(ops []*Op, n uint32) []*Op {
+	if n == 0 {
+		return ops
+	}
+	if len(ops) > 0 {
+		if op, ok := ops[len(ops)-1].Op.(*Op_Delete); ok {
+			op.Delete.Len += n
+			return ops
+		}
+	}
+	return append(ops, &Op{&Op_Delete{&OpDelete{n}}})
+}
+
+func AddRetain(ops []*Op, n uint32, meta *OpMeta) []*Op {
+	if n == 0 {
+		return ops
+	}
+	if len(ops) > 0 {
+		if op, ok := ops[len(ops)-1].Op.(*Op_Retain); ok && op.Retain.Meta == meta {
+			op.Retain.Len += n
+			return ops
+		}
+	}
+	return append(ops, &Op{&Op_Retain{&OpRetain{n, meta}}})
+}
+
+func minLen(a uint32, b uint32) uint32 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func Apply(text []rune, ops []*Op) ([]rune, error) {
+	ret := make([]rune, 0, len(text))
+	pos := uint32(0)
+	textLen := uint32(len(text))
+	for it := newOpIter(ops); it.typ != opEnd; it.next() {
+		switch it.typ {
+		case opInsert:
+			ret = append(ret, it.text...)
+		case opDelete:
+			if pos+it.len > textLen {
+				return nil, ErrOpsLength
+			}
+			pos += it.len
+		case opRetain:
+			if pos+it.len > textLen {
+				return nil, ErrOpsLength
+			}
+			ret = append(ret, text[pos:pos+it.len]...)
+			pos += it.len
+		}
+	}
+	if pos != textLen {
+		return nil, ErrOpsLength
+	}
+	return ret, nil
+}
+
+func Compose(a []*Op, b []*Op) ([]*Op, error) {
+	ret := []*Op{}
+	ai := newOpIter(a)
+	bi := newOpIter(b)
+	for ai.typ != opEnd || bi.typ != opEnd {
+		if bi.typ == opInsert {
+			ret = addInsertFrom(ret, bi, bi.text, bi.meta)
+			bi.next()
+		} else if ai.typ == opDelete {
+			ret = AddDelete(ret, ai.len)
+			ai.next()
+		} else if ai.typ == opEnd || bi.typ == opEnd {
+			return nil, ErrOpsLength
+		} else {
+			n := minLen(ai.len, bi.len)
+			meta := ai.meta
+			if bi.meta != nil {
+				meta = bi.meta
+			}
+			if ai.typ == opRetain && bi.typ == opRetain {
+				ret = AddRetain(ret, n, meta)
+			} else if ai.typ == opRetain && bi.typ == opDelete {
+				ret = AddDelete(ret, n)
+			} else if ai.typ == opInsert && bi.typ == opRetain {
+				ret = addInsertFrom(ret, ai, ai.text[:n], meta)
+			}
+			ai.take(n)
+			bi.take(n)
+		}
+	}
+	return ret, nil
+}
+
+func Transform(a []*Op, b []*Op) ([]*Op, []*Op, error) {
+	an := []*Op{}
+	bn := []*Op{}
+	ai := newOpIter(a)
+	bi := newOpIter(b)
+	for ai.typ != opEnd || bi.typ != opEnd {
+		if ai.typ == opInsert {
+			an = addInsertFrom(an, ai, ai.text, ai.meta)
+			bn = AddRetain(bn, ai.len, nil)
+			ai.next()
+		} else if bi.typ == opInsert {
+			an = AddRetain(an, bi.len, nil)
+			bn = addInsertFrom(bn, bi, bi.text, bi.meta)
+			bi.next()
+		} else if ai.typ == opEnd || bi.typ == opEnd {
+			return nil, nil, ErrOpsLength
+		} else {
+			n := minLen(ai.len, bi.len)
+			if ai.typ == opRetain && bi.typ == opRetain {
+				an = AddRetain(an, n, ai.meta)
+				bn = AddRetain(bn, n, bi.meta)
+			} else if ai.typ == opDelete && bi.typ == opRetain {
+				an = AddDelete(an, n)
+			} else if ai.typ == opRetain && bi.typ == opDelete {
+				bn = AddDelete(bn, n)
+			}
+			ai.take(n)
+			bi.take(n)
+		}
+	}
+	return an, bn, nil
+}
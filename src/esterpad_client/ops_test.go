@@ -0,0 +1,107 @@
+/*
+Esterpad online collaborative editor
+Copyright (C) 2017 Anon2Anon
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package esterpad_client
+
+import (
+	. "esterpad_utils"
+	"math/rand"
+	"testing"
+)
+
+const testIterations = 500
+
+func testRandomText(r *rand.Rand) string {
+	alphabet := []rune("ab\nя😀")
+	text := make([]rune, 1+r.Intn(4))
+	for i := range text {
+		text[i] = alphabet[r.Intn(len(alphabet))]
+	}
+	return string(text)
+}
+
+// testRandomOps returns random ops for a text of length runes.
+func testRandomOps(r *rand.Rand, length uint32) []*Op {
+	ops := []*Op{}
+	for length > 0 {
+		n := 1 + uint32(r.Intn(4))
+		if n > length {
+			n = length
+		}
+		switch r.Intn(4) {
+		case 0:
+			ops = AddInsert(ops, testRandomText(r), nil)
+		case 1:
+			ops = AddDelete(ops, n)
+			length -= n
+		default:
+			ops = AddRetain(ops, n, nil)
+			length -= n
+		}
+	}
+	if r.Intn(2) == 0 {
+		ops = AddInsert(ops, testRandomText(r), nil)
+	}
+	return ops
+}
+
+func testApply(t *testing.T, seed int, text []rune, ops []*Op) []rune {
+	ret, err := Apply(text, ops)
+	if err != nil {
+		t.Fatalf("seed %d: apply %v to %q: %v", seed, ops, string(text), err)
+	}
+	return ret
+}
+
+func TestComposeMatchesApply(t *testing.T) {
+	for seed := 0; seed < testIterations; seed++ {
+		r := rand.New(rand.NewSource(int64(seed)))
+		text := []rune(testRandomText(r) + testRandomText(r))
+		a := testRandomOps(r, uint32(len(text)))
+		afterA := testApply(t, seed, text, a)
+		b := testRandomOps(r, uint32(len(afterA)))
+		composed, err := Compose(a, b)
+		if err != nil {
+			t.Fatalf("seed %d: compose: %v", seed, err)
+		}
+		if got, want := string(testApply(t, seed, text, composed)), string(testApply(t, seed, afterA, b)); got != want {
+			t.Fatalf("seed %d: composed gives %q want %q", seed, got, want)
+		}
+	}
+}
+
+func TestTransformConverges(t *testing.T) {
+	for seed := 0; seed < testIterations; seed++ {
+		r := rand.New(rand.NewSource(int64(seed)))
+		text := []rune(testRandomText(r) + testRandomText(r))
+		a := testRandomOps(r, uint32(len(text)))
+		b := testRandomOps(r, uint32(len(text)))
+		an, bn, err := Transform(a, b)
+		if err != nil {
+			t.Fatalf("seed %d: transform: %v", seed, err)
+		}
+		ab := testApply(t, seed, testApply(t, seed, text, a), bn)
+		ba := testApply(t, seed, testApply(t, seed, text, b), an)
+		if string(ab) != string(ba) {
+			t.Fatalf("seed %d: %q and %q diverged", seed, string(ab), string(ba))
+		}
+	}
+	if _, _, err := Transform(AddRetain(nil, 2, nil), AddRetain(nil, 3, nil)); err != ErrOpsLength {
+		t.Fatal("ops of different lengths transformed")
+	}
+}
@@ -0,0 +1,213 @@
+/*
+Esterpad online collaborative editor
+Copyright (C) 2017 Anon2Anon
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package esterpad_sync
+
+import (
+	"esterpad_client"
+	. "esterpad_utils"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"time"
+)
+
+const (
+	pollPeriod  = 500 * time.Millisecond
+	settleDelay = 2 * time.Second
+)
+
+type Sync struct {
+	client  *esterpad_client.Client
+	path    string
+	synced  []rune
+	modTime time.Time
+	size    int64
+	ready   bool
+	updates chan bool
+}
+
+func PrintUsage() {
+	fmt.Println("Usage:", os.Args[0], "[server address] [pad name] [file] [session id]")
+	fmt.Println("  server address - Server address in host:port format (ex. localhost:9000)")
+	fmt.Println("  pad name - name of pad to mirror")
+	fmt.Println("  file - local file which is kept in sync with the pad")
+	fmt.Println("  session id - optional parameter, session to log in with, guest login is used otherwise")
+	os.Exit(1)
+}
+
+func (s *Sync) notify() {
+	select {
+	case s.updates <- true:
+	default:
+	}
+}
+
+func (s *Sync) readLocal() ([]rune, bool) {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Println("Stat error", err)
+		}
+		return nil, false
+	}
+	if info.ModTime().Equal(s.modTime) && info.Size() == s.size {
+		return nil, false
+	}
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		fmt.Println("Read error", err)
+		return nil, false
+	}
+	s.modTime = info.ModTime()
+	s.size = info.Size()
+	return []rune(string(data)), true
+}
+
+func (s *Sync) writeLocal(text []rune) {
+	if err := ioutil.WriteFile(s.path, []byte(string(text)), 0644); err != nil {
+		fmt.Println("Write error", err)
+		return
+	}
+	if info, err := os.Stat(s.path); err == nil {
+		s.modTime = info.ModTime()
+		s.size = info.Size()
+	}
+	s.synced = text
+}
+
+func (s *Sync) pushLocal() {
+	text, changed := s.readLocal()
+	if !changed || string(text) == string(s.synced) {
+		return
+	}
+	fmt.Println("Local file changed, sending delta")
+	if err := s.client.EditFrom(s.synced, esterpad_client.Diff(s.synced, text)); err != nil {
+		fmt.Println("Send delta error", err)
+		return
+	}
+	s.synced = text
+}
+
+func (s *Sync) pullRemote() {
+	text := []rune(s.client.Document.String())
+	if string(text) != string(s.synced) {
+		s.writeLocal(text)
+	}
+}
+
+func (s *Sync) start() {
+	s.ready = true
+	text, exist := s.readLocal()
+	remote := []rune(s.client.Document.String())
+	if exist && len(remote) == 0 && len(text) > 0 {
+		fmt.Println("Pad is empty, uploading local file")
+		if err := s.client.EditFrom(remote, esterpad_client.Diff(remote, text)); err != nil {
+			fmt.Println("Send delta error", err)
+		}
+		s.synced = text
+		return
+	}
+	s.writeLocal(remote)
+}
+
+func (s *Sync) Loop() {
+	ticker := time.NewTicker(pollPeriod)
+	defer ticker.Stop()
+	settle := time.After(settleDelay)
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, os.Interrupt)
+	for {
+		select {
+		case <-signalChan:
+			if s.ready {
+				s.pushLocal()
+			}
+			s.client.Close()
+			return
+		case <-settle:
+			if !s.ready {
+				s.start()
+			}
+		case _, ok := <-s.updates:
+			if !ok {
+				return
+			}
+			if s.ready {
+				s.pushLocal()
+				s.pullRemote()
+			}
+		case <-ticker.C:
+			if s.ready {
+				s.pushLocal()
+			}
+		}
+	}
+}
+
+func Main() {
+	if len(os.Args) < 4 {
+		PrintUsage()
+	}
+	client, err := esterpad_client.Dial(os.Args[1])
+	if err != nil {
+		fmt.Println("Websocket connect error", err)
+		os.Exit(1)
+	}
+	s := &Sync{client: client, path: os.Args[3], updates: make(chan bool, 1)}
+	padName := os.Args[2]
+	client.OnAuth = func(auth *SAuth) {
+		fmt.Println("Logged in as", auth.Nickname)
+		if err := client.EnterPad(padName); err != nil {
+			fmt.Println("Enter pad error", err)
+		}
+	}
+	client.OnError = func(err *SError) {
+		fmt.Println("Server error:", err.Message)
+		switch err.Request {
+		case "Session", "Login", "EnterPad":
+			os.Exit(1)
+		}
+	}
+	client.OnDocument = func(document *esterpad_client.Document) {
+		s.notify()
+	}
+	client.OnDelta = func(delta *SDelta) {
+		s.notify()
+	}
+	client.OnDeltaDropped = func(dropped *SDeltaDropped) {
+		fmt.Println("Delta dropped by server, resyncing:", dropped.Reason)
+	}
+	if len(os.Args) > 4 {
+		err = client.Session(os.Args[4])
+	} else {
+		err = client.GuestLogin()
+	}
+	if err != nil {
+		fmt.Println("Login error", err)
+		os.Exit(1)
+	}
+	go func() {
+		if err := client.Run(); err != nil {
+			fmt.Println("Server gone", err)
+		}
+		close(s.updates)
+	}()
+	s.Loop()
+}
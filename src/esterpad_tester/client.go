@@ -42,9 +42,15 @@ type Client struct {
 func (c *Client) RenderDelta(ops []*Op) {
 	pos := 0
 	for _, op := range ops {
+		insertText := []rune(nil)
 		switch op := op.Op.(type) {
+		case *Op_Embed:
+			insertText = []rune{'\uFFFC'}
 		case *Op_Insert:
-			insertText := []rune(op.Insert.Text)
+			insertText = []rune(op.Insert.Text)
+		}
+		switch op := op.Op.(type) {
+		case *Op_Insert, *Op_Embed:
 			newText := make([]rune, len(c.text)+len(insertText))
 			copy(newText, c.text[:pos])
 			copy(newText[pos:], insertText)
@@ -97,7 +103,7 @@ func (c *Client) GenerateFlag() *CDelta {
 		ops = append(ops, &Op{&Op_Retain{&OpRetain{Len: uint32(end - left)}}})
 	}
 	c.magicWordChannel <- flag
-	return &CDelta{revision, ops}
+	return &CDelta{revision, ops, false}
 }
 
 func (c *Client) GenerateDelta() *CDelta {
@@ -140,7 +146,7 @@ func (c *Client) GenerateDelta() *CDelta {
 			ops = append(ops, &Op{&Op_Retain{&OpRetain{Len: uint32(end - left)}}})
 		}
 	}
-	return &CDelta{revision, ops}
+	return &CDelta{revision, ops, false}
 }
 
 func (c *Client) Write(wsConn *websocket.Conn) {
@@ -168,11 +174,13 @@ func (c *Client) Write(wsConn *websocket.Conn) {
 }
 
 func (c *Client) Process(wsConn *websocket.Conn) {
+	message0 := CHello{1, 0, "esterpad_tester"}
 	message1 := CSession{""}
-	message2 := CEnterPad{c.padName}
+	message2 := CEnterPad{c.padName, 0, ""}
+	smessage0 := &CMessage{&CMessage_Hello{&message0}}
 	smessage1 := &CMessage{&CMessage_Session{&message1}}
 	smessage2 := &CMessage{&CMessage_EnterPad{&message2}}
-	welcomeDataBytes, err := proto.Marshal(&CMessages{Cm: []*CMessage{smessage1, smessage2}})
+	welcomeDataBytes, err := proto.Marshal(&CMessages{Cm: []*CMessage{smessage0, smessage1, smessage2}})
 	if err != nil {
 		fmt.Println("Client", c.id, "marshal err", err)
 		return